@@ -4,28 +4,70 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"cpipi1024.com/turtleDownloader/utils/bitfield"
 	"cpipi1024.com/turtleDownloader/utils/handshake"
 	"cpipi1024.com/turtleDownloader/utils/message"
+	"cpipi1024.com/turtleDownloader/utils/mse"
 	"cpipi1024.com/turtleDownloader/utils/peers"
 )
 
+// 本地torrent的连接参数, 主动连接和被动接受的连接共用
+type Config struct {
+	PeerID    [20]byte
+	InfoHash  [20]byte
+	NumPieces int                      // piece数量, 未知时为0
+	Registry  *Registry                // 扩展注册表, 为nil时不发送扩展握手
+	Have      func() bitfield.BitField // 本地已有的piece, 为nil时表示没有任何piece
+}
+
 // peer to peer TCP通信客户端
 type Client struct {
-	Conn     net.Conn          // tcp connection对象
-	Choked   bool              // 通信阻塞标志
-	BitField bitfield.BitField // peer承载数据的bitmap
-	peer     peers.Peer
-	infohash [20]byte
-	peerId   [20]byte
+	Conn        net.Conn          // tcp connection对象
+	Choked      bool              // 通信阻塞标志
+	BitField    bitfield.BitField // peer承载数据的bitmap
+	Reserved    [8]byte           // peer握手中的协议扩展标志位
+	Fast        bool              // 双方都支持Fast Extension
+	AllowedFast map[int]bool      // 对端允许在阻塞时请求的piece
+	Suggested   []int             // 对端建议下载的piece, 最多MaxSuggested个, 最新的在最后
+	Incoming    bool              // 由对端发起的连接
+	AmChoking   bool              // 本地是否阻塞对端的请求
+	Interested  bool              // 对端是否对本地的piece感兴趣
+	GrantedFast map[int]bool      // 允许对端在被阻塞时请求的piece
+	peer        peers.Peer
+	infohash    [20]byte
+	peerId      [20]byte
+	numPieces   int
+	registry    *Registry
+	extended    bool // 握手时已经发送扩展握手
+	gotBitField bool // 已经收到对端的bitfield或代替它的HaveAll, HaveNone
+	have        func() bitfield.BitField
+	pending     *message.Message // 代替bitfield收到的第一个消息, 下一次Read时返回
+
+	// 对端的扩展握手, 未收到时为nil; 由worker写入, 扩展可能在其他goroutine中读取
+	extMu      sync.Mutex
+	extensions *ExtHandshake
+
+	// Start之后由reader和writer goroutine使用
+	started   bool
+	msgs      chan *message.Message
+	readErr   error
+	outMu     sync.Mutex
+	outCond   *sync.Cond
+	out       [][]byte // 等待发送的消息
+	queued    int      // 等待发送的字节数
+	writeErr  error
+	lastWrite time.Time
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // peer进行握手
 func completeHandShake(conn net.Conn, infohash, peerID [20]byte) (*handshake.HandShake, error) {
 
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	conn.SetDeadline(deadline(Timeouts.Handshake))
 
 	defer conn.SetDeadline(time.Time{})
 
@@ -54,104 +96,336 @@ func completeHandShake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 }
 
 // 从连接中读取MsgBitField
-func reciveBitField(conn net.Conn) (bitfield.BitField, error) {
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
+//
+// 在MsgBitField之前收到的扩展消息会被分发给对应的扩展
+// 支持Fast Extension时也接受MsgHaveAll和MsgHaveNone
+// 没有任何piece的peer可以不发送bitfield, 此时第一个消息留给下一次Read
+func (c *Client) reciveBitField() (bitfield.BitField, error) {
+	c.Conn.SetDeadline(deadline(Timeouts.BitField))
 
-	defer conn.SetDeadline(time.Time{})
+	defer c.Conn.SetDeadline(time.Time{})
+
+	msg, err := c.Read()
 
-	msg, err := message.ReadMessage(conn)
+	for err == nil && (msg == nil || msg.ID == message.MsgExtended || msg.ID == message.MsgAllowedFast || msg.ID == message.MsgSuggest) {
+		msg, err = c.Read()
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	if msg == nil {
-		err := fmt.Errorf("client read bitfield msg failed")
-		return nil, err
+	if c.Fast && (msg.ID == message.MsgHaveAll || msg.ID == message.MsgHaveNone) {
+		return c.BitField, nil
 	}
 
 	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("expect bitfield msg ID:%d but got:%d", message.MsgBitfield, msg.ID)
-		return nil, err
+		c.pending = msg
+		return newBitField(c.numPieces, false), nil
 	}
 
 	return msg.PayLoad, nil
 }
 
-// 批量创建多个client与传入的peer通信
-func NewClient(peer peers.Peer, peerID, infohash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 5*time.Second)
+// 发送本地的bitfield, 支持Fast Extension时使用HaveAll或HaveNone代替
+func (c *Client) sendBitField() error {
+	var bf bitfield.BitField
+
+	if c.have != nil {
+		bf = c.have()
+	}
+
+	count := 0
+
+	for i := 0; i < c.numPieces; i++ {
+		if bf.HasPiece(i) {
+			count++
+		}
+	}
+
+	var m *message.Message
+
+	switch {
+	case c.Fast && count == 0:
+		m = &message.Message{ID: message.MsgHaveNone}
+	case c.Fast && count == c.numPieces:
+		m = &message.Message{ID: message.MsgHaveAll}
+	case count == 0:
+		// 没有piece时可以不发送bitfield
+		return nil
+	default:
+		m = &message.Message{ID: message.MsgBitfield, PayLoad: bf}
+	}
+
+	return c.write(m, false)
+}
+
+// 握手完成后的初始化: 发送bitfield, 扩展握手和allowed fast集合, 然后接收对端的bitfield
+func (c *Client) setup(hs *handshake.HandShake) error {
+	err := c.sendBitField()
+
+	if err != nil {
+		return err
+	}
+
+	if c.registry != nil && hs.SupportsExtensions() {
+		err = c.sendExtHandshake()
+
+		if err != nil {
+			return err
+		}
+
+		c.extended = true
+	}
+
+	if c.Fast {
+		err = c.sendAllowedFast()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// 接受 msgBitFiled
+	bf, err := c.reciveBitField()
+
+	if err != nil {
+		return err
+	}
+
+	c.BitField = bf
+	c.gotBitField = true
+
+	if c.registry != nil {
+		c.registry.connected(c)
+	}
+
+	return nil
+}
+
+func newClient(conn net.Conn, peer peers.Peer, hs *handshake.HandShake, cfg *Config) *Client {
+	c := &Client{
+		Conn:        conn,
+		Choked:      true,
+		AmChoking:   true,
+		Reserved:    hs.Reserved,
+		Fast:        hs.SupportsFast(),
+		AllowedFast: make(map[int]bool),
+		GrantedFast: make(map[int]bool),
+		peer:        peer,
+		infohash:    cfg.InfoHash,
+		peerId:      cfg.PeerID,
+		numPieces:   cfg.NumPieces,
+		registry:    cfg.Registry,
+		have:        cfg.Have,
+		done:        make(chan struct{}),
+	}
+
+	c.outCond = sync.NewCond(&c.outMu)
+
+	return c
+}
+
+// 创建client与传入的peer通信
+//
+// cfg.Registry不为nil且peer支持扩展协议时, 握手后发送扩展握手
+func NewClient(peer peers.Peer, cfg *Config) (*Client, error) {
+	conn, err := dial(peer, cfg.InfoHash)
 	if err != nil {
 		return nil, err
 	}
 
 	// 先与peer进行握手
-	_, err = completeHandShake(conn, infohash, peerID)
+	hs, err := completeHandShake(conn, cfg.InfoHash, cfg.PeerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	// 接受 msgBitFiled
-	bf, err := reciveBitField(conn)
+	c := newClient(conn, peer, hs, cfg)
+
+	err = c.setup(hs)
+
+	if err != nil {
+		c.Conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// 处理对端发起的连接, hs为已经读取的对端握手
+func Accept(conn net.Conn, hs *handshake.HandShake, cfg *Config) (*Client, error) {
+	conn.SetDeadline(deadline(Timeouts.Handshake))
+
+	_, err := conn.Write(handshake.New(cfg.InfoHash, cfg.PeerID).Serialize())
+
+	conn.SetDeadline(time.Time{})
 
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   false,
-		BitField: bf,
-		peer:     peer,
-		infohash: infohash,
-		peerId:   peerID,
-	}, nil
+	var peer peers.Peer
+
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		peer = peers.Peer{IP: addr.IP, Port: uint(addr.Port)}
+	case *net.UDPAddr:
+		peer = peers.Peer{IP: addr.IP, Port: uint(addr.Port)}
+	}
+
+	c := newClient(conn, peer, hs, cfg)
+	c.Incoming = true
+
+	err = c.setup(hs)
+
+	if err != nil {
+		c.Conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// 关闭连接并通知扩展, 可以多次调用
+func (c *Client) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		if c.registry != nil {
+			c.registry.closed(c)
+		}
+
+		close(c.done)
+		c.shutdown(ErrClosed)
+
+		err = c.Conn.Close()
+	})
+
+	return err
+}
+
+// 对端peer
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+// 连接是否使用MSE加密
+func (c *Client) Encrypted() bool {
+	ec, ok := c.Conn.(*mse.Conn)
+
+	return ok && ec.Encrypted()
+}
+
+// 连接是否使用uTP
+func (c *Client) OverUTP() bool {
+	_, ok := c.Conn.RemoteAddr().(*net.UDPAddr)
+
+	return ok
+}
+
+// 对端是否拥有所有piece, 需要在处理消息的goroutine中调用
+func (c *Client) HasAll() bool {
+	if c.numPieces == 0 {
+		return false
+	}
+
+	for i := 0; i < c.numPieces; i++ {
+		if !c.BitField.HasPiece(i) {
+			return false
+		}
+	}
+
+	return true
 }
 
 // 客户端读取的消息
+//
+// 扩展消息以及Fast Extension的状态消息会先在client中处理, 再返回给调用方
+// Start之后从reader goroutine接收消息
 func (c *Client) Read() (*message.Message, error) {
+	if c.msgs != nil {
+		msg, ok := <-c.msgs
+
+		if !ok {
+			return nil, c.Err()
+		}
+
+		return msg, c.Handle(msg)
+	}
+
+	if c.pending != nil {
+		msg := c.pending
+		c.pending = nil
+
+		return msg, nil
+	}
+
 	msg, err := message.ReadMessage(c.Conn)
-	return msg, err
+
+	if err != nil || msg == nil {
+		return msg, err
+	}
+
+	return msg, c.Handle(msg)
+}
+
+// 在client中处理扩展消息和Fast Extension的状态消息
+//
+// 通过Messages接收的消息需要由调用方在同一个goroutine中处理
+func (c *Client) Handle(msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgExtended:
+		return c.handleExtended(msg)
+	case message.MsgHaveAll, message.MsgHaveNone, message.MsgSuggest, message.MsgAllowedFast:
+		if !c.Fast {
+			err := fmt.Errorf("peer %s sent %s without fast extension", c.peer, msg)
+			return err
+		}
+
+		return c.handleFast(msg)
+	}
+
+	return nil
 }
 
 // 客户端发送请求消息
 func (c *Client) SendRequest(begin, idx, length int) error {
-	req := message.FormatRequest(begin, idx, length)
-
-	_, err := c.Conn.Write(req.Serialize())
+	return c.write(message.FormatRequest(begin, idx, length), false)
+}
 
-	return err
+// 取消已经发送的请求
+func (c *Client) SendCancel(idx, begin, length int) error {
+	return c.write(message.FormatCancel(idx, begin, length), false)
 }
 
 func (c *Client) SendInterested() error {
-	m := message.Message{ID: message.MsgInterested}
-
-	_, err := c.Conn.Write(m.Serialize())
-
-	return err
+	return c.write(&message.Message{ID: message.MsgInterested}, false)
 }
 
 func (c *Client) SendNotInterested() error {
-	m := message.Message{ID: message.MsgNotInterested}
+	return c.write(&message.Message{ID: message.MsgNotInterested}, false)
+}
 
-	_, err := c.Conn.Write(m.Serialize())
+func (c *Client) SendUnchoke() error {
+	c.AmChoking = false
 
-	return err
+	return c.write(&message.Message{ID: message.MsgUnchoke}, false)
 }
-func (c *Client) SendUnchoke() error {
-	m := message.Message{ID: message.MsgUnchoke}
 
-	_, err := c.Conn.Write(m.Serialize())
+func (c *Client) SendChoke() error {
+	c.AmChoking = true
 
-	return err
+	return c.write(&message.Message{ID: message.MsgChoke}, false)
 }
 
-func (c *Client) SendHave(idx int) error {
-	m := message.FromHava(idx)
-
-	_, err := c.Conn.Write(m.Serialize())
+// 发送请求的block数据, 发送队列过长时等待
+func (c *Client) SendPiece(idx, begin int, data []byte) error {
+	return c.write(message.FormatPiece(idx, begin, data), true)
+}
 
-	return err
+func (c *Client) SendHave(idx int) error {
+	return c.write(message.FromHava(idx), false)
 }
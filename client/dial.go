@@ -0,0 +1,138 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/mse"
+	"cpipi1024.com/turtleDownloader/utils/peers"
+	"cpipi1024.com/turtleDownloader/utils/utp"
+)
+
+// 连接peer时使用的加密策略
+var Encryption = mse.Preferred
+
+// 用于发起uTP连接的socket, 为nil时只使用TCP
+var UTP *utp.Socket
+
+// uTP连接的先行时间, 超过后同时尝试TCP
+const utpHeadStart = 500 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func dialUTP(addr string) (net.Conn, error) {
+	conn, err := UTP.DialTimeout(addr, Timeouts.Dial)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func dialTCP(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, Timeouts.Dial)
+}
+
+// 建立传输层连接, 优先使用uTP
+//
+// uTP在utpHeadStart内没有建立或者失败时同时尝试TCP, 使用先建立的连接
+func dialTransport(peer peers.Peer) (net.Conn, error) {
+	addr := peer.String()
+
+	if UTP == nil {
+		return dialTCP(addr)
+	}
+
+	results := make(chan dialResult, 2)
+
+	start := func(dial func(string) (net.Conn, error)) {
+		go func() {
+			conn, err := dial(addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start(dialUTP)
+
+	timer := time.NewTimer(utpHeadStart)
+	defer timer.Stop()
+
+	headStart := timer.C
+	pending := 1
+
+	var err error
+
+	for pending > 0 {
+		select {
+		case <-headStart:
+		case r := <-results:
+			pending--
+
+			if r.err == nil {
+				// 关闭稍后建立的另一个连接
+				go closeResults(results, pending)
+				return r.conn, nil
+			}
+
+			err = r.err
+		}
+
+		if headStart != nil {
+			headStart = nil
+			start(dialTCP)
+			pending++
+		}
+	}
+
+	return nil, err
+}
+
+func closeResults(results chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// 使用与conn相同的传输层重新连接
+func redial(peer peers.Peer, conn net.Conn) (net.Conn, error) {
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); ok && UTP != nil {
+		return dialUTP(peer.String())
+	}
+
+	return dialTCP(peer.String())
+}
+
+// 按照加密策略与peer建立连接
+//
+// 策略为Preferred时, 加密握手失败后使用明文重新连接
+func dial(peer peers.Peer, infohash [20]byte) (net.Conn, error) {
+	conn, err := dialTransport(peer)
+
+	if err != nil || Encryption == mse.Disabled {
+		return conn, err
+	}
+
+	conn.SetDeadline(deadline(Timeouts.Handshake))
+
+	ec, err := mse.Initiate(conn, infohash, Encryption.Provide(), nil)
+
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return ec, nil
+	}
+
+	conn.Close()
+
+	if Encryption == mse.Required {
+		return nil, err
+	}
+
+	// 已经知道可用的传输层, 不需要重新尝试uTP
+	return redial(peer, conn)
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+const (
+	maxQueuedBytes = 1 << 20          // 发送队列中的数据超过该大小时, SendPiece等待队列变短
+	maxBatchBytes  = 256 * 1024       // 一次写入的最大字节数
+	writeTimeout   = 60 * time.Second // 单次写入的超时时间
+)
+
+var ErrClosed = errors.New("client: connection closed")
+
+// 启动reader和writer goroutine
+//
+// 之后收到的消息通过Messages返回, 发送的消息先进入队列, 由writer合并后写入连接
+func (c *Client) Start() {
+	c.msgs = make(chan *message.Message, 16)
+
+	c.outMu.Lock()
+	c.started = true
+	c.lastWrite = time.Now()
+	c.outMu.Unlock()
+
+	go c.readLoop()
+	go c.writeLoop()
+	go c.keepAlive(Timeouts.KeepAlive)
+}
+
+// 对端发送的消息, 连接出错后关闭, 错误由Err返回
+//
+// 收到的消息需要先交给Handle处理
+func (c *Client) Messages() <-chan *message.Message {
+	return c.msgs
+}
+
+// reader goroutine退出的原因, 在Messages关闭之后有效
+func (c *Client) Err() error {
+	if c.readErr == nil {
+		return ErrClosed
+	}
+
+	return c.readErr
+}
+
+func (c *Client) readLoop() {
+	defer close(c.msgs)
+
+	if c.pending != nil {
+		c.msgs <- c.pending
+	}
+
+	for {
+		// 对端至少每隔Idle发送一次消息或keep-alive
+		c.Conn.SetReadDeadline(deadline(Timeouts.Idle))
+
+		msg, err := message.ReadMessage(c.Conn)
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = fmt.Errorf("peer %s silent for %v: %w", c.peer, Timeouts.Idle, err)
+		}
+
+		if err != nil {
+			c.readErr = err
+			c.shutdown(err)
+			return
+		}
+
+		// keep-alive
+		if msg == nil {
+			continue
+		}
+
+		select {
+		case c.msgs <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) writeLoop() {
+	for {
+		c.outMu.Lock()
+
+		for len(c.out) == 0 && c.writeErr == nil {
+			c.outCond.Wait()
+		}
+
+		if c.writeErr != nil {
+			c.outMu.Unlock()
+			return
+		}
+
+		// 合并队列中的消息, 一次写入
+		var buf []byte
+
+		n := 0
+
+		for n < len(c.out) && (n == 0 || len(buf)+len(c.out[n]) <= maxBatchBytes) {
+			buf = append(buf, c.out[n]...)
+			n++
+		}
+
+		c.out = c.out[n:]
+		c.queued -= len(buf)
+		c.outCond.Broadcast()
+		c.outMu.Unlock()
+
+		c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		c.outMu.Lock()
+		c.lastWrite = time.Now()
+		c.outMu.Unlock()
+	}
+}
+
+// 超过interval没有发送任何消息时发送keep-alive
+func (c *Client) keepAlive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.outMu.Lock()
+
+		if c.writeErr != nil {
+			c.outMu.Unlock()
+			return
+		}
+
+		if time.Since(c.lastWrite) >= interval && len(c.out) == 0 {
+			// 长度为0的消息
+			c.out = append(c.out, make([]byte, 4))
+			c.queued += 4
+			c.outCond.Broadcast()
+		}
+
+		c.outMu.Unlock()
+	}
+}
+
+// 写入失败或连接关闭, 唤醒所有等待的goroutine
+func (c *Client) shutdown(err error) {
+	c.outMu.Lock()
+
+	if c.writeErr == nil {
+		c.writeErr = err
+	}
+
+	c.out = nil
+	c.outCond.Broadcast()
+	c.outMu.Unlock()
+
+	c.Conn.Close()
+}
+
+// 发送消息, 启动之前直接写入连接
+//
+// wait为true时, 队列过长则等待writer发送, 用于较大的MsgPiece
+func (c *Client) write(m *message.Message, wait bool) error {
+	data := m.Serialize()
+
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if !c.started {
+		_, err := c.Conn.Write(data)
+
+		return err
+	}
+
+	for wait && c.queued > maxQueuedBytes && c.writeErr == nil {
+		c.outCond.Wait()
+	}
+
+	if c.writeErr != nil {
+		return ErrClosed
+	}
+
+	c.out = append(c.out, data)
+	c.queued += len(data)
+	c.outCond.Broadcast()
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+// 在测试期间使用tc作为超时时间
+func setTimeouts(t *testing.T, tc TimeoutConfig) {
+	old := Timeouts
+	Timeouts = tc
+
+	t.Cleanup(func() { Timeouts = old })
+}
+
+// 通过net.Pipe建立并启动的client, 返回对端的连接
+//
+// 结束时等待reader退出, 之后才恢复setTimeouts修改的超时时间
+func startedClient(t *testing.T) (*Client, net.Conn) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+
+	go func() {
+		if _, err := handshake.ReadHandShake(remote); err != nil {
+			return
+		}
+
+		remote.Write((&message.Message{ID: message.MsgBitfield, PayLoad: []byte{0}}).Serialize())
+	}()
+
+	c, err := Accept(local, &handshake.HandShake{Pstr: "BitTorrent protocol"}, &Config{NumPieces: 8})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Start()
+
+	t.Cleanup(func() {
+		c.Close()
+		remote.Close()
+
+		for range c.Messages() {
+		}
+	})
+
+	return c, remote
+}
+
+// 没有处理的消息积累到缓冲区大小之后不再读取, 对端的写入被阻塞
+func TestReaderBackpressure(t *testing.T) {
+	c, remote := startedClient(t)
+
+	const total = 100
+
+	var written int32
+
+	go func() {
+		for i := 0; i < total; i++ {
+			if _, err := remote.Write(message.FromHava(i % 8).Serialize()); err != nil {
+				return
+			}
+
+			atomic.AddInt32(&written, 1)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// 缓冲区中的消息, reader正在等待放入的一条, 以及正在写入的一条
+	if n := atomic.LoadInt32(&written); n > int32(cap(c.msgs))+2 {
+		t.Fatalf("peer wrote %d messages while none were handled", n)
+	}
+
+	for i := 0; i < total; i++ {
+		select {
+		case msg := <-c.Messages():
+			if msg == nil || msg.ID != message.MsgHave {
+				t.Fatalf("message %d = %v, want have", i, msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of %d messages", i, total)
+		}
+	}
+}
+
+// 对端不读取时, SendPiece在发送队列超过maxQueuedBytes之后等待
+func TestWriterBackpressure(t *testing.T) {
+	c, remote := startedClient(t)
+
+	const total = 200
+
+	block := make([]byte, 16*1024)
+
+	var sent int32
+
+	done := make(chan error, 1)
+
+	go func() {
+		for i := 0; i < total; i++ {
+			if err := c.SendPiece(0, 0, block); err != nil {
+				done <- err
+				return
+			}
+
+			atomic.AddInt32(&sent, 1)
+		}
+
+		done <- nil
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// 队列中的数据, writer正在写入的一批, 以及超过限制的最后一条
+	limit := (maxQueuedBytes+maxBatchBytes)/len(block) + 2
+
+	if n := atomic.LoadInt32(&sent); n == 0 || n > int32(limit) {
+		t.Fatalf("%d pieces queued while the peer was not reading, want 1 to %d", n, limit)
+	}
+
+	go io.Copy(io.Discard, remote)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sent %d of %d pieces after the peer started reading", atomic.LoadInt32(&sent), total)
+	}
+}
+
+// 没有发送其他消息时定期发送keep-alive
+func TestKeepAlive(t *testing.T) {
+	setTimeouts(t, TimeoutConfig{KeepAlive: 40 * time.Millisecond})
+
+	_, remote := startedClient(t)
+
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	msg, err := message.ReadMessage(remote)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg != nil {
+		t.Errorf("received %s, want keep-alive", msg)
+	}
+}
+
+// 对端超过Idle没有发送任何消息时断开
+func TestIdleTimeout(t *testing.T) {
+	setTimeouts(t, TimeoutConfig{Idle: 50 * time.Millisecond})
+
+	c, _ := startedClient(t)
+
+	select {
+	case _, open := <-c.Messages():
+		if open {
+			t.Fatal("received a message from a silent peer")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent peer was not disconnected")
+	}
+
+	if err := c.Err(); !strings.Contains(err.Error(), "silent") {
+		t.Errorf("Err() = %v, want idle timeout", err)
+	}
+}
+
+// 对端的keep-alive使连接保持
+func TestIdleKeepAliveFromPeer(t *testing.T) {
+	setTimeouts(t, TimeoutConfig{Idle: 100 * time.Millisecond})
+
+	c, remote := startedClient(t)
+
+	for i := 0; i < 10; i++ {
+		if _, err := remote.Write(make([]byte, 4)); err != nil {
+			t.Fatalf("connection closed after %d keep-alives: %v", i, err)
+		}
+
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	select {
+	case <-c.Messages():
+		t.Errorf("connection closed: %v", c.Err())
+	default:
+	}
+}
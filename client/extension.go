@@ -0,0 +1,305 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"cpipi1024.com/turtleDownloader/utils/message"
+	"github.com/jackpal/bencode-go"
+)
+
+// 扩展握手使用的扩展消息id
+const extHandshakeID = 0
+
+// BEP 10 扩展握手
+type ExtHandshake struct {
+	M            map[string]int `bencode:"m"`                       // 扩展名称到扩展消息id的映射
+	V            string         `bencode:"v,omitempty"`             // 客户端名称及版本
+	P            int            `bencode:"p,omitempty"`             // 本地监听端口
+	Reqq         int            `bencode:"reqq,omitempty"`          // 未完成请求队列的长度
+	YourIP       string         `bencode:"yourip,omitempty"`        // 对端的ip地址, 4或16字节
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // info字典的大小
+	UploadOnly   int            `bencode:"upload_only,omitempty"`   // BEP 21, 为1时只上传不再下载
+}
+
+// 扩展协议的具体扩展, 如ut_metadata, ut_pex
+//
+// 同一个扩展实例会被多个client共享, 实现需要保证并发安全
+type Extension interface {
+	// 扩展名称, 即扩展握手m字典中的key
+	Name() string
+
+	// 收到对端的扩展握手后调用
+	OnHandshake(c *Client, hs *ExtHandshake) error
+
+	// 收到该扩展的消息后调用
+	OnMessage(c *Client, payload []byte) error
+}
+
+// 可选接口, 扩展需要跟踪连接的建立和断开时实现
+type ConnTracker interface {
+	OnConnect(c *Client)
+	OnClose(c *Client)
+}
+
+// 扩展注册表, 本地扩展消息id按注册顺序从1开始分配
+type Registry struct {
+	Version      string
+	Port         int
+	Reqq         int
+	MetadataSize int
+	UploadOnly   func() bool // 是否只上传, 例如只下载了部分文件的partial seed, 为nil时表示否
+
+	exts []Extension
+}
+
+func NewRegistry() *Registry {
+	return &Registry{Version: "turtleDownloader"}
+}
+
+// 注册扩展
+func (r *Registry) Register(ext Extension) {
+	r.exts = append(r.exts, ext)
+}
+
+// 根据本地扩展消息id查找扩展
+func (r *Registry) byID(id byte) Extension {
+	if id == extHandshakeID || int(id) > len(r.exts) {
+		return nil
+	}
+
+	return r.exts[id-1]
+}
+
+// 生成发送给对端的扩展握手
+func (r *Registry) handshake(remote net.Addr) *ExtHandshake {
+	hs := &ExtHandshake{
+		M:            make(map[string]int, len(r.exts)),
+		V:            r.Version,
+		P:            r.Port,
+		Reqq:         r.Reqq,
+		MetadataSize: r.MetadataSize,
+	}
+
+	if r.UploadOnly != nil && r.UploadOnly() {
+		hs.UploadOnly = 1
+	}
+
+	for i, ext := range r.exts {
+		hs.M[ext.Name()] = i + 1
+	}
+
+	var ip net.IP
+
+	// 连接可能使用TCP或uTP
+	switch addr := remote.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		hs.YourIP = string(ip4)
+	} else if ip != nil {
+		hs.YourIP = string(ip)
+	}
+
+	return hs
+}
+
+// 通知扩展连接已建立
+func (r *Registry) connected(c *Client) {
+	for _, ext := range r.exts {
+		if t, ok := ext.(ConnTracker); ok {
+			t.OnConnect(c)
+		}
+	}
+}
+
+// 通知扩展连接已断开
+func (r *Registry) closed(c *Client) {
+	for _, ext := range r.exts {
+		if t, ok := ext.(ConnTracker); ok {
+			t.OnClose(c)
+		}
+	}
+}
+
+// 将对端后续的扩展握手合并到之前的握手中, 返回新的握手, h可以为nil
+//
+// 后续握手可以只包含变化的key (BEP 10), m中id为0的扩展表示对端不再支持
+func (h *ExtHandshake) merge(update *ExtHandshake, keys map[string]interface{}) *ExtHandshake {
+	merged := &ExtHandshake{}
+
+	if h != nil {
+		*merged = *h
+	}
+
+	merged.M = make(map[string]int, len(merged.M)+len(update.M))
+
+	if h != nil {
+		for name, id := range h.M {
+			merged.M[name] = id
+		}
+	}
+
+	for name, id := range update.M {
+		if id == 0 {
+			delete(merged.M, name)
+		} else {
+			merged.M[name] = id
+		}
+	}
+
+	if _, ok := keys["v"]; ok {
+		merged.V = update.V
+	}
+
+	if _, ok := keys["p"]; ok {
+		merged.P = update.P
+	}
+
+	if _, ok := keys["reqq"]; ok {
+		merged.Reqq = update.Reqq
+	}
+
+	if _, ok := keys["yourip"]; ok {
+		merged.YourIP = update.YourIP
+	}
+
+	if _, ok := keys["metadata_size"]; ok {
+		merged.MetadataSize = update.MetadataSize
+	}
+
+	if _, ok := keys["upload_only"]; ok {
+		merged.UploadOnly = update.UploadOnly
+	}
+
+	return merged
+}
+
+// 发送扩展握手
+func (c *Client) sendExtHandshake() error {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, *c.registry.handshake(c.Conn.RemoteAddr()))
+
+	if err != nil {
+		return err
+	}
+
+	return c.write(message.FormatExtended(extHandshakeID, buf.Bytes()), false)
+}
+
+// 本地状态变化后重新发送扩展握手, 没有发送过扩展握手时忽略
+func (c *Client) SendExtHandshake() error {
+	if !c.extended {
+		return nil
+	}
+
+	return c.sendExtHandshake()
+}
+
+// 对端的扩展握手, 未收到时返回nil
+//
+// 对端可以重新发送扩展握手, 新的字段合并到新的握手中, 返回的握手不会被修改
+func (c *Client) PeerExtensions() *ExtHandshake {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	return c.extensions
+}
+
+// 对端是否只上传 (BEP 21)
+func (c *Client) UploadOnly() bool {
+	hs := c.PeerExtensions()
+
+	return hs != nil && hs.UploadOnly == 1
+}
+
+// 对端扩展的消息id, 不支持时返回0
+func (c *Client) extensionID(name string) int {
+	hs := c.PeerExtensions()
+
+	if hs == nil {
+		return 0
+	}
+
+	return hs.M[name]
+}
+
+// 对端是否支持扩展
+func (c *Client) SupportsExtension(name string) bool {
+	return c.extensionID(name) > 0
+}
+
+// 向对端发送扩展消息, 可以在worker之外的goroutine中调用
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id := c.extensionID(name)
+
+	if id <= 0 {
+		err := fmt.Errorf("peer %s does not support extension %s", c.peer, name)
+		return err
+	}
+
+	m := message.FormatExtended(byte(id), payload)
+
+	return c.write(m, false)
+}
+
+// 将扩展消息分发给对应的扩展
+func (c *Client) handleExtended(msg *message.Message) error {
+	if c.registry == nil {
+		return nil
+	}
+
+	id, payload, err := message.ParseMsgExtended(msg)
+
+	if err != nil {
+		return err
+	}
+
+	if id == extHandshakeID {
+		update := &ExtHandshake{}
+
+		err = bencode.Unmarshal(bytes.NewReader(payload), update)
+
+		if err != nil {
+			return err
+		}
+
+		// 区分没有出现的key和值为0的key
+		raw, err := bencode.Decode(bytes.NewReader(payload))
+
+		if err != nil {
+			return err
+		}
+
+		keys, _ := raw.(map[string]interface{})
+
+		c.extMu.Lock()
+		hs := c.extensions.merge(update, keys)
+		c.extensions = hs
+		c.extMu.Unlock()
+
+		for _, ext := range c.registry.exts {
+			if c.SupportsExtension(ext.Name()) {
+				if err := ext.OnHandshake(c, hs); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	ext := c.registry.byID(id)
+
+	if ext == nil {
+		return nil
+	}
+
+	return ext.OnMessage(c, payload)
+}
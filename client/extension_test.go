@@ -0,0 +1,86 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+// 对端依次发送的扩展握手合并后的结果
+func TestExtHandshakeMerge(t *testing.T) {
+	tests := []struct {
+		name       string
+		handshakes []string
+		want       ExtHandshake
+	}{
+		{
+			name:       "first handshake",
+			handshakes: []string{"d1:md6:ut_pexi1e11:ut_metadatai2ee1:pi6881e1:v4:teste"},
+			want:       ExtHandshake{M: map[string]int{"ut_pex": 1, "ut_metadata": 2}, P: 6881, V: "test"},
+		},
+		{
+			name: "upload_only keeps extensions",
+			handshakes: []string{
+				"d1:md6:ut_pexi1e11:ut_metadatai2ee13:metadata_sizei100ee",
+				"d11:upload_onlyi1ee",
+			},
+			want: ExtHandshake{M: map[string]int{"ut_pex": 1, "ut_metadata": 2}, MetadataSize: 100, UploadOnly: 1},
+		},
+		{
+			name: "id 0 removes an extension",
+			handshakes: []string{
+				"d1:md6:ut_pexi1e11:ut_metadatai2eee",
+				"d1:md6:ut_pexi0e11:ut_metadatai3eee",
+			},
+			want: ExtHandshake{M: map[string]int{"ut_metadata": 3}},
+		},
+		{
+			name: "explicit zero clears upload_only",
+			handshakes: []string{
+				"d1:md6:ut_pexi1ee11:upload_onlyi1ee",
+				"d11:upload_onlyi0ee",
+			},
+			want: ExtHandshake{M: map[string]int{"ut_pex": 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{registry: NewRegistry()}
+
+			var prev *ExtHandshake
+
+			for _, hs := range tt.handshakes {
+				if err := c.Handle(message.FormatExtended(extHandshakeID, []byte(hs))); err != nil {
+					t.Fatalf("Handle(%q) = %v", hs, err)
+				}
+
+				// 之前返回的握手不会被修改
+				if prev != nil && c.PeerExtensions() == prev {
+					t.Fatal("handshake was modified in place")
+				}
+
+				prev = c.PeerExtensions()
+			}
+
+			if got := c.PeerExtensions(); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("PeerExtensions() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupportsExtensionAfterUploadOnly(t *testing.T) {
+	c := &Client{registry: NewRegistry()}
+
+	for _, hs := range []string{"d1:md6:ut_pexi1eee", "d11:upload_onlyi1ee"} {
+		if err := c.Handle(message.FormatExtended(extHandshakeID, []byte(hs))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.SupportsExtension("ut_pex") || !c.UploadOnly() {
+		t.Errorf("SupportsExtension(ut_pex) = %v, UploadOnly() = %v", c.SupportsExtension("ut_pex"), c.UploadOnly())
+	}
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"cpipi1024.com/turtleDownloader/utils/bitfield"
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+// 发送给每个peer的allowed fast集合大小
+const AllowedFastCount = 10
+
+// 保留的对端建议数, 超过时丢弃最早的建议
+const MaxSuggested = 16
+
+// 按BEP 6计算ip对应的allowed fast集合
+//
+// ipv4地址只取前24位, 同一网段的peer得到相同的集合
+func AllowedFastSet(ip net.IP, infohash [20]byte, numPieces, k int) []int {
+	if numPieces <= 0 {
+		return nil
+	}
+
+	if k > numPieces {
+		k = numPieces
+	}
+
+	var x []byte
+
+	if ip4 := ip.To4(); ip4 != nil {
+		x = []byte{ip4[0], ip4[1], ip4[2], 0}
+	} else {
+		x = append([]byte{}, ip.To16()...)
+	}
+
+	x = append(x, infohash[:]...)
+
+	set := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			idx := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+
+			if !seen[idx] {
+				seen[idx] = true
+				set = append(set, idx)
+			}
+		}
+	}
+
+	return set
+}
+
+// 创建包含numPieces个piece的bitfield, all为true时设置所有piece
+func newBitField(numPieces int, all bool) bitfield.BitField {
+	bf := make(bitfield.BitField, (numPieces+7)/8)
+
+	if all {
+		for i := 0; i < numPieces; i++ {
+			bf.SetPiece(i)
+		}
+	}
+
+	return bf
+}
+
+// 双方都支持Fast Extension时, 发送对端的allowed fast集合
+func (c *Client) sendAllowedFast() error {
+	for _, idx := range AllowedFastSet(c.peer.IP, c.infohash, c.numPieces, AllowedFastCount) {
+		c.GrantedFast[idx] = true
+
+		err := c.write(message.FormatIndex(message.MsgAllowedFast, idx), false)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 处理Fast Extension中只影响连接状态的消息
+func (c *Client) handleFast(msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgHaveAll, message.MsgHaveNone:
+		// 只能代替握手之后的bitfield, 之后对端的piece只能通过MsgHave增加
+		if c.gotBitField {
+			err := fmt.Errorf("peer %s sent %s after its bitfield", c.peer, msg)
+			return err
+		}
+
+		c.BitField = newBitField(c.numPieces, msg.ID == message.MsgHaveAll)
+	case message.MsgSuggest:
+		idx, err := message.ParseMsgIndex(msg)
+
+		if err != nil {
+			return err
+		}
+
+		if idx < c.numPieces {
+			c.suggest(idx)
+		}
+	case message.MsgAllowedFast:
+		idx, err := message.ParseMsgIndex(msg)
+
+		if err != nil {
+			return err
+		}
+
+		if idx < c.numPieces {
+			c.AllowedFast[idx] = true
+		}
+	}
+
+	return nil
+}
+
+// 记录对端建议的piece, 重复的建议移到最后
+func (c *Client) suggest(idx int) {
+	for i, s := range c.Suggested {
+		if s == idx {
+			c.Suggested = append(c.Suggested[:i], c.Suggested[i+1:]...)
+			break
+		}
+	}
+
+	if len(c.Suggested) >= MaxSuggested {
+		c.Suggested = c.Suggested[1:]
+	}
+
+	c.Suggested = append(c.Suggested, idx)
+}
+
+// 被对端阻塞时是否仍然可以请求该piece
+func (c *Client) CanRequest(idx int) bool {
+	return !c.Choked || c.AllowedFast[idx]
+}
+
+// 拒绝对端的请求, 对端不支持Fast Extension时直接忽略
+func (c *Client) SendReject(idx, begin, length int) error {
+	if !c.Fast {
+		return nil
+	}
+
+	return c.write(message.FormatReject(idx, begin, length), false)
+}
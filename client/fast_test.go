@@ -0,0 +1,192 @@
+package client
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+// BEP 6 中的测试向量: ip 80.4.4.200, infohash 20个0xaa, 1313个piece
+func TestAllowedFastSetVectors(t *testing.T) {
+	var infohash [20]byte
+
+	for i := range infohash {
+		infohash[i] = 0xaa
+	}
+
+	tests := []struct {
+		ip   string
+		k    int
+		want []int
+	}{
+		{"80.4.4.200", 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"80.4.4.200", 9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		// 只取ip的前24位
+		{"80.4.4.1", 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+	}
+
+	for _, tt := range tests {
+		got := AllowedFastSet(net.ParseIP(tt.ip), infohash, 1313, tt.k)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("AllowedFastSet(%s, k=%d) = %v, want %v", tt.ip, tt.k, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedFastSetSmallTorrent(t *testing.T) {
+	tests := []struct {
+		numPieces int
+		k         int
+		want      int
+	}{
+		{0, 10, 0},
+		{3, 10, 3},
+		{20, 10, 10},
+	}
+
+	for _, tt := range tests {
+		set := AllowedFastSet(net.ParseIP("10.0.0.1"), [20]byte{1}, tt.numPieces, tt.k)
+
+		if len(set) != tt.want {
+			t.Fatalf("AllowedFastSet(%d pieces, k=%d) has %d pieces, want %d", tt.numPieces, tt.k, len(set), tt.want)
+		}
+
+		seen := make(map[int]bool)
+
+		for _, idx := range set {
+			if idx < 0 || idx >= tt.numPieces || seen[idx] {
+				t.Fatalf("AllowedFastSet(%d pieces) = %v has invalid or duplicate index", tt.numPieces, set)
+			}
+
+			seen[idx] = true
+		}
+	}
+}
+
+func TestHandleFast(t *testing.T) {
+	many := make([]*message.Message, 0, MaxSuggested+4)
+	wantMany := make([]int, 0, MaxSuggested)
+
+	for i := 0; i < MaxSuggested+4; i++ {
+		many = append(many, message.FormatIndex(message.MsgSuggest, i))
+
+		if i >= 4 {
+			wantMany = append(wantMany, i)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		numPieces     int
+		msgs          []*message.Message
+		wantSuggested []int
+		wantAllowed   map[int]bool
+		wantHave      int
+	}{
+		{
+			name:     "have all",
+			msgs:     []*message.Message{{ID: message.MsgHaveAll}},
+			wantHave: 10,
+		},
+		{
+			name: "have none after have all",
+			msgs: []*message.Message{{ID: message.MsgHaveAll}, {ID: message.MsgHaveNone}},
+		},
+		{
+			name: "suggest dedupes and keeps the latest last",
+			msgs: []*message.Message{
+				message.FormatIndex(message.MsgSuggest, 1),
+				message.FormatIndex(message.MsgSuggest, 2),
+				message.FormatIndex(message.MsgSuggest, 1),
+			},
+			wantSuggested: []int{2, 1},
+		},
+		{
+			name:          "suggest out of range",
+			msgs:          []*message.Message{message.FormatIndex(message.MsgSuggest, 10)},
+			wantSuggested: nil,
+		},
+		{
+			name:          "suggest is capped",
+			numPieces:     MaxSuggested + 4,
+			msgs:          many,
+			wantSuggested: wantMany,
+		},
+		{
+			name: "allowed fast",
+			msgs: []*message.Message{
+				message.FormatIndex(message.MsgAllowedFast, 3),
+				message.FormatIndex(message.MsgAllowedFast, 42),
+			},
+			wantAllowed: map[int]bool{3: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{Fast: true, numPieces: tt.numPieces, AllowedFast: make(map[int]bool)}
+
+			if c.numPieces == 0 {
+				c.numPieces = 10
+			}
+
+			for _, msg := range tt.msgs {
+				if err := c.Handle(msg); err != nil {
+					t.Fatalf("Handle(%s) = %v", msg, err)
+				}
+			}
+
+			if !reflect.DeepEqual(c.Suggested, tt.wantSuggested) {
+				t.Errorf("Suggested = %v, want %v", c.Suggested, tt.wantSuggested)
+			}
+
+			if tt.wantAllowed == nil {
+				tt.wantAllowed = map[int]bool{}
+			}
+
+			if !reflect.DeepEqual(c.AllowedFast, tt.wantAllowed) {
+				t.Errorf("AllowedFast = %v, want %v", c.AllowedFast, tt.wantAllowed)
+			}
+
+			have := 0
+
+			for i := 0; i < c.numPieces; i++ {
+				if c.BitField.HasPiece(i) {
+					have++
+				}
+			}
+
+			if have != tt.wantHave {
+				t.Errorf("peer has %d pieces, want %d", have, tt.wantHave)
+			}
+		})
+	}
+}
+
+// HaveAll和HaveNone只能代替bitfield, 之后收到时picker中的可用数会出错
+func TestHaveAllAfterBitField(t *testing.T) {
+	for _, msg := range []*message.Message{{ID: message.MsgHaveAll}, {ID: message.MsgHaveNone}} {
+		c := &Client{Fast: true, numPieces: 10, AllowedFast: make(map[int]bool), gotBitField: true}
+		c.BitField = newBitField(10, false)
+		c.BitField.SetPiece(3)
+
+		if err := c.Handle(msg); err == nil {
+			t.Errorf("Handle accepted %s after the bitfield", msg)
+		}
+
+		if !c.BitField.HasPiece(3) || c.BitField.HasPiece(4) {
+			t.Errorf("bitfield changed to %08b", c.BitField)
+		}
+	}
+}
+
+func TestFastMessageWithoutExtension(t *testing.T) {
+	c := &Client{AllowedFast: make(map[int]bool)}
+
+	if err := c.Handle(&message.Message{ID: message.MsgHaveAll}); err == nil {
+		t.Error("Handle accepted MsgHaveAll without the fast extension")
+	}
+}
@@ -0,0 +1,36 @@
+package client
+
+import "time"
+
+// 连接各个阶段的超时时间
+type TimeoutConfig struct {
+	Dial      time.Duration // 建立TCP或uTP连接
+	Handshake time.Duration // 加密协商以及BitTorrent握手
+	BitField  time.Duration // 握手之后等待对端的bitfield
+	Idle      time.Duration // 对端没有发送任何消息, 包括keep-alive
+	Snub      time.Duration // 对端没有阻塞我们, 但是没有返回请求的数据, 标记为snubbed
+	Request   time.Duration // 对端没有阻塞我们, 但是一直没有返回请求的数据, 断开连接
+	KeepAlive time.Duration // 没有发送任何消息时, 发送keep-alive的间隔
+}
+
+var DefaultTimeouts = TimeoutConfig{
+	Dial:      5 * time.Second,
+	Handshake: 15 * time.Second,
+	BitField:  15 * time.Second,
+	Idle:      3 * time.Minute,
+	Snub:      time.Minute,
+	Request:   5 * time.Minute,
+	KeepAlive: 2 * time.Minute,
+}
+
+// 所有连接使用的超时时间
+var Timeouts = DefaultTimeouts
+
+// 超时时间为0时不设置deadline
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(d)
+}
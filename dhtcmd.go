@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/dht"
+	"cpipi1024.com/turtleDownloader/utils/metadata"
+	"cpipi1024.com/turtleDownloader/utils/torrentfile"
+)
+
+// dht 子命令
+//
+//	dht put [-key keyfile] [-salt salt] [-seq n] <value>
+//	dht get [-salt salt] <target|publickey>
+//	dht crawl [-duration d] [-out dir]
+func dhtCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dht put|get|crawl [flags] <arg>")
+	}
+
+	switch args[0] {
+	case "put":
+		return dhtPut(args[1:])
+	case "get":
+		return dhtGet(args[1:])
+	case "crawl":
+		return dhtCrawl(args[1:])
+	default:
+		return fmt.Errorf("unknown dht command: %s", args[0])
+	}
+}
+
+func dhtPut(args []string) error {
+	fs := flag.NewFlagSet("dht put", flag.ExitOnError)
+
+	keyFile := fs.String("key", "", "ed25519 private key file, put a mutable item when set")
+	salt := fs.String("salt", "", "salt of the mutable item")
+	seq := fs.Int64("seq", 0, "sequence number of the mutable item, default to current seq + 1")
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: dht put [-key keyfile] [-salt salt] [-seq n] <value>")
+	}
+
+	node := startDHT(0, nil)
+
+	if node == nil {
+		return errors.New("dht node is not available")
+	}
+
+	closeNode := stopOnInterrupt(func() { node.Close() }, nil)
+	defer closeNode()
+
+	value := fs.Arg(0)
+
+	if *keyFile == "" {
+		target, err := node.PutImmutable(value)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%x\n", target)
+
+		return nil
+	}
+
+	priv, err := loadOrCreateKey(*keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	var pub [32]byte
+	copy(pub[:], priv.Public().(ed25519.PublicKey))
+
+	// 未指定seq时在当前数据的基础上递增, 并通过CAS避免覆盖并发的更新
+	var cas int64
+
+	if *seq == 0 {
+		*seq = 1
+
+		if cur, err := node.GetMutable(pub, []byte(*salt)); err == nil {
+			*seq = cur.Seq + 1
+			cas = cur.Seq
+		}
+	}
+
+	item, err := dht.NewMutableItem(priv, []byte(*salt), *seq, value)
+
+	if err != nil {
+		return err
+	}
+
+	item.CAS = cas
+
+	err = node.PutMutable(item)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%x seq:%d\n", pub, item.Seq)
+
+	return nil
+}
+
+func dhtGet(args []string) error {
+	fs := flag.NewFlagSet("dht get", flag.ExitOnError)
+
+	salt := fs.String("salt", "", "salt of the mutable item")
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: dht get [-salt salt] <target|publickey>")
+	}
+
+	key, err := hex.DecodeString(fs.Arg(0))
+
+	if err != nil {
+		return err
+	}
+
+	if len(key) != 20 && len(key) != 32 {
+		return fmt.Errorf("expect 20 bytes target or 32 bytes public key, got %d bytes", len(key))
+	}
+
+	node := startDHT(0, nil)
+
+	if node == nil {
+		return errors.New("dht node is not available")
+	}
+
+	closeNode := stopOnInterrupt(func() { node.Close() }, nil)
+	defer closeNode()
+
+	// 20字节为不可变数据的target, 32字节为可变数据的公钥
+	if len(key) == 20 {
+		var target [20]byte
+		copy(target[:], key)
+
+		v, err := node.GetImmutable(target)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(v)
+
+		return nil
+	}
+
+	var pub [32]byte
+	copy(pub[:], key)
+
+	item, err := node.GetMutable(pub, []byte(*salt))
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("seq:%d %v\n", item.Seq, item.V)
+
+	return nil
+}
+
+// 读取ed25519私钥, 文件不存在时生成新的私钥
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err == nil {
+		if len(data) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid key file %s, size:%d", path, len(data))
+		}
+
+		return ed25519.NewKeyFromSeed(data), nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+
+	_, err = rand.Read(seed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, seed, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// 遍历DHT网络收集infohash, 指定out时通过ut_metadata获取.torrent文件
+func dhtCrawl(args []string) error {
+	fs := flag.NewFlagSet("dht crawl", flag.ExitOnError)
+
+	duration := fs.Duration("duration", 10*time.Minute, "how long to crawl")
+	out := fs.String("out", "", "directory to save fetched .torrent files")
+
+	fs.Parse(args)
+
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			return err
+		}
+	}
+
+	node := startDHT(0, nil)
+
+	if node == nil {
+		return errors.New("dht node is not available")
+	}
+
+	// 爬取一直持续到中断, 找到的infohash已经输出
+	closeNode := stopOnInterrupt(func() { node.Close() }, func() bool { return true })
+	defer closeNode()
+
+	var peerId [20]byte
+	rand.Read(peerId[:])
+
+	var wg sync.WaitGroup
+
+	// 同时获取metadata的infohash数
+	sem := make(chan struct{}, 16)
+
+	stop := make(chan struct{})
+	time.AfterFunc(*duration, func() { close(stop) })
+
+	node.Crawl(stop, func(infohash [20]byte) {
+		fmt.Printf("%x\n", infohash)
+
+		if *out == "" {
+			return
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ps, err := node.GetPeers(infohash)
+
+			if err != nil {
+				return
+			}
+
+			info, err := metadata.FetchFromPeers(ps, infohash, peerId)
+
+			if err != nil {
+				return
+			}
+
+			path := filepath.Join(*out, fmt.Sprintf("%x.torrent", infohash))
+
+			err = torrentfile.WriteTorrent(path, info)
+
+			if err != nil {
+				log.Println("save torrent failed:", err)
+			}
+		}()
+	})
+
+	wg.Wait()
+
+	return nil
+}
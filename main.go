@@ -1,24 +1,350 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/dht"
+	"cpipi1024.com/turtleDownloader/utils/downloader"
+	"cpipi1024.com/turtleDownloader/utils/listener"
+	"cpipi1024.com/turtleDownloader/utils/lsd"
+	"cpipi1024.com/turtleDownloader/utils/mse"
 	"cpipi1024.com/turtleDownloader/utils/torrentfile"
+	"cpipi1024.com/turtleDownloader/utils/utp"
 )
 
-func main() {
-	inpath := os.Args[1]
+// 路由表保存路径
+func dhtTablePath() string {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return ""
+	}
+
+	dir = filepath.Join(dir, "turtleDownloader")
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "dht.dat")
+}
+
+// 在port上启动DHT节点, 并从保存的路由表以及默认节点加入网络
+//
+// conn不为nil时与uTP共用UDP socket, 忽略port
+func startDHT(port int, conn dht.Conn) *dht.DHT {
+	node, err := dht.New(dht.Config{
+		Addr:      ":" + strconv.Itoa(port),
+		Conn:      conn,
+		TablePath: dhtTablePath(),
+	})
+
+	if err != nil {
+		log.Println("start dht failed:", err)
+		return nil
+	}
+
+	node.Bootstrap(dht.DefaultBootstrapNodes)
+
+	log.Printf("dht node started with %d nodes\n", node.NumNodes())
+
+	return node
+}
+
+// 收到SIGINT或SIGTERM时执行stop后退出
+//
+// finished返回true时中断属于正常结束, 例如文件已经保存后的做种, 退出码为0;
+// 否则下载的数据只保存在内存中, 中断后全部丢失, 退出码为1. finished可以为nil
+//
+// 返回的函数用于正常结束时执行stop, 两种情况下stop只会执行一次
+func stopOnInterrupt(stop func(), finished func() bool) func() {
+	var once sync.Once
+
+	run := func() {
+		once.Do(stop)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		run()
+
+		if finished == nil || !finished() {
+			log.Println("interrupted before the download was saved")
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}()
+
+	return run
+}
+
+// 启动局域网服务发现
+func startLSD(port int) *lsd.LSD {
+	l, err := lsd.New(lsd.Config{Port: port})
+
+	if err != nil {
+		log.Println("start lsd failed:", err)
+		return nil
+	}
+
+	return l
+}
+
+// 在监听端口上启动uTP socket, 用于连接peer以及接受对端的uTP连接
+func startUTP(bind string, port int) *utp.Socket {
+	s, err := utp.Listen(listener.Addr(bind, port))
+
+	if err != nil {
+		log.Println("start utp failed:", err)
+		return nil
+	}
+
+	return s
+}
+
+// 监听对端发起的连接
+func startListener(bind string, port int) *listener.Listener {
+	l, err := listener.New(listener.Addr(bind, port))
+
+	if err != nil {
+		log.Println("start listener failed:", err)
+		return nil
+	}
+
+	log.Printf("listening for peers on port %d\n", l.Port())
+
+	return l
+}
+
+// 启动下载使用的本地服务, 返回的函数用于关闭服务
+func startServices() (torrentfile.Options, func()) {
+	opts := torrentfile.Options{
+		Listener: startListener(bindAddr, listenPort),
+
+		UploadSlots: uploadSlots,
+		MaxConns:    maxConns,
+		SuperSeed:   superSeed,
+	}
+
+	// 端口为0时使用TCP监听实际分配的端口
+	port := listenPort
+
+	if opts.Listener != nil {
+		port = opts.Listener.Port()
+	}
+
+	// uTP与DHT共用同一个UDP端口
+	var conn dht.Conn
+
+	if useUTP {
+		client.UTP = startUTP(bindAddr, port)
+	}
+
+	if client.UTP != nil {
+		conn = client.UTP.PacketConn()
+
+		if opts.Listener != nil {
+			opts.Listener.Serve(client.UTP)
+		}
+	}
+
+	opts.DHT = startDHT(port, conn)
+	opts.LSD = startLSD(port)
+
+	// 文件保存之后才能通过中断正常结束
+	var saved int32
+
+	opts.Saved = func() {
+		atomic.StoreInt32(&saved, 1)
+	}
+
+	finished := func() bool {
+		return atomic.LoadInt32(&saved) == 1
+	}
 
-	outPath := os.Args[2]
+	// 关闭时保存DHT路由表
+	return opts, stopOnInterrupt(func() {
+		// DHT先于共用的uTP socket关闭
+		if opts.DHT != nil {
+			opts.DHT.Close()
+		}
 
+		if client.UTP != nil {
+			client.UTP.Close()
+		}
+
+		if opts.LSD != nil {
+			opts.LSD.Close()
+		}
+
+		if opts.Listener != nil {
+			opts.Listener.Close()
+		}
+	}, finished)
+}
+
+func download(inpath, outPath string) error {
 	tf, err := torrentfile.Open(inpath)
 
+	if err != nil {
+		return err
+	}
+
+	skip, err := tf.SkipPieces(pieces)
+
+	if err != nil {
+		return err
+	}
+
+	opts, stop := startServices()
+	defer stop()
+
+	// 只下载部分piece时作为partial seed继续上传
+	opts.Skip = skip
+	opts.Seed = len(skip) > 0
+
+	return tf.DownLoad(outPath, opts)
+}
+
+// 通过DHT获取magnet链接的torrent信息后下载
+func downloadMagnet(link, outPath string) error {
+	ml, err := torrentfile.ParseMagnet(link)
+
+	if err != nil {
+		return err
+	}
+
+	opts, stop := startServices()
+	defer stop()
+
+	log.Printf("fetching metadata for %x\n", ml.InfoHash)
+
+	tf, err := ml.Fetch(opts.DHT)
+
+	if err != nil {
+		return err
+	}
+
+	skip, err := tf.SkipPieces(pieces)
+
+	if err != nil {
+		return err
+	}
+
+	opts.Skip = skip
+	opts.Seed = len(skip) > 0
+
+	return tf.DownLoad(outPath, opts)
+}
+
+// 补全path中的文件后继续做种, 直到进程退出
+func seed(inpath, path string) error {
+	tf, err := torrentfile.Open(inpath)
+
+	if err != nil {
+		return err
+	}
+
+	skip, err := tf.SkipPieces(pieces)
+
+	if err != nil {
+		return err
+	}
+
+	opts, stop := startServices()
+	defer stop()
+
+	opts.Skip = skip
+
+	return tf.Seed(path, opts)
+}
+
+// 跟随BEP 46可变torrent, 每隔一段时间检查是否有新版本
+func followMutable(link, outPath string) error {
+	ml, err := torrentfile.ParseMutableMagnet(link)
+
+	if err != nil {
+		return err
+	}
+
+	opts, stop := startServices()
+	defer stop()
+
+	return torrentfile.FollowMutable(ml, outPath, opts, 10*time.Minute)
+}
+
+var (
+	useUTP      bool   // 是否优先使用uTP连接peer
+	listenPort  int    // 接受peer连接的端口, 同时用于DHT和LSD
+	bindAddr    string // 接受peer连接的地址
+	uploadSlots int    // 同时上传的peer数
+	maxConns    int    // 每个torrent的连接数
+	superSeed   bool   // 做种时使用super-seeding
+	pieces      string // 只下载这些piece, 为空时下载所有piece
+)
+
+func main() {
+	encryption := flag.String("encryption", mse.Preferred.String(), "peer connection encryption: disabled, preferred or required")
+	flag.BoolVar(&useUTP, "utp", true, "try uTP before TCP when connecting to peers")
+	flag.IntVar(&listenPort, "port", torrentfile.Port, "port to accept peer connections on")
+	flag.StringVar(&bindAddr, "bind", "", "address to accept peer connections on")
+	flag.IntVar(&uploadSlots, "upload-slots", downloader.DefaultUploadSlots, "number of peers to upload to at the same time")
+	flag.IntVar(&maxConns, "max-conns-per-torrent", downloader.DefaultMaxConnsPerTorrent, "connections to keep for each torrent")
+	flag.BoolVar(&superSeed, "super-seed", false, "reveal pieces one peer at a time when seeding a complete file")
+	flag.StringVar(&pieces, "pieces", "", "only download these pieces, e.g. 0-99,150,200-, and then seed them as a partial seed")
+	flag.IntVar(&downloader.MaxConnections, "max-conns", downloader.MaxConnections, "connections to keep across all torrents")
+	flag.IntVar(&downloader.MaxHalfOpen, "max-half-open", downloader.MaxHalfOpen, "connection attempts in progress at the same time")
+	flag.DurationVar(&client.Timeouts.Dial, "dial-timeout", client.DefaultTimeouts.Dial, "timeout for connecting to a peer")
+	flag.DurationVar(&client.Timeouts.Handshake, "handshake-timeout", client.DefaultTimeouts.Handshake, "timeout for the encryption and protocol handshake")
+	flag.DurationVar(&client.Timeouts.BitField, "bitfield-timeout", client.DefaultTimeouts.BitField, "timeout for receiving the peer's bitfield")
+	flag.DurationVar(&client.Timeouts.Idle, "idle-timeout", client.DefaultTimeouts.Idle, "disconnect peers that send nothing for this long")
+	flag.DurationVar(&client.Timeouts.Snub, "snub-timeout", client.DefaultTimeouts.Snub, "mark unchoking peers that send no requested data for this long as snubbed")
+	flag.DurationVar(&client.Timeouts.Request, "request-timeout", client.DefaultTimeouts.Request, "disconnect unchoking peers that send no requested data for this long")
+	flag.DurationVar(&client.Timeouts.KeepAlive, "keepalive", client.DefaultTimeouts.KeepAlive, "send a keep-alive after this long without other messages")
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) < 2 {
+		log.Fatal("usage: turtleDownloader [-encryption policy] [-utp=false] [-port n] [-bind addr] [-upload-slots n] [-max-conns n] [-max-conns-per-torrent n] [-max-half-open n] [-super-seed] [-pieces list] [-*-timeout d] <torrent|magnet> <output> | seed <torrent> <file> | dht put|get|crawl [flags] [arg]")
+	}
+
+	policy, err := mse.ParsePolicy(*encryption)
+
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = tf.DownLoad(outPath)
+	client.Encryption = policy
+
+	switch {
+	case args[0] == "dht":
+		err = dhtCommand(args[1:])
+	case args[0] == "seed" && len(args) >= 3:
+		err = seed(args[1], args[2])
+	case torrentfile.IsMutableMagnet(args[0]):
+		err = followMutable(args[0], args[1])
+	case strings.HasPrefix(args[0], "magnet:"):
+		err = downloadMagnet(args[0], args[1])
+	default:
+		err = download(args[0], args[1])
+	}
 
 	if err != nil {
 		log.Fatal(err)
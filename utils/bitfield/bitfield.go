@@ -9,7 +9,7 @@ func (bf BitField) HasPiece(idx int) bool {
 	// peice位于整个数组中的下标
 	byteIdx := idx / 8
 
-	if len(bf) < byteIdx {
+	if byteIdx < 0 || byteIdx >= len(bf) {
 		return false
 	}
 
@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	externalIPVotes = 3  // 确认外部ip所需的不同节点ip数
+	maxIPCandidates = 16 // 同时统计的候选外部ip数, 超过时重新统计
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// 不需要校验节点id的本地地址
+var exemptNets = []*net.IPNet{
+	mustCIDR("10.0.0.0/8"),
+	mustCIDR("172.16.0.0/12"),
+	mustCIDR("192.168.0.0/16"),
+	mustCIDR("169.254.0.0/16"),
+	mustCIDR("127.0.0.0/8"),
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return n
+}
+
+// BEP 42 节点id前缀: crc32c((ip & mask) | (r << 29))
+func idPrefix(ip net.IP, r byte) uint32 {
+	ip4 := ip.To4()
+
+	buf := make([]byte, 4)
+
+	mask := []byte{0x03, 0x0f, 0x3f, 0xff}
+
+	for i := range buf {
+		buf[i] = ip4[i] & mask[i]
+	}
+
+	buf[0] |= (r & 0x07) << 5
+
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// 根据外部ip生成符合BEP 42的节点id
+func SecureNodeID(ip net.IP) [20]byte {
+	var id [20]byte
+
+	rand.Read(id[:])
+
+	if ip.To4() == nil {
+		return id
+	}
+
+	r := id[19] & 0x07
+	crc := idPrefix(ip, r)
+
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	id[19] = r
+
+	return id
+}
+
+func isExempt(ip net.IP) bool {
+	for _, n := range exemptNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 校验节点id是否与其ip匹配, 本地地址以及非ipv4地址总是视为匹配
+func IsSecureNodeID(id [20]byte, ip net.IP) bool {
+	if ip.To4() == nil || isExempt(ip) {
+		return true
+	}
+
+	crc := idPrefix(ip, id[19])
+
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// 处理响应中的ip字段, 多个不同ip的节点确认同一外部ip后据此更新自身的节点id
+//
+// 同一个ip的节点只算一票, 避免单个节点反复响应改变本地节点id
+func (d *DHT) voteExternalIP(from *net.UDPAddr, r krpcMsg) {
+	raw := r.str("ip")
+
+	if len(raw) != 6 {
+		return
+	}
+
+	ip := decodeCompactAddr([]byte(raw)).IP
+
+	d.mu.Lock()
+
+	if d.externalIP != nil && d.externalIP.Equal(ip) {
+		d.mu.Unlock()
+		return
+	}
+
+	key := ip.String()
+	voters, ok := d.ipVotes[key]
+
+	if !ok {
+		if len(d.ipVotes) >= maxIPCandidates {
+			d.ipVotes = make(map[string]map[string]bool)
+		}
+
+		voters = make(map[string]bool)
+		d.ipVotes[key] = voters
+	}
+
+	voters[from.IP.String()] = true
+
+	if len(voters) < externalIPVotes {
+		d.mu.Unlock()
+		return
+	}
+
+	d.externalIP = ip
+	d.ipVotes = make(map[string]map[string]bool)
+	d.mu.Unlock()
+
+	d.setExternalIP(ip)
+}
+
+// 外部ip改变时, 如果当前节点id不符合BEP 42则重新生成
+func (d *DHT) setExternalIP(ip net.IP) {
+	d.mu.Lock()
+	d.externalIP = ip
+	id := d.id
+	d.mu.Unlock()
+
+	if IsSecureNodeID(id, ip) {
+		return
+	}
+
+	id = SecureNodeID(ip)
+
+	d.mu.Lock()
+	d.id = id
+	d.mu.Unlock()
+
+	d.table.setSelf(id)
+}
+
+// 外部ip
+func (d *DHT) ExternalIP() net.IP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.externalIP
+}
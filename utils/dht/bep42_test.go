@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+// BEP 42 中的测试向量
+var bep42Vectors = []struct {
+	ip string
+	id string
+}{
+	{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func TestIsSecureNodeID(t *testing.T) {
+	for _, tt := range bep42Vectors {
+		t.Run(tt.ip, func(t *testing.T) {
+			var id [20]byte
+			copy(id[:], mustHex(t, tt.id))
+
+			ip := net.ParseIP(tt.ip)
+
+			if !IsSecureNodeID(id, ip) {
+				t.Fatalf("IsSecureNodeID(%s, %s) = false", tt.id, tt.ip)
+			}
+
+			// 前21位中的任意一位改变后不再匹配
+			id[2] ^= 0x08
+
+			if IsSecureNodeID(id, ip) {
+				t.Errorf("IsSecureNodeID accepted a modified id")
+			}
+		})
+	}
+}
+
+func TestSecureNodeID(t *testing.T) {
+	for _, addr := range []string{"124.31.75.21", "8.8.8.8", "192.168.1.2", "2001:db8::1"} {
+		t.Run(addr, func(t *testing.T) {
+			ip := net.ParseIP(addr)
+
+			// id的随机部分每次不同
+			for i := 0; i < 16; i++ {
+				if id := SecureNodeID(ip); !IsSecureNodeID(id, ip) {
+					t.Fatalf("SecureNodeID(%s) = %x is not secure", addr, id)
+				}
+			}
+		})
+	}
+}
+
+func TestExemptAddrs(t *testing.T) {
+	var id [20]byte
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.0.10", true},
+		{"169.254.1.1", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"8.8.8.8", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsSecureNodeID(id, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsSecureNodeID(zero, %s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestVoteExternalIP(t *testing.T) {
+	external := &net.UDPAddr{IP: net.ParseIP("124.31.75.21").To4(), Port: 6881}
+	resp := krpcMsg{"ip": string(encodeCompactAddr(external))}
+
+	tests := []struct {
+		name   string
+		voters []string
+		want   bool
+	}{
+		{name: "one voter", voters: []string{"1.1.1.1"}},
+		{name: "same ip repeated", voters: []string{"1.1.1.1", "1.1.1.1", "1.1.1.1", "1.1.1.1"}},
+		{name: "two voters", voters: []string{"1.1.1.1", "2.2.2.2", "2.2.2.2"}},
+		{name: "three voters", voters: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := New(Config{Addr: "127.0.0.1:0"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer d.Close()
+
+			for i, v := range tt.voters {
+				d.voteExternalIP(&net.UDPAddr{IP: net.ParseIP(v), Port: 1000 + i}, resp)
+			}
+
+			got := d.ExternalIP().Equal(external.IP)
+
+			if got != tt.want {
+				t.Fatalf("external ip = %v, want learned %v", d.ExternalIP(), tt.want)
+			}
+
+			if id := d.ID(); got && !IsSecureNodeID(id, external.IP) {
+				t.Errorf("node id %x does not match external ip", id)
+			}
+		})
+	}
+}
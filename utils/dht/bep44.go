@@ -0,0 +1,449 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// BEP 44 错误码
+const (
+	errValueTooBig  = 205
+	errBadSignature = 206
+	errSaltTooBig   = 207
+	errCASMismatch  = 301
+	errSeqTooSmall  = 302
+)
+
+const (
+	maxValueSize = 1000 // bencode后的v最大长度
+	maxSaltSize  = 64
+
+	itemExpire = 2 * time.Hour // 保存的item过期时间, 发布方需要定期重新put
+	maxItems   = 5000
+)
+
+// BEP 44 可变数据
+type MutableItem struct {
+	K    [32]byte    // ed25519公钥
+	Salt []byte      // 可选的salt, 同一个公钥可以通过不同salt发布多个item
+	Seq  int64       // 序列号, 只有更大的seq才能覆盖旧的数据
+	V    interface{} // 数据, 可以是任意可以bencode编码的值
+	Sig  [64]byte    // 签名
+	CAS  int64       // 大于0时要求存储节点当前的seq等于CAS, 否则put失败
+}
+
+// 可变数据在DHT中的target: sha1(k + salt)
+func MutableTarget(k [32]byte, salt []byte) [20]byte {
+	return sha1.Sum(append(k[:], salt...))
+}
+
+// 不可变数据在DHT中的target: sha1(bencode(v))
+func ImmutableTarget(v interface{}) ([20]byte, error) {
+	data, err := encodeValue(v)
+
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	return sha1.Sum(data), nil
+}
+
+func encodeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > maxValueSize {
+		return nil, fmt.Errorf("value is too big, size:%d, max:%d", buf.Len(), maxValueSize)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// 签名的原文: 4:salt<len>:<salt>3:seqi<seq>e1:v<bencode(v)>
+func signBuffer(salt []byte, seq int64, v []byte) []byte {
+	var buf bytes.Buffer
+
+	if len(salt) > 0 {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(v)
+
+	return buf.Bytes()
+}
+
+// 用私钥签名生成可变数据
+func NewMutableItem(priv ed25519.PrivateKey, salt []byte, seq int64, v interface{}) (*MutableItem, error) {
+	if len(salt) > maxSaltSize {
+		return nil, fmt.Errorf("salt is too big, size:%d, max:%d", len(salt), maxSaltSize)
+	}
+
+	data, err := encodeValue(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	item := &MutableItem{Salt: salt, Seq: seq, V: v}
+
+	copy(item.K[:], priv.Public().(ed25519.PublicKey))
+	copy(item.Sig[:], ed25519.Sign(priv, signBuffer(salt, seq, data)))
+
+	return item, nil
+}
+
+// 校验可变数据的签名
+func (item *MutableItem) Verify() error {
+	data, err := encodeValue(item.V)
+
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(item.K[:], signBuffer(item.Salt, item.Seq, data), item.Sig[:]) {
+		return fmt.Errorf("invalid signature for mutable item seq:%d", item.Seq)
+	}
+
+	return nil
+}
+
+func (item *MutableItem) Target() [20]byte {
+	return MutableTarget(item.K, item.Salt)
+}
+
+// 本地保存的item
+type storedItem struct {
+	v       interface{}
+	mutable *MutableItem // 不可变数据时为nil
+	expires time.Time
+}
+
+type itemStore struct {
+	mu    sync.Mutex
+	items map[[20]byte]*storedItem
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[[20]byte]*storedItem)}
+}
+
+func (s *itemStore) get(target [20]byte) *storedItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[target]
+
+	if !ok || time.Now().After(item.expires) {
+		return nil
+	}
+
+	return item
+}
+
+func (s *itemStore) put(target [20]byte, item *storedItem) *krpcError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.items[target]
+
+	if !ok && len(s.items) >= maxItems {
+		return &krpcError{errServer, "storage is full"}
+	}
+
+	if ok && old.mutable != nil && item.mutable != nil && time.Now().Before(old.expires) {
+		if item.mutable.CAS > 0 && item.mutable.CAS != old.mutable.Seq {
+			return &krpcError{errCASMismatch, "cas mismatch"}
+		}
+
+		if item.mutable.Seq < old.mutable.Seq {
+			return &krpcError{errSeqTooSmall, "sequence number less than current"}
+		}
+	}
+
+	item.expires = time.Now().Add(itemExpire)
+	s.items[target] = item
+
+	return nil
+}
+
+func (s *itemStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for target, item := range s.items {
+		if now.After(item.expires) {
+			delete(s.items, target)
+		}
+	}
+}
+
+// 响应get请求
+func (d *DHT) onGet(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	target, err := args.id("target")
+
+	if err != nil {
+		return nil, &krpcError{errProtocol, "invalid target"}
+	}
+
+	r := krpcMsg{
+		"token": d.token.create(from.IP),
+		"nodes": encodeNodes(d.table.closest(target, K)),
+	}
+
+	item := d.items.get(target)
+
+	if item == nil {
+		return r, nil
+	}
+
+	if item.mutable == nil {
+		r["v"] = item.v
+		return r, nil
+	}
+
+	r["seq"] = item.mutable.Seq
+
+	// 请求方已经有不小于该seq的数据时不返回v
+	if seq, ok := args.integer("seq"); ok && seq >= item.mutable.Seq {
+		return r, nil
+	}
+
+	r["v"] = item.mutable.V
+	r["k"] = string(item.mutable.K[:])
+	r["sig"] = string(item.mutable.Sig[:])
+
+	return r, nil
+}
+
+// 响应put请求
+func (d *DHT) onPut(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	if !d.token.validate(args.str("token"), from.IP) {
+		return nil, &krpcError{errProtocol, "bad token"}
+	}
+
+	v, ok := args["v"]
+
+	if !ok {
+		return nil, &krpcError{errProtocol, "missing v"}
+	}
+
+	data, err := encodeValue(v)
+
+	if err != nil {
+		return nil, &krpcError{errValueTooBig, "message (v field) too big"}
+	}
+
+	k := args.str("k")
+
+	// 不可变数据
+	if k == "" {
+		return krpcMsg{}, d.items.put(sha1.Sum(data), &storedItem{v: v})
+	}
+
+	item, kerr := mutableFromArgs(args)
+
+	if kerr != nil {
+		return nil, kerr
+	}
+
+	return krpcMsg{}, d.items.put(item.Target(), &storedItem{v: v, mutable: item})
+}
+
+// 从put请求或get响应中解析可变数据并校验签名
+func mutableFromArgs(args krpcMsg) (*MutableItem, *krpcError) {
+	k := args.str("k")
+	sig := args.str("sig")
+	salt := args.str("salt")
+
+	if len(k) != 32 || len(sig) != 64 {
+		return nil, &krpcError{errProtocol, "invalid k or sig"}
+	}
+
+	if len(salt) > maxSaltSize {
+		return nil, &krpcError{errSaltTooBig, "salt (salt field) too big"}
+	}
+
+	seq, _ := args.integer("seq")
+	cas, _ := args.integer("cas")
+
+	item := &MutableItem{Seq: seq, V: args["v"], CAS: cas}
+
+	if salt != "" {
+		item.Salt = []byte(salt)
+	}
+
+	copy(item.K[:], k)
+	copy(item.Sig[:], sig)
+
+	if item.Verify() != nil {
+		return nil, &krpcError{errBadSignature, "invalid signature"}
+	}
+
+	return item, nil
+}
+
+// 发布不可变数据, 返回其target
+func (d *DHT) PutImmutable(v interface{}) ([20]byte, error) {
+	target, err := ImmutableTarget(v)
+
+	if err != nil {
+		return target, err
+	}
+
+	err = d.put(target, krpcMsg{"v": v})
+
+	return target, err
+}
+
+// 查找不可变数据, 并校验数据的hash
+func (d *DHT) GetImmutable(target [20]byte) (interface{}, error) {
+	var value interface{}
+
+	d.lookup(target, "get", krpcMsg{"target": string(target[:])}, func(id [20]byte, r krpcMsg) {
+		v, ok := r["v"]
+
+		if !ok || value != nil {
+			return
+		}
+
+		if got, err := ImmutableTarget(v); err == nil && got == target {
+			value = v
+		}
+	})
+
+	if value == nil {
+		return nil, fmt.Errorf("immutable item %x not found", target)
+	}
+
+	return value, nil
+}
+
+// 发布可变数据
+func (d *DHT) PutMutable(item *MutableItem) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+
+	args := krpcMsg{
+		"v":   item.V,
+		"k":   string(item.K[:]),
+		"sig": string(item.Sig[:]),
+		"seq": item.Seq,
+	}
+
+	if len(item.Salt) > 0 {
+		args["salt"] = string(item.Salt)
+	}
+
+	if item.CAS > 0 {
+		args["cas"] = item.CAS
+	}
+
+	return d.put(item.Target(), args)
+}
+
+// 查找可变数据, 返回签名有效且seq最大的数据
+func (d *DHT) GetMutable(k [32]byte, salt []byte) (*MutableItem, error) {
+	target := MutableTarget(k, salt)
+
+	var best *MutableItem
+
+	d.lookup(target, "get", krpcMsg{"target": string(target[:])}, func(id [20]byte, r krpcMsg) {
+		if _, ok := r["v"]; !ok || r.str("k") != string(k[:]) {
+			return
+		}
+
+		// 签名原文中需要salt, 响应中不包含salt
+		if len(salt) > 0 {
+			r["salt"] = string(salt)
+		}
+
+		item, kerr := mutableFromArgs(r)
+
+		if kerr != nil {
+			return
+		}
+
+		if best == nil || item.Seq > best.Seq {
+			best = item
+		}
+	})
+
+	if best == nil {
+		return nil, fmt.Errorf("mutable item %x not found", target)
+	}
+
+	best.CAS = 0
+
+	return best, nil
+}
+
+// 将数据put到距离target最近的节点, 至少有一个节点存储成功时返回nil
+func (d *DHT) put(target [20]byte, args krpcMsg) error {
+	res := d.lookup(target, "get", krpcMsg{"target": string(target[:])}, nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	stored := 0
+	var lastErr error
+
+	for _, n := range res.nodes {
+		token, ok := res.tokens[n.ID]
+
+		if !ok {
+			continue
+		}
+
+		a := krpcMsg{"token": token}
+
+		for key, v := range args {
+			a[key] = v
+		}
+
+		wg.Add(1)
+
+		go func(n Node, a krpcMsg) {
+			defer wg.Done()
+
+			_, err := d.query(n.Addr, "put", a)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				lastErr = err
+				return
+			}
+
+			stored++
+		}(n, a)
+	}
+
+	wg.Wait()
+
+	if stored == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no dht node accepted put for %x", target)
+		}
+
+		return lastErr
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// BEP 44 中的测试向量
+func TestMutableItemVectors(t *testing.T) {
+	const pub = "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"
+
+	tests := []struct {
+		name   string
+		salt   string
+		sig    string
+		target string
+	}{
+		{
+			name:   "without salt",
+			sig:    "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			target: "4a533d47ec9c7d95b1ad75f576cffc641853b750",
+		},
+		{
+			name:   "with salt",
+			salt:   "foobar",
+			sig:    "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			target: "411eba73b6f087ca51a3795d9c8c938d365e32c1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := &MutableItem{Seq: 1, V: "Hello World!"}
+
+			if tt.salt != "" {
+				item.Salt = []byte(tt.salt)
+			}
+
+			copy(item.K[:], mustHex(t, pub))
+			copy(item.Sig[:], mustHex(t, tt.sig))
+
+			if err := item.Verify(); err != nil {
+				t.Fatalf("Verify() = %v", err)
+			}
+
+			target := item.Target()
+
+			if got := hex.EncodeToString(target[:]); got != tt.target {
+				t.Errorf("Target() = %s, want %s", got, tt.target)
+			}
+
+			item.Seq = 2
+
+			if err := item.Verify(); err == nil {
+				t.Error("Verify() accepted a changed seq")
+			}
+		})
+	}
+}
+
+func TestImmutableTarget(t *testing.T) {
+	target, err := ImmutableTarget("Hello World!")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := hex.EncodeToString(target[:]), "e5f96f6f38320f0f33959cb4d3d656452117aadb"; got != want {
+		t.Errorf("ImmutableTarget() = %s, want %s", got, want)
+	}
+}
+
+func TestNewMutableItem(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		salt    []byte
+		v       interface{}
+		wantErr bool
+	}{
+		{name: "string", v: "hello"},
+		{name: "salt", salt: []byte("salt"), v: int64(42)},
+		{name: "list", v: []interface{}{"a", int64(1)}},
+		{name: "salt too big", salt: make([]byte, maxSaltSize+1), v: "x", wantErr: true},
+		{name: "value too big", v: string(make([]byte, maxValueSize)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, err := NewMutableItem(priv, tt.salt, 7, tt.v)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewMutableItem() succeeded, want error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := item.Verify(); err != nil {
+				t.Errorf("Verify() = %v", err)
+			}
+
+			item.V = "tampered"
+
+			if err := item.Verify(); err == nil {
+				t.Error("Verify() accepted a tampered value")
+			}
+		})
+	}
+}
+
+func TestItemStoreCAS(t *testing.T) {
+	tests := []struct {
+		name     string
+		seq      int64
+		cas      int64
+		wantCode int
+	}{
+		{name: "newer seq", seq: 6},
+		{name: "same seq", seq: 5},
+		{name: "older seq", seq: 4, wantCode: errSeqTooSmall},
+		{name: "cas matches", seq: 6, cas: 5},
+		{name: "cas mismatch", seq: 6, cas: 4, wantCode: errCASMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newItemStore()
+
+			var target [20]byte
+
+			if err := s.put(target, &storedItem{mutable: &MutableItem{Seq: 5}}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := s.put(target, &storedItem{mutable: &MutableItem{Seq: tt.seq, CAS: tt.cas}})
+
+			code := 0
+
+			if err != nil {
+				code = err.code
+			}
+
+			if code != tt.wantCode {
+				t.Fatalf("put() error code = %d, want %d", code, tt.wantCode)
+			}
+
+			want := tt.seq
+
+			if tt.wantCode != 0 {
+				want = 5
+			}
+
+			if got := s.get(target).mutable.Seq; got != want {
+				t.Errorf("stored seq = %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package dht
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sampleInterval   = 6 * time.Hour // 告知请求方再次请求sample_infohashes前需要等待的时间
+	maxSamples       = 20            // 每个响应最多返回的infohash数
+	crawlConcurrency = 8
+)
+
+// sample_infohashes 响应
+type Samples struct {
+	Infohashes [][20]byte
+	Num        int           // 节点保存的infohash总数
+	Interval   time.Duration // 再次请求前需要等待的时间
+	Nodes      []Node
+}
+
+// 从本地保存的infohash中随机抽样
+func (s *peerStore) sample(n int) ([][20]byte, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make([][20]byte, 0, len(s.peers))
+
+	for ih := range s.peers {
+		all = append(all, ih)
+	}
+
+	// 部分洗牌选出前n个
+	for i := 0; i < n && i < len(all); i++ {
+		j, _ := rand.Int(rand.Reader, big.NewInt(int64(len(all)-i)))
+		k := i + int(j.Int64())
+		all[i], all[k] = all[k], all[i]
+	}
+
+	if len(all) > n {
+		return all[:n], len(all)
+	}
+
+	return all, len(all)
+}
+
+// 响应sample_infohashes请求
+func (d *DHT) onSampleInfohashes(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	target, err := args.id("target")
+
+	if err != nil {
+		return nil, &krpcError{errProtocol, "invalid target"}
+	}
+
+	samples, num := d.store.sample(maxSamples)
+
+	buf := make([]byte, 0, len(samples)*20)
+
+	for _, ih := range samples {
+		buf = append(buf, ih[:]...)
+	}
+
+	return krpcMsg{
+		"interval": int(sampleInterval / time.Second),
+		"num":      num,
+		"samples":  string(buf),
+		"nodes":    encodeNodes(d.table.closest(target, K)),
+	}, nil
+}
+
+// 向节点发送sample_infohashes请求
+func (d *DHT) SampleInfohashes(addr *net.UDPAddr, target [20]byte) (*Samples, error) {
+	r, err := d.query(addr, "sample_infohashes", krpcMsg{"target": string(target[:])})
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw := r.str("samples")
+
+	res := &Samples{Infohashes: make([][20]byte, 0, len(raw)/20)}
+
+	for i := 0; i+20 <= len(raw); i += 20 {
+		var ih [20]byte
+		copy(ih[:], raw[i:i+20])
+		res.Infohashes = append(res.Infohashes, ih)
+	}
+
+	num, _ := r.integer("num")
+	interval, _ := r.integer("interval")
+
+	res.Num = int(num)
+	res.Interval = time.Duration(interval) * time.Second
+	res.Nodes, _ = decodeNodes(r.str("nodes"))
+
+	return res, nil
+}
+
+// 等待再次请求的节点
+type crawlNode struct {
+	addr *net.UDPAddr
+	next time.Time
+}
+
+// 遍历DHT网络收集infohash, 每个新发现的infohash会调用一次found
+//
+// 会遵守每个节点返回的interval, 直到stop关闭或者没有可以请求的节点
+func (d *DHT) Crawl(stop <-chan struct{}, found func(infohash [20]byte)) {
+	var mu sync.Mutex
+
+	seenNodes := make(map[string]bool)
+	seenHashes := make(map[[20]byte]bool)
+	queue := make([]crawlNode, 0)
+
+	push := func(addr *net.UDPAddr, next time.Time) {
+		queue = append(queue, crawlNode{addr, next})
+	}
+
+	for _, n := range d.table.closest(d.ID(), 160*K) {
+		seenNodes[n.Addr.String()] = true
+		push(n.Addr, time.Time{})
+	}
+
+	sem := make(chan struct{}, crawlConcurrency)
+
+	var wg sync.WaitGroup
+
+	for {
+		select {
+		case <-stop:
+			wg.Wait()
+			return
+		case <-d.closed:
+			wg.Wait()
+			return
+		default:
+		}
+
+		mu.Lock()
+
+		// 取出第一个已经可以请求的节点
+		idx := -1
+
+		for i, cn := range queue {
+			if time.Now().After(cn.next) {
+				idx = i
+				break
+			}
+		}
+
+		var cn crawlNode
+
+		if idx >= 0 {
+			cn = queue[idx]
+			queue = append(queue[:idx], queue[idx+1:]...)
+		}
+
+		empty := len(queue) == 0
+		mu.Unlock()
+
+		if idx < 0 {
+			if empty && len(sem) == 0 {
+				wg.Wait()
+
+				mu.Lock()
+				empty = len(queue) == 0
+				mu.Unlock()
+
+				if empty {
+					return
+				}
+			}
+
+			time.Sleep(time.Second)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(cn crawlNode) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			// 每次使用随机target遍历不同的key空间
+			var target [20]byte
+			rand.Read(target[:])
+
+			res, err := d.SampleInfohashes(cn.addr, target)
+
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, ih := range res.Infohashes {
+				if !seenHashes[ih] {
+					seenHashes[ih] = true
+					found(ih)
+				}
+			}
+
+			// 节点还有更多infohash时在interval之后再次请求
+			if res.Num > len(res.Infohashes) && res.Interval > 0 {
+				push(cn.addr, time.Now().Add(res.Interval))
+			}
+
+			for _, n := range res.Nodes {
+				if !seenNodes[n.Addr.String()] {
+					seenNodes[n.Addr.String()] = true
+					push(n.Addr, time.Time{})
+				}
+			}
+		}(cn)
+	}
+}
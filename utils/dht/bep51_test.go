@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+func TestSampleInfohashes(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored int
+		want   int // 响应中的infohash数
+	}{
+		{name: "empty", stored: 0, want: 0},
+		{name: "fewer than max", stored: 5, want: 5},
+		{name: "more than max", stored: maxSamples + 10, want: maxSamples},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestDHT(t)
+			b := newTestDHT(t)
+
+			stored := make(map[[20]byte]bool)
+
+			for i := 0; i < tt.stored; i++ {
+				ih := [20]byte{byte(i), 1}
+				stored[ih] = true
+
+				a.store.add(ih, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+			}
+
+			res, err := b.SampleInfohashes(a.Addr(), [20]byte{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Interval != sampleInterval {
+				t.Errorf("interval = %v, want %v", res.Interval, sampleInterval)
+			}
+
+			if res.Num != tt.stored {
+				t.Errorf("num = %d, want %d", res.Num, tt.stored)
+			}
+
+			if len(res.Infohashes) != tt.want {
+				t.Fatalf("%d samples, want %d", len(res.Infohashes), tt.want)
+			}
+
+			seen := make(map[[20]byte]bool)
+
+			for _, ih := range res.Infohashes {
+				if !stored[ih] || seen[ih] {
+					t.Errorf("unexpected sample %x", ih)
+				}
+
+				seen[ih] = true
+			}
+		})
+	}
+}
+
+// 每次抽样都是随机的, 多次请求可以覆盖所有infohash
+func TestSampleCoversStore(t *testing.T) {
+	s := newPeerStore()
+
+	for i := 0; i < maxSamples*2; i++ {
+		s.add([20]byte{byte(i)}, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	}
+
+	seen := make(map[[20]byte]bool)
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(seen) < maxSamples*2 && time.Now().Before(deadline) {
+		samples, _ := s.sample(maxSamples)
+
+		for _, ih := range samples {
+			seen[ih] = true
+		}
+	}
+
+	if len(seen) != maxSamples*2 {
+		t.Errorf("samples covered %d of %d infohashes", len(seen), maxSamples*2)
+	}
+}
@@ -0,0 +1,679 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+const (
+	queryTimeout     = 5 * time.Second
+	announceInterval = 15 * time.Minute // 重新announce活跃torrent的周期
+	maintainInterval = time.Minute
+
+	minReadDelay = 10 * time.Millisecond // 读取失败后的等待时间, 连续失败时翻倍
+	maxReadDelay = time.Second
+)
+
+// 默认的bootstrap节点
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var ErrClosed = errors.New("dht node closed")
+
+// DHT 节点配置
+type Config struct {
+	Addr       string // udp监听地址, 如 ":6881"
+	TablePath  string // 路由表持久化文件, 为空则不保存
+	ExternalIP net.IP // 外部ip, 为空时通过其他节点响应中的ip字段获取
+	Conn       Conn   // 与其他协议共用的UDP连接, 为nil时在Addr上监听
+}
+
+// DHT使用的UDP连接, *net.UDPConn以及与uTP共用的连接都实现了该接口
+type Conn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// KRPC 协议错误
+type krpcError struct {
+	code int
+	msg  string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.code, e.msg)
+}
+
+// 处理某一类query, 返回响应的r字典
+type queryHandler func(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError)
+
+type pendingQuery struct {
+	addr *net.UDPAddr
+	resp chan krpcMsg
+}
+
+// 活跃torrent的announce信息
+type announceInfo struct {
+	port int
+	last time.Time
+}
+
+// DHT 节点, 既可以查找peers也会响应其他节点的请求
+type DHT struct {
+	cfg   Config
+	conn  Conn
+	table *table
+	token *tokenManager
+	store *peerStore
+	items *itemStore
+
+	handlers map[string]queryHandler
+
+	mu         sync.Mutex
+	id         [20]byte
+	externalIP net.IP
+	ipVotes    map[string]map[string]bool // 外部ip -> 给出该ip的节点ip
+	tid        uint16
+	pending    map[string]*pendingQuery
+	announces  map[[20]byte]*announceInfo
+
+	bootstrapping bool // 路由表节点不足时后台的Bootstrap正在进行
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+}
+
+// 创建并启动DHT节点
+//
+// 如果配置了路由表文件, 则复用其中的节点id以及节点
+func New(cfg Config) (*DHT, error) {
+	conn := cfg.Conn
+
+	if conn == nil {
+		addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		udp, err := net.ListenUDP("udp4", addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		conn = udp
+	}
+
+	d := &DHT{
+		cfg:       cfg,
+		conn:      conn,
+		token:     newTokenManager(),
+		store:     newPeerStore(),
+		items:     newItemStore(),
+		pending:   make(map[string]*pendingQuery),
+		announces: make(map[[20]byte]*announceInfo),
+		ipVotes:   make(map[string]map[string]bool),
+		closed:    make(chan struct{}),
+	}
+
+	var saved []Node
+
+	if cfg.TablePath != "" {
+		id, nodes, err := loadTable(cfg.TablePath)
+
+		if err == nil {
+			d.id = id
+			saved = nodes
+		}
+	}
+
+	// 已知外部ip时使用符合BEP 42的节点id
+	if cfg.ExternalIP != nil && !IsSecureNodeID(d.id, cfg.ExternalIP) {
+		d.id = SecureNodeID(cfg.ExternalIP)
+	}
+
+	if d.id == [20]byte{} {
+		rand.Read(d.id[:])
+	}
+
+	d.externalIP = cfg.ExternalIP
+	d.table = newTable(d.id)
+
+	d.handlers = map[string]queryHandler{
+		"ping":          d.onPing,
+		"find_node":     d.onFindNode,
+		"get_peers":     d.onGetPeers,
+		"announce_peer": d.onAnnouncePeer,
+		"get":           d.onGet,
+		"put":           d.onPut,
+
+		"sample_infohashes": d.onSampleInfohashes,
+	}
+
+	d.wg.Add(2)
+	go d.readLoop()
+	go d.maintainLoop()
+
+	// 先ping保存的节点, 有响应的节点会进入路由表
+	for _, n := range saved {
+		go d.ping(n.Addr)
+	}
+
+	return d, nil
+}
+
+// 节点id
+func (d *DHT) ID() [20]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.id
+}
+
+// 本地监听地址
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// 路由表中的节点数
+func (d *DHT) NumNodes() int {
+	return d.table.len()
+}
+
+// 关闭节点并保存路由表, 可以并发多次调用
+func (d *DHT) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+
+		d.closeErr = d.conn.Close()
+
+		d.wg.Wait()
+
+		if d.cfg.TablePath != "" {
+			if err := d.table.save(d.cfg.TablePath); err != nil {
+				d.closeErr = err
+			}
+		}
+	})
+
+	return d.closeErr
+}
+
+// 通过给定的地址加入DHT网络, 地址格式为 host:port
+func (d *DHT) Bootstrap(addrs []string) {
+	var wg sync.WaitGroup
+
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp4", a)
+
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+
+			d.findNode(addr, d.ID())
+		}(addr)
+	}
+
+	wg.Wait()
+
+	// 查找自身id附近的节点来填充路由表
+	self := d.ID()
+	d.lookup(self, "find_node", krpcMsg{"target": string(self[:])}, nil)
+}
+
+// 查找infohash对应的peers
+func (d *DHT) GetPeers(infohash [20]byte) ([]peers.Peer, error) {
+	ps, res := d.getPeers(infohash)
+
+	if len(ps) == 0 && len(res.nodes) == 0 {
+		return nil, fmt.Errorf("dht lookup for %x found no nodes", infohash)
+	}
+
+	return ps, nil
+}
+
+// 通过get_peers迭代查找, 返回找到的peers以及最近的节点
+func (d *DHT) getPeers(infohash [20]byte) ([]peers.Peer, *lookupResult) {
+	seen := make(map[string]bool)
+	ps := make([]peers.Peer, 0)
+
+	res := d.lookup(infohash, "get_peers", krpcMsg{"info_hash": string(infohash[:])}, func(id [20]byte, r krpcMsg) {
+		values := r.strList("values")
+
+		if len(values) == 0 {
+			return
+		}
+
+		found, err := peers.Unmarshal([]byte(strings.Join(values, "")))
+
+		if err != nil {
+			return
+		}
+
+		for _, p := range found {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				ps = append(ps, p)
+			}
+		}
+	})
+
+	return ps, res
+}
+
+// 标记torrent为活跃状态, 节点会定期向DHT网络announce本地的端口
+func (d *DHT) Announce(infohash [20]byte, port int) {
+	d.mu.Lock()
+	d.announces[infohash] = &announceInfo{port: port}
+	d.mu.Unlock()
+
+	go d.announce(infohash, port)
+}
+
+// 停止announce torrent
+func (d *DHT) StopAnnounce(infohash [20]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.announces, infohash)
+}
+
+// 向离infohash最近的节点发送announce_peer
+func (d *DHT) announce(infohash [20]byte, port int) {
+	_, res := d.getPeers(infohash)
+
+	for _, n := range res.nodes {
+		token, ok := res.tokens[n.ID]
+
+		if !ok {
+			continue
+		}
+
+		go d.query(n.Addr, "announce_peer", krpcMsg{
+			"info_hash":    string(infohash[:]),
+			"port":         port,
+			"implied_port": 0,
+			"token":        token,
+		})
+	}
+
+	d.mu.Lock()
+	if info, ok := d.announces[infohash]; ok {
+		info.last = time.Now()
+	}
+	d.mu.Unlock()
+}
+
+func (d *DHT) maintainLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		d.store.expire()
+		d.items.expire()
+
+		if d.table.len() < K {
+			d.startBootstrap()
+		}
+
+		d.mu.Lock()
+		for ih, info := range d.announces {
+			if time.Since(info.last) > announceInterval {
+				info.last = time.Now()
+				go d.announce(ih, info.port)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// 在后台从默认节点重新加入网络, 上一次还没有结束时不再启动, 返回是否启动
+func (d *DHT) startBootstrap() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.bootstrapping {
+		return false
+	}
+
+	select {
+	case <-d.closed:
+		return false
+	default:
+	}
+
+	d.bootstrapping = true
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+
+		d.Bootstrap(DefaultBootstrapNodes)
+
+		d.mu.Lock()
+		d.bootstrapping = false
+		d.mu.Unlock()
+	}()
+
+	return true
+}
+
+// 连续读取失败后的下一次等待时间
+func nextReadDelay(d time.Duration) time.Duration {
+	if d < minReadDelay {
+		return minReadDelay
+	}
+
+	if d *= 2; d > maxReadDelay {
+		d = maxReadDelay
+	}
+
+	return d
+}
+
+func (d *DHT) readLoop() {
+	defer d.wg.Done()
+
+	buf := make([]byte, 65536)
+
+	var delay time.Duration
+
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+
+			// 共用的socket已经关闭
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Println("dht read failed:", err)
+
+			// 其他错误可能持续出现, 等待后重试
+			delay = nextReadDelay(delay)
+
+			select {
+			case <-d.closed:
+				return
+			case <-time.After(delay):
+			}
+
+			continue
+		}
+
+		delay = 0
+
+		msg, err := decodeMsg(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		switch msg.str("y") {
+		case "q":
+			d.handleQuery(addr, msg)
+		case "r", "e":
+			d.handleResponse(addr, msg)
+		}
+	}
+}
+
+func (d *DHT) handleQuery(addr *net.UDPAddr, msg krpcMsg) {
+	tid := msg.str("t")
+	args := msg.dict("a")
+
+	id, err := args.id("id")
+
+	if err != nil {
+		d.send(addr, errorMsg(tid, errProtocol, "invalid id"))
+		return
+	}
+
+	handler, ok := d.handlers[msg.str("q")]
+
+	if !ok {
+		d.send(addr, errorMsg(tid, errMethod, "method unknown"))
+		return
+	}
+
+	r, kerr := handler(addr, args)
+
+	if kerr != nil {
+		d.send(addr, errorMsg(tid, kerr.code, kerr.msg))
+		return
+	}
+
+	self := d.ID()
+	r["id"] = string(self[:])
+
+	// 告知请求方其外部地址
+	d.send(addr, krpcMsg{"t": tid, "y": "r", "r": map[string]interface{}(r), "ip": string(encodeCompactAddr(addr))})
+
+	d.table.insert(Node{ID: id, Addr: addr})
+}
+
+func (d *DHT) handleResponse(addr *net.UDPAddr, msg krpcMsg) {
+	tid := msg.str("t")
+
+	d.mu.Lock()
+	pq, ok := d.pending[tid]
+
+	if ok && sameAddr(pq.addr, addr) {
+		delete(d.pending, tid)
+	} else {
+		ok = false
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	pq.resp <- msg
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg krpcMsg) error {
+	data, err := encodeMsg(msg)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(data, addr)
+
+	return err
+}
+
+// 发送query并等待响应, 返回响应中的r字典
+func (d *DHT) query(addr *net.UDPAddr, q string, args krpcMsg) (krpcMsg, error) {
+	self := d.ID()
+	args["id"] = string(self[:])
+
+	pq := &pendingQuery{addr: addr, resp: make(chan krpcMsg, 1)}
+
+	d.mu.Lock()
+	d.tid++
+	tidBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(tidBuf, d.tid)
+	tid := string(tidBuf)
+	d.pending[tid] = pq
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	msg := krpcMsg{"t": tid, "y": "q", "q": q, "a": map[string]interface{}(args)}
+
+	err := d.send(addr, msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-pq.resp:
+		if resp.str("y") == "e" {
+			return nil, fmt.Errorf("%s to %s failed: %v", q, addr, resp["e"])
+		}
+
+		d.voteExternalIP(addr, resp)
+
+		r := resp.dict("r")
+
+		id, err := r.id("id")
+
+		if err != nil {
+			return nil, err
+		}
+
+		d.table.insert(Node{ID: id, Addr: addr})
+
+		return r, nil
+	case <-timer.C:
+		d.markFailed(addr)
+		return nil, fmt.Errorf("%s to %s timed out", q, addr)
+	case <-d.closed:
+		return nil, ErrClosed
+	}
+}
+
+// 将超时地址对应的路由表节点标记为失败
+func (d *DHT) markFailed(addr *net.UDPAddr) {
+	for _, n := range d.table.closest(d.ID(), 160*K) {
+		if sameAddr(n.Addr, addr) {
+			d.table.failed(n.ID)
+		}
+	}
+}
+
+func (d *DHT) ping(addr *net.UDPAddr) error {
+	_, err := d.query(addr, "ping", krpcMsg{})
+	return err
+}
+
+func (d *DHT) findNode(addr *net.UDPAddr, target [20]byte) ([]Node, error) {
+	r, err := d.query(addr, "find_node", krpcMsg{"target": string(target[:])})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeNodes(r.str("nodes"))
+}
+
+func (d *DHT) onPing(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	return krpcMsg{}, nil
+}
+
+func (d *DHT) onFindNode(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	target, err := args.id("target")
+
+	if err != nil {
+		return nil, &krpcError{errProtocol, "invalid target"}
+	}
+
+	return krpcMsg{"nodes": encodeNodes(d.table.closest(target, K))}, nil
+}
+
+func (d *DHT) onGetPeers(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	infohash, err := args.id("info_hash")
+
+	if err != nil {
+		return nil, &krpcError{errProtocol, "invalid info_hash"}
+	}
+
+	r := krpcMsg{"token": d.token.create(from.IP)}
+
+	stored := d.store.get(infohash)
+
+	if len(stored) > 0 {
+		values := make([]interface{}, 0, len(stored))
+
+		for _, p := range stored {
+			addr := encodeCompactAddr(&net.UDPAddr{IP: p.IP, Port: int(p.Port)})
+
+			if addr != nil {
+				values = append(values, string(addr))
+			}
+		}
+
+		r["values"] = values
+	} else {
+		r["nodes"] = encodeNodes(d.table.closest(infohash, K))
+	}
+
+	return r, nil
+}
+
+func (d *DHT) onAnnouncePeer(from *net.UDPAddr, args krpcMsg) (krpcMsg, *krpcError) {
+	infohash, err := args.id("info_hash")
+
+	if err != nil {
+		return nil, &krpcError{errProtocol, "invalid info_hash"}
+	}
+
+	if !d.token.validate(args.str("token"), from.IP) {
+		return nil, &krpcError{errProtocol, "bad token"}
+	}
+
+	// 忽略节点id不符合BEP 42的节点
+	if id, _ := args.id("id"); !IsSecureNodeID(id, from.IP) {
+		return krpcMsg{}, nil
+	}
+
+	port, _ := args.integer("port")
+
+	if implied, _ := args.integer("implied_port"); implied != 0 {
+		port = int64(from.Port)
+	}
+
+	if port <= 0 || port > 65535 {
+		return nil, &krpcError{errProtocol, "invalid port"}
+	}
+
+	d.store.add(infohash, peers.Peer{IP: from.IP, Port: uint(port)})
+
+	return krpcMsg{}, nil
+}
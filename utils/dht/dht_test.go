@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDHT(t *testing.T) *DHT {
+	t.Helper()
+
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+// 信号处理和defer可能同时关闭节点
+func TestConcurrentClose(t *testing.T) {
+	d := newTestDHT(t)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			d.Close()
+		}()
+	}
+
+	wg.Wait()
+
+	if d.startBootstrap() {
+		t.Error("bootstrap started after Close")
+	}
+}
+
+// 上一次Bootstrap没有结束时不再启动新的
+func TestStartBootstrapOnce(t *testing.T) {
+	d := newTestDHT(t)
+
+	d.mu.Lock()
+	d.bootstrapping = true
+	d.mu.Unlock()
+
+	if d.startBootstrap() {
+		t.Error("bootstrap started while another one is running")
+	}
+}
+
+// 读取总是失败的连接, 关闭后返回net.ErrClosed
+type failingConn struct {
+	reads  int32
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *failingConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	atomic.AddInt32(&c.reads, 1)
+
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	default:
+	}
+
+	return 0, nil, errors.New("read failed")
+}
+
+func (c *failingConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return len(b), nil
+}
+
+func (c *failingConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (c *failingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+
+	return nil
+}
+
+// 读取持续失败时等待后重试, 而不是空转
+func TestReadLoopBackoff(t *testing.T) {
+	conn := &failingConn{closed: make(chan struct{})}
+
+	d, err := New(Config{Conn: conn})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&conn.reads); n > 10 {
+		t.Errorf("%d reads in 200ms after errors", n)
+	}
+
+	d.Close()
+}
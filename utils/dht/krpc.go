@@ -0,0 +1,181 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC 错误码
+const (
+	errGeneric  = 201
+	errServer   = 202
+	errProtocol = 203
+	errMethod   = 204
+)
+
+// 单个compact node info的长度: 20字节id + 4字节ip + 2字节端口
+const compactNodeSize = 26
+
+// DHT 网络中的节点
+type Node struct {
+	ID   [20]byte
+	Addr *net.UDPAddr
+}
+
+func (n Node) String() string {
+	return fmt.Sprintf("%x@%s", n.ID[:4], n.Addr.String())
+}
+
+// KRPC 报文, 以通用的bencode字典表示
+type krpcMsg map[string]interface{}
+
+func (m krpcMsg) str(key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func (m krpcMsg) dict(key string) krpcMsg {
+	d, _ := m[key].(map[string]interface{})
+	return krpcMsg(d)
+}
+
+func (m krpcMsg) integer(key string) (int64, bool) {
+	i, ok := m[key].(int64)
+	return i, ok
+}
+
+// 返回字典中的字符串列表, 忽略非字符串元素
+func (m krpcMsg) strList(key string) []string {
+	list, _ := m[key].([]interface{})
+
+	res := make([]string, 0, len(list))
+
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			res = append(res, s)
+		}
+	}
+
+	return res
+}
+
+// 读取20字节的id类字段
+func (m krpcMsg) id(key string) ([20]byte, error) {
+	var id [20]byte
+
+	s := m.str(key)
+
+	if len(s) != 20 {
+		return id, fmt.Errorf("invalid %s length:%d", key, len(s))
+	}
+
+	copy(id[:], s)
+
+	return id, nil
+}
+
+func encodeMsg(m krpcMsg) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, map[string]interface{}(m))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeMsg(data []byte) (krpcMsg, error) {
+	v, err := bencode.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("krpc msg is not a dict")
+	}
+
+	return krpcMsg(d), nil
+}
+
+// 生成error报文
+func errorMsg(tid string, code int, text string) krpcMsg {
+	return krpcMsg{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, text},
+	}
+}
+
+// 将ipv4地址编码为6字节的compact peer info
+func encodeCompactAddr(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+
+	if ip == nil {
+		return nil
+	}
+
+	buf := make([]byte, 6)
+
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[4:], uint16(addr.Port))
+
+	return buf
+}
+
+func decodeCompactAddr(buf []byte) *net.UDPAddr {
+	ip := make(net.IP, 4)
+	copy(ip, buf[:4])
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(buf[4:6]))}
+}
+
+// 编码compact node info列表
+func encodeNodes(nodes []Node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+
+	for _, n := range nodes {
+		addr := encodeCompactAddr(n.Addr)
+
+		if addr == nil {
+			continue
+		}
+
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, addr...)
+	}
+
+	return string(buf)
+}
+
+// 解码compact node info列表
+func decodeNodes(s string) ([]Node, error) {
+	if len(s)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("received malformed nodes, length:%d", len(s))
+	}
+
+	nodes := make([]Node, 0, len(s)/compactNodeSize)
+
+	for i := 0; i < len(s); i += compactNodeSize {
+		var n Node
+
+		copy(n.ID[:], s[i:i+20])
+		n.Addr = decodeCompactAddr([]byte(s[i+20 : i+compactNodeSize]))
+
+		if n.Addr.Port == 0 {
+			continue
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,138 @@
+package dht
+
+import (
+	"sync"
+)
+
+// 同时进行的查询数
+const alpha = 3
+
+// 迭代查找的结果
+type lookupResult struct {
+	nodes  []Node              // 距离target最近的K个有响应的节点
+	tokens map[[20]byte]string // 响应中携带的token, 用于之后的announce_peer/put
+}
+
+// 迭代查找距离target最近的节点
+//
+// 每一轮向最近的未查询节点发送q请求, args为请求参数,
+// collect不为nil时会在收到每个响应后被调用
+func (d *DHT) lookup(target [20]byte, q string, args krpcMsg, collect func(id [20]byte, r krpcMsg)) *lookupResult {
+	res := &lookupResult{tokens: make(map[[20]byte]string)}
+
+	candidates := d.table.closest(target, K)
+	queried := make(map[string]bool)
+	responded := make([]Node, 0, K)
+
+	var mu sync.Mutex
+
+	for {
+		select {
+		case <-d.closed:
+			return res
+		default:
+		}
+
+		// 选出最近的K个候选中尚未查询过的节点
+		sortByDistance(candidates, target)
+
+		batch := make([]Node, 0, alpha)
+
+		for i := 0; i < len(candidates) && i < K && len(batch) < alpha; i++ {
+			key := candidates[i].Addr.String()
+
+			if !queried[key] {
+				queried[key] = true
+				batch = append(batch, candidates[i])
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+
+		found := make([]Node, 0)
+
+		for _, n := range batch {
+			wg.Add(1)
+
+			go func(n Node) {
+				defer wg.Done()
+
+				// query会修改参数, 每个请求使用单独的副本
+				a := make(krpcMsg, len(args)+1)
+
+				for k, v := range args {
+					a[k] = v
+				}
+
+				r, err := d.query(n.Addr, q, a)
+
+				if err != nil {
+					return
+				}
+
+				id, err := r.id("id")
+
+				if err != nil {
+					return
+				}
+
+				nodes, _ := decodeNodes(r.str("nodes"))
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				responded = append(responded, Node{ID: id, Addr: n.Addr})
+
+				if token := r.str("token"); token != "" {
+					res.tokens[id] = token
+				}
+
+				if collect != nil {
+					collect(id, r)
+				}
+
+				found = append(found, nodes...)
+			}(n)
+		}
+
+		wg.Wait()
+
+		for _, n := range found {
+			if !queried[n.Addr.String()] {
+				candidates = append(candidates, n)
+			}
+		}
+
+		candidates = dedupNodes(candidates)
+	}
+
+	sortByDistance(responded, target)
+
+	if len(responded) > K {
+		responded = responded[:K]
+	}
+
+	res.nodes = responded
+
+	return res
+}
+
+func dedupNodes(nodes []Node) []Node {
+	seen := make(map[string]bool, len(nodes))
+	res := nodes[:0]
+
+	for _, n := range nodes {
+		key := n.Addr.String()
+
+		if !seen[key] {
+			seen[key] = true
+			res = append(res, n)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+const (
+	peerExpire         = 30 * time.Minute // announce_peer保存的peer过期时间
+	maxPeersPerHash    = 2000             // 每个infohash最多保存的peer数
+	maxHashes          = 10000            // 最多保存的infohash数
+	maxValuesPerAnswer = 50               // get_peers响应中最多返回的peer数
+)
+
+type storedPeer struct {
+	peer    peers.Peer
+	expires time.Time
+}
+
+// 保存其他节点announce的peer
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]*storedPeer
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[string]*storedPeer)}
+}
+
+func (s *peerStore) add(infohash [20]byte, p peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.peers[infohash]
+
+	if !ok {
+		if len(s.peers) >= maxHashes {
+			return
+		}
+
+		m = make(map[string]*storedPeer)
+		s.peers[infohash] = m
+	}
+
+	key := p.String()
+
+	if _, ok := m[key]; !ok && len(m) >= maxPeersPerHash {
+		return
+	}
+
+	m[key] = &storedPeer{peer: p, expires: time.Now().Add(peerExpire)}
+}
+
+// 返回infohash对应的未过期peer
+func (s *peerStore) get(infohash [20]byte) []peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]peers.Peer, 0)
+
+	for _, sp := range s.peers[infohash] {
+		if len(res) >= maxValuesPerAnswer {
+			break
+		}
+
+		if time.Now().Before(sp.expires) {
+			res = append(res, sp.peer)
+		}
+	}
+
+	return res
+}
+
+// 清理过期的peer
+func (s *peerStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for ih, m := range s.peers {
+		for key, sp := range m {
+			if now.After(sp.expires) {
+				delete(m, key)
+			}
+		}
+
+		if len(m) == 0 {
+			delete(s.peers, ih)
+		}
+	}
+}
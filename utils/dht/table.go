@@ -0,0 +1,276 @@
+package dht
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	K = 8 // 每个bucket最多保存的节点数
+
+	nodeBadAfter  = 15 * time.Minute // 超过该时间未响应的节点视为可替换
+	nodeMaxFailed = 2                // 连续失败次数超过该值的节点视为bad
+)
+
+// 路由表中保存的节点状态
+type tableNode struct {
+	Node
+	lastSeen time.Time
+	failed   int
+	secure   bool // 节点id是否符合BEP 42
+}
+
+func (n *tableNode) bad() bool {
+	return n.failed >= nodeMaxFailed || time.Since(n.lastSeen) > nodeBadAfter
+}
+
+// 路由表
+//
+// 按照与自身id的公共前缀长度划分为160个bucket
+type table struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [160][]*tableNode
+}
+
+func newTable(self [20]byte) *table {
+	return &table{self: self}
+}
+
+// 计算两个id的xor距离
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+
+	return d
+}
+
+// 返回公共前缀长度, 用作bucket下标
+func prefixLen(a, b [20]byte) int {
+	for i := 0; i < 20; i++ {
+		x := a[i] ^ b[i]
+
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return 159
+}
+
+func (t *table) bucketIdx(id [20]byte) int {
+	idx := prefixLen(t.self, id)
+
+	if idx > 159 {
+		idx = 159
+	}
+
+	return idx
+}
+
+// 记录一个有响应的节点
+func (t *table) insert(n Node) {
+	if n.ID == t.self || n.Addr == nil || n.Addr.Port == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := t.bucketIdx(n.ID)
+	bucket := t.buckets[idx]
+
+	for _, tn := range bucket {
+		if tn.ID == n.ID {
+			tn.Addr = n.Addr
+			tn.lastSeen = time.Now()
+			tn.failed = 0
+			return
+		}
+	}
+
+	tn := &tableNode{Node: n, lastSeen: time.Now(), secure: IsSecureNodeID(n.ID, n.Addr.IP)}
+
+	if len(bucket) < K {
+		t.buckets[idx] = append(bucket, tn)
+		return
+	}
+
+	// bucket已满时替换掉bad节点
+	for i, old := range bucket {
+		if old.bad() {
+			bucket[i] = tn
+			return
+		}
+	}
+
+	// 优先保留节点id符合BEP 42的节点
+	if !tn.secure {
+		return
+	}
+
+	for i, old := range bucket {
+		if !old.secure {
+			bucket[i] = tn
+			return
+		}
+	}
+}
+
+// 自身id改变后按照新的id重新划分bucket
+func (t *table) setSelf(self [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old := t.buckets
+
+	t.self = self
+	t.buckets = [160][]*tableNode{}
+
+	for _, bucket := range old {
+		for _, tn := range bucket {
+			if tn.ID == self {
+				continue
+			}
+
+			idx := t.bucketIdx(tn.ID)
+
+			if len(t.buckets[idx]) < K {
+				t.buckets[idx] = append(t.buckets[idx], tn)
+			}
+		}
+	}
+}
+
+// 记录一个查询失败的节点
+func (t *table) failed(id [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := t.bucketIdx(id)
+
+	for _, tn := range t.buckets[idx] {
+		if tn.ID == id {
+			tn.failed++
+			return
+		}
+	}
+}
+
+// 返回距离target最近的n个节点
+func (t *table) closest(target [20]byte, n int) []Node {
+	t.mu.Lock()
+
+	nodes := make([]Node, 0, K*4)
+
+	for _, bucket := range t.buckets {
+		for _, tn := range bucket {
+			if tn.failed < nodeMaxFailed {
+				nodes = append(nodes, tn.Node)
+			}
+		}
+	}
+
+	t.mu.Unlock()
+
+	sortByDistance(nodes, target)
+
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := 0
+
+	for _, bucket := range t.buckets {
+		total += len(bucket)
+	}
+
+	return total
+}
+
+func sortByDistance(nodes []Node, target [20]byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di := distance(nodes[i].ID, target)
+		dj := distance(nodes[j].ID, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// 路由表持久化格式
+type tableFile struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// 保存路由表到文件
+func (t *table) save(path string) error {
+	nodes := t.closest(t.self, 160*K)
+
+	tf := tableFile{
+		ID:    string(t.self[:]),
+		Nodes: encodeNodes(nodes),
+	}
+
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, tf)
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// 读取保存的路由表文件, 返回节点id以及节点列表
+func loadTable(path string) ([20]byte, []Node, error) {
+	var id [20]byte
+
+	r, err := os.Open(path)
+
+	if err != nil {
+		return id, nil, err
+	}
+
+	defer r.Close()
+
+	tf := tableFile{}
+
+	err = bencode.Unmarshal(r, &tf)
+
+	if err != nil {
+		return id, nil, err
+	}
+
+	copy(id[:], tf.ID)
+
+	nodes, err := decodeNodes(tf.Nodes)
+
+	if err != nil {
+		return id, nil, err
+	}
+
+	return id, nodes, nil
+}
+
+// 判断两个udp地址是否相同
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
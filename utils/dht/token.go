@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// token密钥轮换周期, 上一个周期的token依然有效
+const tokenRotateInterval = 5 * time.Minute
+
+// 根据轮换的密钥为get_peers请求方生成token
+type tokenManager struct {
+	mu      sync.Mutex
+	secret  [20]byte
+	prev    [20]byte
+	rotated time.Time
+}
+
+func newTokenManager() *tokenManager {
+	tm := &tokenManager{rotated: time.Now()}
+
+	rand.Read(tm.secret[:])
+	tm.prev = tm.secret
+
+	return tm
+}
+
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotated) < tokenRotateInterval {
+		return
+	}
+
+	tm.prev = tm.secret
+	rand.Read(tm.secret[:])
+	tm.rotated = time.Now()
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	h := sha1.New()
+
+	h.Write(secret[:])
+	h.Write(ip.To16())
+
+	return string(h.Sum(nil)[:8])
+}
+
+// 为ip生成token
+func (tm *tokenManager) create(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.rotate()
+
+	return tokenFor(tm.secret, ip)
+}
+
+// 校验ip携带的token
+func (tm *tokenManager) validate(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.rotate()
+
+	return token == tokenFor(tm.secret, ip) || token == tokenFor(tm.prev, ip)
+}
@@ -0,0 +1,196 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxHashFailures = 2 // 单独提供的piece校验失败达到该次数时封禁
+	subnetOffenders = 3 // 同一网段中被封禁的ip达到该数量时封禁整个网段
+)
+
+// 被封禁的ip或网段
+type Ban struct {
+	Addr   string // ip地址, 或者升级为封禁网段时的CIDR
+	Reason string
+	Time   time.Time
+}
+
+func (b Ban) String() string {
+	return fmt.Sprintf("%s (%s)", b.Addr, b.Reason)
+}
+
+// 本次运行中被封禁的peer, 所有torrent共用
+//
+// 同一网段中被封禁的ip达到subnetOffenders个时, 升级为封禁整个网段;
+// 局域网和本机地址不升级, 避免封禁同一局域网中的其他用户
+type banList struct {
+	mu       sync.Mutex
+	ips      map[string]*Ban
+	subnets  map[string]*Ban
+	failures map[string]int // 单独提供的piece校验失败的次数
+}
+
+var bans = banList{
+	ips:      make(map[string]*Ban),
+	subnets:  make(map[string]*Ban),
+	failures: make(map[string]int),
+}
+
+// ipv4取/24, ipv6取/64
+func subnet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	}
+
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+}
+
+// ip是否被封禁
+func IsBanned(ip net.IP) bool {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	if _, ok := bans.ips[ip.String()]; ok {
+		return true
+	}
+
+	_, ok := bans.subnets[subnet(ip).String()]
+
+	return ok
+}
+
+// 所有被封禁的ip和网段
+func Banned() []Ban {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	list := make([]Ban, 0, len(bans.ips)+len(bans.subnets))
+
+	for _, b := range bans.ips {
+		list = append(list, *b)
+	}
+
+	for _, b := range bans.subnets {
+		list = append(list, *b)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.Before(list[j].Time)
+	})
+
+	return list
+}
+
+// 封禁ip, 返回false表示已经被封禁
+func (l *banList) ban(ip net.IP, reason string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+
+	if _, ok := l.ips[key]; ok {
+		return false
+	}
+
+	now := time.Now()
+
+	l.ips[key] = &Ban{Addr: key, Reason: reason, Time: now}
+
+	log.Printf("banned %s: %s\n", key, reason)
+
+	if isLocal(ip) {
+		return true
+	}
+
+	// 同一网段中的重复违规
+	network := subnet(ip)
+	netKey := network.String()
+
+	if _, ok := l.subnets[netKey]; ok {
+		return true
+	}
+
+	offenders := 0
+
+	for addr := range l.ips {
+		if network.Contains(net.ParseIP(addr)) {
+			offenders++
+		}
+	}
+
+	if offenders >= subnetOffenders {
+		l.subnets[netKey] = &Ban{Addr: netKey, Reason: fmt.Sprintf("%d banned peers in subnet", offenders), Time: now}
+
+		log.Printf("banned %s: %d banned peers in subnet\n", netKey, offenders)
+	}
+
+	return true
+}
+
+// ip单独提供的piece校验失败, 达到maxHashFailures次后封禁
+func (l *banList) hashFailed(ip net.IP) bool {
+	l.mu.Lock()
+
+	key := ip.String()
+
+	l.failures[key]++
+	n := l.failures[key]
+
+	l.mu.Unlock()
+
+	if n < maxHashFailures {
+		return false
+	}
+
+	return l.ban(ip, fmt.Sprintf("sent %d pieces that failed the hash check", n))
+}
+
+// piece校验失败, 记录每个block的来源
+func (t *Torrent) pieceFailed(index int) {
+	sources := t.picker.failed(index)
+
+	// 所有block都来自同一个peer时直接记录
+	if len(sources) == 1 && bans.hashFailed(net.ParseIP(sources[0])) {
+		t.dropBanned()
+	}
+}
+
+// piece校验通过, 与之前失败的数据比较找出提供错误block的peer
+func (t *Torrent) pieceVerified(index int, buf []byte) {
+	banned := false
+
+	for _, ip := range t.picker.culprits(index, buf) {
+		if bans.ban(net.ParseIP(ip), fmt.Sprintf("sent corrupt data for piece #%d", index)) {
+			banned = true
+		}
+	}
+
+	if banned {
+		t.dropBanned()
+	}
+}
+
+// 断开被封禁的peer
+func (t *Torrent) dropBanned() {
+	t.mu.Lock()
+
+	var drop []*peerConn
+
+	for _, pc := range t.conns {
+		if IsBanned(pc.c.Peer().IP) {
+			drop = append(drop, pc)
+		}
+	}
+
+	t.mu.Unlock()
+
+	for _, pc := range drop {
+		pc.c.Close()
+	}
+}
@@ -0,0 +1,203 @@
+package downloader
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newBanList() *banList {
+	return &banList{
+		ips:      make(map[string]*Ban),
+		subnets:  make(map[string]*Ban),
+		failures: make(map[string]int),
+	}
+}
+
+// 校验失败的piece重新下载并校验通过后, 找出之前提供了错误block的peer
+func TestCulprits(t *testing.T) {
+	tests := []struct {
+		name    string
+		senders []string // 第一次下载时每个block的来源
+		corrupt []int    // 第一次下载时数据错误的block
+		want    []string
+	}{
+		{
+			name:    "single culprit",
+			senders: []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2"},
+			corrupt: []int{1},
+			want:    []string{"10.0.0.2"},
+		},
+		{
+			name:    "two culprits",
+			senders: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			corrupt: []int{0, 3},
+			want:    []string{"10.0.0.1", "10.0.0.4"},
+		},
+		{
+			name:    "several corrupt blocks from one peer",
+			senders: []string{"10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.2"},
+			corrupt: []int{1, 3},
+			want:    []string{"10.0.0.2"},
+		},
+		{
+			name:    "no corrupt block",
+			senders: []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPicker(1, len(tt.senders))
+			peers := make(map[string]*peerConn)
+
+			peer := func(ip string) *peerConn {
+				if peers[ip] == nil {
+					peers[ip] = testPeer(t, ip)
+				}
+
+				return peers[ip]
+			}
+
+			corrupt := make(map[int]bool)
+
+			for _, i := range tt.corrupt {
+				corrupt[i] = true
+			}
+
+			// 第一次下载
+			for i, ip := range tt.senders {
+				pc := peer(ip)
+				rs, _ := p.pick(pc, all(1), allowAll, nil, 1)
+
+				if len(rs) != 1 || rs[0].begin != i*MaxBacklogSize {
+					t.Fatalf("pick() = %v, want block %d", rs, i)
+				}
+
+				data := blockData(rs[0])
+
+				if corrupt[i] {
+					data[0] ^= 0xff
+				}
+
+				p.received(pc, rs[0], data)
+			}
+
+			sources := p.failed(0)
+			sort.Strings(sources)
+
+			// 所有来源都被记录
+			want := dedupe(tt.senders)
+
+			if !reflect.DeepEqual(sources, want) {
+				t.Fatalf("failed() = %v, want %v", sources, want)
+			}
+
+			// 重新从一个诚实的peer下载
+			honest := peer("10.0.0.9")
+			rs, _ := p.pick(honest, all(1), allowAll, nil, len(tt.senders))
+
+			var buf []byte
+
+			for _, r := range rs {
+				_, buf, _, _ = p.received(honest, r, blockData(r))
+			}
+
+			got := p.culprits(0, buf)
+			sort.Strings(got)
+
+			if len(got) == 0 {
+				got = nil
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("culprits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func dedupe(ips []string) []string {
+	seen := make(map[string]bool)
+
+	var res []string
+
+	for _, ip := range ips {
+		if !seen[ip] {
+			seen[ip] = true
+			res = append(res, ip)
+		}
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+func TestSubnetEscalation(t *testing.T) {
+	tests := []struct {
+		name       string
+		ips        []string
+		wantSubnet string // 为空表示不封禁网段
+	}{
+		{name: "one offender", ips: []string{"8.8.8.1"}},
+		{name: "two offenders", ips: []string{"8.8.8.1", "8.8.8.2"}},
+		{name: "three offenders", ips: []string{"8.8.8.1", "8.8.8.2", "8.8.8.3"}, wantSubnet: "8.8.8.0/24"},
+		{name: "different subnets", ips: []string{"8.8.8.1", "8.8.9.2", "8.8.10.3"}},
+		{name: "private network", ips: []string{"192.168.1.2", "192.168.1.3", "192.168.1.4"}},
+		{name: "loopback", ips: []string{"127.0.0.2", "127.0.0.3", "127.0.0.4"}},
+		{name: "ipv6", ips: []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}, wantSubnet: "2001:db8::/64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newBanList()
+
+			for _, ip := range tt.ips {
+				if !l.ban(net.ParseIP(ip), "test") {
+					t.Fatalf("ban(%s) = false", ip)
+				}
+			}
+
+			if l.ban(net.ParseIP(tt.ips[0]), "test") {
+				t.Error("ban() of a banned ip returned true")
+			}
+
+			var subnets []string
+
+			for s := range l.subnets {
+				subnets = append(subnets, s)
+			}
+
+			var want []string
+
+			if tt.wantSubnet != "" {
+				want = []string{tt.wantSubnet}
+			}
+
+			if !reflect.DeepEqual(subnets, want) {
+				t.Errorf("banned subnets = %v, want %v", subnets, want)
+			}
+		})
+	}
+}
+
+func TestHashFailures(t *testing.T) {
+	l := newBanList()
+	ip := net.ParseIP("8.8.4.4")
+
+	for i := 1; i < maxHashFailures; i++ {
+		if l.hashFailed(ip) {
+			t.Fatalf("banned after %d failures", i)
+		}
+	}
+
+	if !l.hashFailed(ip) {
+		t.Fatalf("not banned after %d failures", maxHashFailures)
+	}
+
+	if _, ok := l.ips[ip.String()]; !ok {
+		t.Error("ip is not in the ban list")
+	}
+}
@@ -5,17 +5,23 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"log"
+	"net"
 	"runtime"
+	"sync"
 	"time"
 
 	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/bitfield"
 	"cpipi1024.com/turtleDownloader/utils/message"
 	"cpipi1024.com/turtleDownloader/utils/peers"
 )
 
 const (
-	MaxBacklogSize = 16384
-	MaXBacklog     = 5
+	MaxBacklogSize = 16384 // 每个请求的block大小
+	MaXBacklog     = 5     // 每个peer初始的未完成请求数
+	MaxPeers       = 500   // 每个torrent最多保存的候选peer数
+
+	repickInterval = 2 * time.Second // 没有可请求的block时重新选择的间隔
 )
 
 // torrent 保存远端peers和本地peer端信息
@@ -27,6 +33,36 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Existing    map[int][]byte   // 已有的piece数据, 校验通过后不再下载
+	Skip        map[int]bool     // 不需要下载的piece, 下载完成后作为partial seed只上传已有的piece
+	Registry    *client.Registry // 扩展协议注册表, 为nil时不发送扩展握手
+	Seed        bool             // 下载完成后继续上传, 直到调用Stop
+	UploadSlots int              // 同时上传的peer数, 为0时使用DefaultUploadSlots
+	MaxConns    int              // 最多保持的连接数, 为0时使用DefaultMaxConnsPerTorrent
+	SuperSeed   bool             // 开始时已经拥有所有piece并且做种时使用super-seeding
+
+	mu        sync.Mutex
+	config    *client.Config
+	buf       []byte            // 文件数据
+	have      bitfield.BitField // 本地已经校验通过的piece
+	conns     map[*client.Client]*peerConn
+	choker    choker
+	chokeWake chan struct{}
+	picker    *picker
+	super     *superSeeder // 为nil时不使用super-seeding
+	results   chan *pieceResult
+	finished  bool
+	stopped   bool
+
+	candidates map[string]*candidate // 可以连接的peer
+	dialing    int                   // 正在建立的连接数
+	starting   int                   // 已经建立但worker还没有加入conns的连接数
+	lastDrop   time.Time
+	connWake   chan struct{}
+
+	downloaded int64
+	uploaded   int64
+	wasted     int64
 }
 
 type pieceWork struct {
@@ -40,129 +76,268 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
-}
-
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
+// 处理reader goroutine收到的消息
+func (pc *peerConn) handleMessage(msg *message.Message) error {
+	c := pc.c
 
-	if err != nil {
+	if err := c.Handle(msg); err != nil {
 		return err
 	}
 
-	if msg == nil {
-		return nil
+	if handled, err := pc.handle(msg); handled {
+		return err
 	}
 
 	switch msg.ID {
+	case message.MsgExtended:
+		pc.updatePeerState()
+		pc.updateInterest()
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		c.Choked = false
+		pc.touch()
 	case message.MsgChoke:
-		state.client.Choked = true
+		c.Choked = true
+		// 不支持Fast Extension的peer阻塞时丢弃所有请求
+		if !c.Fast {
+			pc.releaseRequests()
+		}
 	case message.MsgHave:
 		index, err := message.ParseMsgHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.BitField.SetPiece(index)
+		if !c.BitField.HasPiece(index) {
+			c.BitField.SetPiece(index)
+			pc.t.picker.addHave(index)
+			pc.t.superSeedHave(pc, index)
+			pc.updatePeerState()
+			pc.updateInterest()
+		}
 	case message.MsgPiece:
-		n, err := message.ParseMsgPiece(state.index, state.buf, msg)
+		return pc.receiveBlock(msg)
+	case message.MsgReject:
+		idx, begin, length, err := message.ParseMsgRequest(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		r := request{idx, begin, length}
+		if pc.removeRequest(r) {
+			pc.t.picker.release(pc, r)
+		}
 	}
 	return nil
 }
 
-func attempDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// 收到block, 交给picker; piece完整后校验并提交结果
+func (pc *peerConn) receiveBlock(msg *message.Message) error {
+	t := pc.t
+
+	idx, begin, err := message.ParseMsgPieceHeader(msg)
+
+	if err != nil {
+		return err
 	}
 
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+	data := msg.PayLoad[8:]
+	r := request{idx, begin, len(data)}
 
-	// 开始下载
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaXBacklog && state.requested < pw.index {
-				blockSize := MaxBacklogSize
+	// 取消或拒绝之后才到达的block
+	if !pc.completeRequest(r) {
+		t.addWasted(len(data))
+		return nil
+	}
 
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
+	pc.addDownloaded(len(data))
+	pc.gotData()
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
+	pw, buf, others, ok := t.picker.received(pc, r, data)
 
-				if err != nil {
-					return nil, err
-				}
+	if !ok {
+		t.addWasted(len(data))
+		return nil
+	}
 
-				state.backlog++
-				state.requested += blockSize
-			}
-		}
-		err := state.readMessage()
+	// endgame中取消其他peer的相同请求
+	for _, other := range others {
+		other.cancelRequest(r)
+	}
 
-		if err != nil {
-			return nil, err
+	if pw == nil {
+		return nil
+	}
+
+	if err := checkIntegrity(pw, buf); err != nil {
+		log.Printf("piece #%d failed check integrity check \n", pw.index)
+		t.addWasted(len(buf))
+		t.pieceFailed(pw.index)
+		return nil
+	}
+
+	t.pieceVerified(pw.index, buf)
+	t.picker.done(pw.index)
+	t.results <- &pieceResult{pw.index, buf}
+
+	return nil
+}
+
+// 向对端发送新的请求, 未完成的请求数由pipeline根据带宽时延积决定
+//
+// 被阻塞时仍然可以请求allowed fast集合中的piece, ok为false表示所有piece都已经完成
+func (pc *peerConn) requestBlocks() (ok bool, err error) {
+	n := pc.queueDepth() - pc.outstanding()
+
+	if n <= 0 {
+		return true, nil
+	}
+
+	rs, ok := pc.t.picker.pick(pc, pc.c.BitField, pc.c.CanRequest, pc.c.Suggested, n)
+
+	// 从空闲开始请求时重新计算等待数据的时间
+	if len(rs) > 0 && pc.outstanding() == 0 {
+		pc.touch()
+	}
+
+	for _, r := range rs {
+		pc.addRequest(r)
+
+		if err := pc.c.SendRequest(r.begin, r.index, r.length); err != nil {
+			return ok, err
 		}
 	}
 
-	return state.buf, nil
+	return ok, nil
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 
-	if bytes.Equal(hash[:], pw.hash[:]) {
+	if !bytes.Equal(hash[:], pw.hash[:]) {
 		return fmt.Errorf("index %d failed intergrity check ", pw.index)
 	}
 
 	return nil
 }
 
+// 与peer建立连接时使用的参数, 主动连接和被动接受的连接共用
+func (t *Torrent) Config() *client.Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.config == nil {
+		t.config = &client.Config{
+			PeerID:    t.PeerID,
+			InfoHash:  t.InfoHash,
+			NumPieces: len(t.PieceHashes),
+			Registry:  t.Registry,
+			Have:      t.advertised,
+		}
+	}
+
+	return t.config
+}
+
+// 本地已有piece的bitfield副本
+func (t *Torrent) BitField() bitfield.BitField {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bf := make(bitfield.BitField, (len(t.PieceHashes)+7)/8)
+	copy(bf, t.have)
+
+	return bf
+}
+
+func (t *Torrent) setHave(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.have == nil {
+		t.have = make(bitfield.BitField, (len(t.PieceHashes)+7)/8)
+	}
+
+	t.have.SetPiece(index)
+}
+
 func (t *Torrent) Download() ([]byte, error) {
 	log.Println("start download for ", t.Name)
 
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	picker := newPicker(len(t.PieceHashes))
 
 	results := make(chan *pieceResult)
 
+	t.Config()
+
+	buf := make([]byte, t.Length)
+
+	doncePieces := 0
+	wanted := len(t.PieceHashes)
+
 	for idx, hash := range t.PieceHashes {
 		length := t.calculatePieceSize(idx)
-		workQueue <- &pieceWork{idx, hash, length}
+		pw := &pieceWork{idx, hash, length}
+
+		// 复用已有的piece
+		if data, ok := t.Existing[idx]; ok && checkIntegrity(pw, data) == nil {
+			begin, end := t.calculateBoundsForPiece(idx)
+			copy(buf[begin:end], data)
+			t.setHave(idx)
+			picker.done(idx)
+			doncePieces++
+			continue
+		}
+
+		if t.Skip[idx] {
+			wanted--
+			continue
+		}
+
+		picker.add(pw)
 	}
 
-	// 启动woker
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	if doncePieces > 0 {
+		log.Printf("reused %d pieces for %s\n", doncePieces, t.Name)
 	}
 
-	buf := make([]byte, t.Length)
+	// 在picker公开之前决定, 否则AddConn此时接受的连接会收到完整的bitfield
+	var super *superSeeder
 
-	doncePieces := 0
+	if t.SuperSeed && t.Seed && doncePieces == len(t.PieceHashes) {
+		log.Printf("super-seeding %s\n", t.Name)
 
-	for doncePieces <= len(t.PieceHashes) {
+		super = newSuperSeeder()
+	}
+
+	t.mu.Lock()
+	t.connWake = make(chan struct{}, 1)
+	t.addCandidates(t.Peers)
+	t.conns = make(map[*client.Client]*peerConn)
+	t.chokeWake = make(chan struct{}, 1)
+	t.buf = buf
+	t.super = super
+	t.picker = picker
+	t.results = results
+	t.mu.Unlock()
+
+	go t.runChoker()
+
+	go t.logProgress()
+
+	// 连接peers并启动worker
+	go t.manageConns()
+
+	for doncePieces < wanted {
 		res := <-results
 
 		begin, end := t.calculateBoundsForPiece(res.index)
 
 		copy(buf[begin:end], res.buf)
 
+		t.setHave(res.index)
+		t.broadcastHave(res.index)
+
 		doncePieces++
 
-		percents := float64(doncePieces) / float64(len(t.PieceHashes)) * 100
+		percents := float64(doncePieces) / float64(wanted) * 100
 
 		numWorkers := runtime.NumGoroutine()
 
@@ -170,52 +345,189 @@ func (t *Torrent) Download() ([]byte, error) {
 
 	}
 
-	close(workQueue)
+	t.mu.Lock()
+	t.finished = true
+	picker.close()
+	t.mu.Unlock()
+
+	// 跳过了部分piece时作为partial seed继续上传
+	if t.UploadOnly() {
+		log.Printf("%s is now a partial seed with %d/%d pieces\n", t.Name, doncePieces, len(t.PieceHashes))
+
+		t.broadcastExtHandshake()
+	}
+
+	log.Printf("finished %s: %s\n", t.Name, t.Stats())
 
 	return buf, nil
 
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.NewClient(peer, t.PeerID, t.InfoHash)
+// 停止做种, 关闭所有连接
+func (t *Torrent) Stop() {
+	t.mu.Lock()
 
-	if err != nil {
-		log.Println("could not handshake with:", peer.IP)
+	t.stopped = true
+
+	conns := make([]*client.Client, 0, len(t.conns))
+
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// 是否还需要新的连接, 调用时需要持有锁
+func (t *Torrent) acceptingPeers() bool {
+	if t.stopped {
+		return false
+	}
+
+	return !t.finished || t.Seed
+}
+
+// 向下载添加候选peers, 由连接管理按照连接数限制建立连接
+//
+// 开始下载之前添加的peers会在下载开始时连接, 做种时继续连接新的peers
+func (t *Torrent) AddPeers(ps []peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.acceptingPeers() {
 		return
 	}
 
-	defer c.Conn.Close()
+	t.addCandidates(ps)
+
+	if t.connWake != nil {
+		t.wakeConnect()
+	}
+}
+
+// 对端发起的连接, 与主动建立的连接使用相同的worker
+//
+// 超过连接数限制或者对端被封禁时直接关闭
+func (t *Torrent) AddConn(c *client.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	log.Printf("completed handshake with %s\n", peer.IP)
+	if !t.acceptingPeers() || t.picker == nil || IsBanned(c.Peer().IP) || t.numConns() >= t.maxConns() || !limiter.tryAccept() {
+		go c.Close()
+		return
+	}
 
-	c.SendUnchoke()
-	c.SendInterested()
+	// 在worker加入conns之前占用名额, 同时接受的连接不会超过限制
+	t.starting++
 
-	for pw := range workQueue {
-		if !c.BitField.HasPiece(pw.index) {
-			workQueue <- pw
-			continue
-		}
+	go t.runWorker(c)
+}
 
-		buf, err := attempDownloadPiece(c, pw)
+// 从已经建立的连接下载block, 直到所有piece完成或连接出错
+//
+// 消息由client的reader goroutine读取, 下载期间同时响应对端的请求, 做种时下载完成后继续上传
+func (t *Torrent) runWorker(c *client.Client) {
+	defer limiter.release()
+	defer c.Close()
+
+	c.Start()
+
+	pc := t.newPeerConn(c)
+	defer pc.close()
+
+	t.picker.addBitField(c.BitField)
+	defer func() { t.picker.removeBitField(c.BitField) }()
+
+	// 断开时已经请求的block交给其他peer
+	defer t.picker.releaseAll(pc)
+
+	// 是否上传由choker决定, 是否下载取决于对端是否有需要的piece
+	pc.updatePeerState()
+	pc.updateInterest()
+
+	ticker := time.NewTicker(repickInterval)
+	defer ticker.Stop()
+
+	for {
+		ok, err := pc.requestBlocks()
 
 		if err != nil {
-			log.Panicln("Exiting:", err)
-			workQueue <- pw
+			log.Println("Exiting:", err)
 			return
 		}
 
-		err = checkIntegrity(pw, buf)
+		// 下载完成, 取消endgame中剩余的请求
+		if !ok {
+			pc.cancelRequests()
+			break
+		}
 
-		if err != nil {
-			log.Printf("piece #%d failed check integrity check \n", pw.index)
-			workQueue <- pw
+		// snubbed的peer的请求交给其他peer
+		if d := client.Timeouts.Snub; d > 0 && !c.Choked && pc.checkSnubbed(d) {
+			log.Printf("peer %s is snubbing us\n", c.Peer())
+			pc.cancelRequests()
 			continue
 		}
-		c.SendHave(pw.index)
 
-		results <- &pieceResult{pw.index, buf}
+		// 对端没有阻塞我们, 但是一直没有返回请求的数据
+		if d := client.Timeouts.Request; d > 0 && !c.Choked && pc.stalled(d) {
+			log.Printf("Exiting: no data from %s for %v\n", c.Peer(), d)
+			return
+		}
+
+		// 没有可以请求的block时定期重新选择
+		select {
+		case msg, open := <-c.Messages():
+			if !open {
+				log.Println("Exiting:", c.Err())
+				return
+			}
+
+			if err := pc.handleMessage(msg); err != nil {
+				log.Println("Exiting:", err)
+				return
+			}
+		case <-ticker.C:
+			// 其他peer完成了需要的piece之后可能不再感兴趣
+			pc.updateInterest()
+		}
+	}
+
+	if t.Seed {
+		t.serve(c, pc)
+	}
+}
+
+// 下载完成后只处理对端的消息, 直到连接出错或停止做种
+//
+// 对端只上传时双方都不需要对方的数据, 断开连接
+func (t *Torrent) serve(c *client.Client, pc *peerConn) {
+	pc.updateInterest()
+
+	t.superSeedStart(pc)
+
+	// 沉默的peer由client的Idle超时断开
+	for !pc.isUploadOnly() {
+		msg, open := <-c.Messages()
+
+		if !open {
+			return
+		}
+
+		if err := pc.handleMessage(msg); err != nil {
+			return
+		}
 	}
+
+	log.Printf("disconnecting upload only peer %s\n", c.Peer())
+}
+
+func isLocal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
 }
 
 // 返回下载的piece大小
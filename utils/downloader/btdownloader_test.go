@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+// 与testPeer相同, 但是对端收到的消息通过返回的channel读取
+func recordingPeer(t *testing.T, torrent *Torrent, ip string) (*peerConn, <-chan *message.Message) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	msgs := make(chan *message.Message, 16)
+
+	go func() {
+		if _, err := handshake.ReadHandShake(remote); err != nil {
+			return
+		}
+
+		go func() {
+			for {
+				msg, err := message.ReadMessage(remote)
+
+				if err != nil {
+					return
+				}
+
+				if msg != nil {
+					msgs <- msg
+				}
+			}
+		}()
+
+		remote.Write((&message.Message{ID: message.MsgBitfield, PayLoad: []byte{0}}).Serialize())
+	}()
+
+	conn := &pipeConn{Conn: local, raddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 6881}}
+
+	c, err := client.Accept(conn, &handshake.HandShake{Pstr: "BitTorrent protocol"}, &client.Config{NumPieces: 8})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &peerConn{t: torrent, c: c}, msgs
+}
+
+// endgame中先到达的block被接受, 其他peer的相同请求被取消, 之后到达的重复block计为浪费
+func TestEndgameCancel(t *testing.T) {
+	torrent := &Torrent{
+		PieceHashes: make([][20]byte, 1),
+		PieceLength: 2 * MaxBacklogSize,
+		Length:      2 * MaxBacklogSize,
+		conns:       make(map[*client.Client]*peerConn),
+		picker:      newTestPicker(1, 2),
+	}
+
+	a, _ := recordingPeer(t, torrent, "10.0.0.1")
+	b, msgs := recordingPeer(t, torrent, "10.0.0.2")
+
+	ra, _ := torrent.picker.pick(a, all(1), allowAll, nil, 2)
+	rb, _ := torrent.picker.pick(b, all(1), allowAll, nil, 2)
+
+	if len(ra) != 2 || len(rb) != 2 {
+		t.Fatalf("requests = %v and %v, want both blocks twice", ra, rb)
+	}
+
+	for i := range ra {
+		a.addRequest(ra[i])
+		b.addRequest(rb[i])
+	}
+
+	r := ra[0]
+
+	if err := a.receiveBlock(message.FormatPiece(r.index, r.begin, blockData(r))); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := b.outstanding(); n != 1 {
+		t.Errorf("peer b has %d outstanding requests, want 1", n)
+	}
+
+	var msg *message.Message
+
+	for msg == nil {
+		select {
+		case m := <-msgs:
+			if m.ID == message.MsgCancel {
+				msg = m
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer b did not receive a cancel")
+		}
+	}
+
+	if idx, begin, length, err := message.ParseMsgRequest(msg); err != nil || (request{idx, begin, length}) != r {
+		t.Errorf("cancel = %v, want %v", request{idx, begin, length}, r)
+	}
+
+	// 取消之前已经发出的block
+	if err := b.receiveBlock(message.FormatPiece(r.index, r.begin, blockData(r))); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent.mu.Lock()
+	wasted := torrent.wasted
+	torrent.mu.Unlock()
+
+	if wasted != int64(r.length) {
+		t.Errorf("wasted = %d, want %d", wasted, r.length)
+	}
+}
@@ -0,0 +1,197 @@
+package downloader
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultUploadSlots = 4 // 默认同时上传的peer数, 包含一个optimistic unchoke名额
+
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+)
+
+// tit-for-tat choker
+//
+// 每10秒按照传输速率选出上传名额, 下载时按对端给我们的下载速率, 做种时按我们的上传速率;
+// 每30秒轮换一个optimistic unchoke名额, 让新的peer有机会证明自己;
+// 下载时snubbed的peer不参与按速率的排名, 只能通过轮换的optimistic unchoke恢复
+type choker struct {
+	lastRound      time.Time
+	lastOptimistic time.Time
+	optimistic     *peerConn
+
+	// 上一轮的传输量, 用于计算速率
+	lastUploaded   map[*peerConn]int
+	lastDownloaded map[*peerConn]int
+}
+
+// 单个peer在一轮中的速率
+type peerRate struct {
+	pc   *peerConn
+	rate float64
+}
+
+func (t *Torrent) uploadSlots() int {
+	if t.UploadSlots > 0 {
+		return t.UploadSlots
+	}
+
+	return DefaultUploadSlots
+}
+
+// 定期重新分配上传名额, 直到下载结束或停止做种
+func (t *Torrent) runChoker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.chokeWake:
+		}
+
+		t.mu.Lock()
+		done := t.stopped || (t.finished && !t.Seed)
+		t.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		t.chokeRound(time.Now())
+	}
+}
+
+// 请求choker尽快运行一轮
+func (t *Torrent) rechoke() {
+	select {
+	case t.chokeWake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Torrent) chokeRound(now time.Time) {
+	t.mu.Lock()
+
+	ch := &t.choker
+	seeding := t.finished
+
+	conns := make([]*peerConn, 0, len(t.conns))
+
+	for _, pc := range t.conns {
+		conns = append(conns, pc)
+	}
+
+	t.mu.Unlock()
+
+	if ch.lastUploaded == nil {
+		ch.lastUploaded = make(map[*peerConn]int)
+		ch.lastDownloaded = make(map[*peerConn]int)
+	}
+
+	elapsed := now.Sub(ch.lastRound).Seconds()
+
+	if ch.lastRound.IsZero() || elapsed <= 0 {
+		elapsed = chokeInterval.Seconds()
+	}
+
+	ch.lastRound = now
+
+	var interested, snubbed []peerRate
+
+	uploaded := make(map[*peerConn]int, len(conns))
+	downloaded := make(map[*peerConn]int, len(conns))
+
+	for _, pc := range conns {
+		pc.mu.Lock()
+		uploaded[pc] = pc.uploaded
+		downloaded[pc] = pc.downloaded
+		isInterested := pc.interested
+		isSnubbed := pc.pipe.snubbed
+		pc.mu.Unlock()
+
+		var rate float64
+
+		if seeding {
+			rate = float64(uploaded[pc]-ch.lastUploaded[pc]) / elapsed
+		} else {
+			rate = float64(downloaded[pc]-ch.lastDownloaded[pc]) / elapsed
+		}
+
+		switch {
+		case !isInterested:
+		case isSnubbed && !seeding:
+			snubbed = append(snubbed, peerRate{pc, rate})
+		default:
+			interested = append(interested, peerRate{pc, rate})
+		}
+	}
+
+	ch.lastUploaded = uploaded
+	ch.lastDownloaded = downloaded
+
+	sort.SliceStable(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+
+	// 保留一个名额给optimistic unchoke
+	regular := t.uploadSlots() - 1
+
+	if regular < 0 {
+		regular = 0
+	}
+
+	unchoke := make(map[*peerConn]bool)
+
+	for i := 0; i < len(interested) && i < regular; i++ {
+		unchoke[interested[i].pc] = true
+	}
+
+	// 当前的optimistic peer已经断开或不再感兴趣时立即轮换
+	optimisticValid := false
+
+	interested = append(interested, snubbed...)
+
+	for _, p := range interested {
+		if p.pc == ch.optimistic && !unchoke[p.pc] {
+			optimisticValid = true
+		}
+	}
+
+	if !optimisticValid || now.Sub(ch.lastOptimistic) >= optimisticInterval {
+		var candidates []*peerConn
+
+		// snubbed的peer与新peer一起轮换, 有其他候选时不再选择当前的optimistic peer
+		for _, p := range interested {
+			if !unchoke[p.pc] && p.pc != ch.optimistic {
+				candidates = append(candidates, p.pc)
+			}
+		}
+
+		if len(candidates) == 0 && optimisticValid {
+			candidates = append(candidates, ch.optimistic)
+		}
+
+		ch.optimistic = nil
+
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[rand.Intn(len(candidates))]
+			ch.lastOptimistic = now
+		}
+	}
+
+	if ch.optimistic != nil && t.uploadSlots() > 0 {
+		unchoke[ch.optimistic] = true
+	}
+
+	for _, pc := range conns {
+		if unchoke[pc] {
+			pc.unchoke()
+		} else {
+			pc.choke()
+		}
+	}
+}
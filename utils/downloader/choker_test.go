@@ -0,0 +1,267 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+)
+
+// 测试用的choker peer
+type chokerPeer struct {
+	ip         string
+	downloaded int // 一轮中从对端下载的字节数
+	snubbed    bool
+	bored      bool // 对端不感兴趣
+}
+
+func newChokerTorrent(t *testing.T, slots int, specs []chokerPeer) (*Torrent, []*peerConn) {
+	torrent := &Torrent{UploadSlots: slots, conns: make(map[*client.Client]*peerConn)}
+
+	var pcs []*peerConn
+
+	for _, spec := range specs {
+		pc := testPeer(t, spec.ip)
+		pc.t = torrent
+		pc.choking = true
+		pc.interested = !spec.bored
+		pc.downloaded = spec.downloaded
+		pc.pipe.snubbed = spec.snubbed
+
+		torrent.conns[pc.c] = pc
+		pcs = append(pcs, pc)
+	}
+
+	return torrent, pcs
+}
+
+// 未被阻塞的peer
+func unchoked(pcs []*peerConn) map[*peerConn]bool {
+	res := make(map[*peerConn]bool)
+
+	for _, pc := range pcs {
+		pc.mu.Lock()
+
+		if !pc.choking {
+			res[pc] = true
+		}
+
+		pc.mu.Unlock()
+	}
+
+	return res
+}
+
+func TestChokeRound(t *testing.T) {
+	tests := []struct {
+		name    string
+		slots   int
+		peers   []chokerPeer
+		regular []int // 一定获得上传名额的peer
+		choked  []int // 一定被阻塞的peer
+	}{
+		{
+			name:    "fastest peers",
+			slots:   3,
+			peers:   []chokerPeer{{ip: "10.0.0.1", downloaded: 100}, {ip: "10.0.0.2", downloaded: 300}, {ip: "10.0.0.3", downloaded: 200}},
+			regular: []int{1, 2},
+		},
+		{
+			name:    "snubbed peers are not reciprocated",
+			slots:   2,
+			peers:   []chokerPeer{{ip: "10.0.0.1", downloaded: 900, snubbed: true}, {ip: "10.0.0.2", downloaded: 100}, {ip: "10.0.0.3"}},
+			regular: []int{1},
+		},
+		{
+			name:  "only the optimistic slot",
+			slots: 1,
+			peers: []chokerPeer{{ip: "10.0.0.1", downloaded: 100}, {ip: "10.0.0.2", downloaded: 200}},
+		},
+		{
+			name:   "not interested",
+			slots:  2,
+			peers:  []chokerPeer{{ip: "10.0.0.1", downloaded: 100, bored: true}},
+			choked: []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent, pcs := newChokerTorrent(t, tt.slots, tt.peers)
+
+			torrent.chokeRound(time.Now())
+
+			got := unchoked(pcs)
+
+			for _, i := range tt.regular {
+				if !got[pcs[i]] {
+					t.Errorf("peer %s is choked", tt.peers[i].ip)
+				}
+			}
+
+			for _, i := range tt.choked {
+				if got[pcs[i]] {
+					t.Errorf("peer %s is unchoked", tt.peers[i].ip)
+				}
+			}
+
+			// 再加上一个optimistic unchoke名额
+			want := len(tt.regular) + 1
+
+			if len(tt.choked) == len(tt.peers) {
+				want = 0
+			}
+
+			if len(got) != want {
+				t.Errorf("%d peers unchoked, want %d", len(got), want)
+			}
+		})
+	}
+}
+
+// snubbed的peer不会一直占用optimistic unchoke名额, 新的peer也能轮到
+func TestOptimisticRotation(t *testing.T) {
+	torrent, pcs := newChokerTorrent(t, 2, []chokerPeer{
+		{ip: "10.0.0.1", downloaded: 1000},
+		{ip: "10.0.0.2", snubbed: true},
+		{ip: "10.0.0.3"},
+		{ip: "10.0.0.4"},
+	})
+
+	now := time.Now()
+	seen := make(map[*peerConn]int)
+
+	var last *peerConn
+
+	for round := 0; round < 30; round++ {
+		// 第一个peer一直最快, 占用常规名额
+		pcs[0].downloaded += 1000
+
+		torrent.chokeRound(now)
+
+		optimistic := torrent.choker.optimistic
+
+		if optimistic == nil || optimistic == pcs[0] {
+			t.Fatalf("round %d: optimistic peer = %v", round, optimistic)
+		}
+
+		if optimistic == last {
+			t.Fatalf("round %d: optimistic peer %s was not rotated", round, optimistic.c.Peer())
+		}
+
+		// 间隔之内保持不变
+		pcs[0].downloaded += 1000
+
+		torrent.chokeRound(now.Add(chokeInterval))
+
+		if torrent.choker.optimistic != optimistic {
+			t.Fatalf("round %d: optimistic peer changed within %v", round, optimisticInterval)
+		}
+
+		seen[optimistic]++
+		last = optimistic
+		now = now.Add(optimisticInterval)
+	}
+
+	for _, pc := range pcs[1:] {
+		if seen[pc] == 0 {
+			t.Errorf("peer %s never got the optimistic slot: %v", pc.c.Peer(), seen)
+		}
+	}
+}
+
+// 唯一的候选peer保留optimistic名额
+func TestOptimisticSingleCandidate(t *testing.T) {
+	torrent, pcs := newChokerTorrent(t, 2, []chokerPeer{
+		{ip: "10.0.0.1", downloaded: 1000},
+		{ip: "10.0.0.2", snubbed: true},
+	})
+
+	now := time.Now()
+
+	for round := 0; round < 3; round++ {
+		pcs[0].downloaded += 1000
+
+		torrent.chokeRound(now)
+
+		if torrent.choker.optimistic != pcs[1] {
+			t.Fatalf("round %d: optimistic peer = %v, want the snubbed peer", round, torrent.choker.optimistic)
+		}
+
+		now = now.Add(optimisticInterval)
+	}
+}
+
+// 通过常规名额(而不是optimistic unchoke)上传的peer
+func regularSlots(torrent *Torrent, pcs []*peerConn) map[*peerConn]bool {
+	res := unchoked(pcs)
+	delete(res, torrent.choker.optimistic)
+
+	return res
+}
+
+// 按每一轮的传输量排名, 之前传输多但当前没有传输的peer会失去名额
+func TestChokeRoundRates(t *testing.T) {
+	torrent, pcs := newChokerTorrent(t, 2, []chokerPeer{
+		{ip: "10.0.0.1", downloaded: 10000},
+		{ip: "10.0.0.2"},
+		{ip: "10.0.0.3"},
+	})
+
+	now := time.Now()
+
+	torrent.chokeRound(now)
+
+	if got := regularSlots(torrent, pcs); !got[pcs[0]] || len(got) != 1 {
+		t.Fatalf("first round: %d regular slots, peer 10.0.0.1 unchoked: %v", len(got), got[pcs[0]])
+	}
+
+	pcs[1].downloaded += 5000
+
+	torrent.chokeRound(now.Add(chokeInterval))
+
+	if got := regularSlots(torrent, pcs); !got[pcs[1]] || len(got) != 1 {
+		t.Errorf("second round: %d regular slots, peer 10.0.0.2 unchoked: %v", len(got), got[pcs[1]])
+	}
+}
+
+// 做种时按上传速率排名, snubbed不影响上传
+func TestChokeRoundSeeding(t *testing.T) {
+	torrent, pcs := newChokerTorrent(t, 2, []chokerPeer{
+		{ip: "10.0.0.1", downloaded: 10000},
+		{ip: "10.0.0.2", snubbed: true},
+		{ip: "10.0.0.3"},
+	})
+
+	torrent.finished = true
+	pcs[1].uploaded = 5000
+
+	torrent.chokeRound(time.Now())
+
+	if got := regularSlots(torrent, pcs); !got[pcs[1]] || len(got) != 1 {
+		t.Errorf("%d regular slots, fastest uploader unchoked: %v", len(got), got[pcs[1]])
+	}
+}
+
+// 被阻塞的peer的未发送请求作废, 除了allowed fast集合中的piece
+func TestChokeDropsQueue(t *testing.T) {
+	torrent, pcs := newChokerTorrent(t, 2, []chokerPeer{{ip: "10.0.0.1", bored: true}})
+
+	pc := pcs[0]
+	pc.choking = false
+	pc.queue = []request{{0, 0, 16}, {1, 0, 16}, {2, 0, 16}}
+	pc.c.GrantedFast = map[int]bool{1: true}
+
+	torrent.chokeRound(time.Now())
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if !pc.choking {
+		t.Fatal("peer that is not interested is unchoked")
+	}
+
+	if len(pc.queue) != 1 || pc.queue[0].index != 1 {
+		t.Errorf("queue after choke = %v, want only the allowed fast piece", pc.queue)
+	}
+}
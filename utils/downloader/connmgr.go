@@ -0,0 +1,317 @@
+package downloader
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+const DefaultMaxConnsPerTorrent = 50 // 每个torrent默认的连接数
+
+// 所有torrent共用的连接限制, 需要在开始下载之前设置
+var (
+	MaxConnections = 200 // 所有torrent的连接总数, 包括正在建立的连接
+	MaxHalfOpen    = 20  // 同时正在建立的连接数
+)
+
+const (
+	connectInterval = time.Second      // 检查连接数的周期
+	minRetryDelay   = 30 * time.Second // 重新连接的最短等待时间
+	maxRetryDelay   = 30 * time.Minute
+	maxFailures     = 8 // 连续失败超过该次数的peer不再连接
+
+	minConnAge   = time.Minute      // 连接时间太短的peer不参与淘汰
+	dropInterval = 30 * time.Second // 两次淘汰之间的最短间隔
+)
+
+// 所有torrent的连接计数
+type connLimiter struct {
+	mu       sync.Mutex
+	conns    int
+	halfOpen int
+}
+
+var limiter connLimiter
+
+// 是否可以发起新的连接, 返回true时需要调用dialDone
+func (l *connLimiter) tryDial() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.halfOpen >= MaxHalfOpen || l.conns+l.halfOpen >= MaxConnections {
+		return false
+	}
+
+	l.halfOpen++
+
+	return true
+}
+
+// 连接建立完成, connected为true时计入连接数
+func (l *connLimiter) dialDone(connected bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.halfOpen--
+
+	if connected {
+		l.conns++
+	}
+}
+
+// 是否可以接受对端发起的连接
+func (l *connLimiter) tryAccept() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns+l.halfOpen >= MaxConnections {
+		return false
+	}
+
+	l.conns++
+
+	return true
+}
+
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+}
+
+// 候选peer, 来自tracker, DHT, LSD以及PEX
+type candidate struct {
+	peer      peers.Peer
+	added     int // 加入的顺序
+	failures  int // 连续失败的次数
+	next      time.Time
+	dialing   bool
+	connected bool
+	tried     bool
+}
+
+func (cand *candidate) ready(now time.Time) bool {
+	return !cand.dialing && !cand.connected && cand.failures < maxFailures && !now.Before(cand.next)
+}
+
+// 连续失败后的等待时间, 每次失败翻倍
+func retryDelay(failures int) time.Duration {
+	d := minRetryDelay
+
+	for i := 1; i < failures && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+
+	return d
+}
+
+// 已经建立以及正在建立的连接数, 调用时需要持有锁
+func (t *Torrent) numConns() int {
+	return len(t.conns) + t.dialing + t.starting
+}
+
+func (t *Torrent) maxConns() int {
+	if t.MaxConns > 0 {
+		return t.MaxConns
+	}
+
+	return DefaultMaxConnsPerTorrent
+}
+
+// 加入候选peer, 调用时需要持有锁
+func (t *Torrent) addCandidates(ps []peers.Peer) {
+	if t.candidates == nil {
+		t.candidates = make(map[string]*candidate)
+	}
+
+	for _, peer := range ps {
+		key := peer.String()
+
+		if _, ok := t.candidates[key]; ok || len(t.candidates) >= MaxPeers {
+			continue
+		}
+
+		t.candidates[key] = &candidate{peer: peer, added: len(t.candidates)}
+	}
+}
+
+// 唤醒连接管理
+func (t *Torrent) wakeConnect() {
+	select {
+	case t.connWake <- struct{}{}:
+	default:
+	}
+}
+
+// 保持连接数, 直到下载结束或停止做种
+func (t *Torrent) manageConns() {
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		t.mu.Lock()
+		done := !t.acceptingPeers()
+		t.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		t.connectPeers(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-t.connWake:
+		}
+	}
+}
+
+// 按优先级排列可以连接的候选peer: 局域网内的peer, 没有连接过的peer, 失败次数少的peer
+func (t *Torrent) readyCandidates(now time.Time) []*candidate {
+	var ready []*candidate
+
+	for _, cand := range t.candidates {
+		if cand.ready(now) && !IsBanned(cand.peer.IP) {
+			ready = append(ready, cand)
+		}
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		a, b := ready[i], ready[j]
+
+		if isLocal(a.peer.IP) != isLocal(b.peer.IP) {
+			return isLocal(a.peer.IP)
+		}
+
+		if a.tried != b.tried {
+			return !a.tried
+		}
+
+		if a.failures != b.failures {
+			return a.failures < b.failures
+		}
+
+		return a.added < b.added
+	})
+
+	return ready
+}
+
+func (t *Torrent) connectPeers(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ready := t.readyCandidates(now)
+
+	for len(ready) > 0 && t.numConns() < t.maxConns() {
+		if !limiter.tryDial() {
+			return
+		}
+
+		cand := ready[0]
+		ready = ready[1:]
+
+		cand.dialing = true
+		cand.tried = true
+		t.dialing++
+
+		go t.connect(cand)
+	}
+
+	// 连接数已满时, 用没有连接过的peer替换最差的peer
+	if len(ready) > 0 && !ready[0].tried && len(t.conns) >= t.maxConns() && now.Sub(t.lastDrop) >= dropInterval {
+		if pc := t.worstConn(now); pc != nil {
+			t.lastDrop = now
+
+			log.Printf("dropping slow peer %s for new candidates\n", pc.c.Peer())
+
+			go pc.c.Close()
+		}
+	}
+}
+
+// 连接时间足够长的peer中传输速率最低的一个, 调用时需要持有锁
+func (t *Torrent) worstConn(now time.Time) *peerConn {
+	var worst *peerConn
+
+	worstRate := 0.0
+
+	for _, pc := range t.conns {
+		age := now.Sub(pc.since)
+
+		if age < minConnAge {
+			continue
+		}
+
+		pc.mu.Lock()
+		bytes := pc.downloaded
+
+		if t.finished {
+			bytes = pc.uploaded
+		}
+		pc.mu.Unlock()
+
+		rate := float64(bytes) / age.Seconds()
+
+		if worst == nil || rate < worstRate {
+			worst = pc
+			worstRate = rate
+		}
+	}
+
+	return worst
+}
+
+// 连接候选peer, 成功后运行worker, 断开后安排重新连接
+func (t *Torrent) connect(cand *candidate) {
+	c, err := client.NewClient(cand.peer, t.Config())
+
+	limiter.dialDone(err == nil)
+
+	t.mu.Lock()
+	t.dialing--
+	cand.dialing = false
+
+	if err != nil {
+		cand.failures++
+		cand.next = time.Now().Add(retryDelay(cand.failures))
+		t.mu.Unlock()
+
+		log.Println("could not handshake with:", cand.peer.IP)
+		return
+	}
+
+	// 名额交给worker, 加入conns时释放
+	cand.connected = true
+	t.starting++
+	t.mu.Unlock()
+
+	log.Printf("completed handshake with %s\n", cand.peer.IP)
+
+	start := time.Now()
+
+	t.runWorker(c)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cand.connected = false
+
+	// 很快断开的连接也按失败处理
+	if time.Since(start) < minConnAge {
+		cand.failures++
+	} else {
+		cand.failures = 0
+	}
+
+	cand.next = time.Now().Add(retryDelay(cand.failures))
+}
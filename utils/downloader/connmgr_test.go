@@ -0,0 +1,291 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, minRetryDelay},
+		{1, minRetryDelay},
+		{2, 2 * minRetryDelay},
+		{3, 4 * minRetryDelay},
+		{6, 32 * minRetryDelay},
+		{7, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.failures); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	defer func(conns, halfOpen int) {
+		MaxConnections, MaxHalfOpen = conns, halfOpen
+	}(MaxConnections, MaxHalfOpen)
+
+	MaxConnections = 4
+	MaxHalfOpen = 2
+
+	var l connLimiter
+
+	if !l.tryDial() || !l.tryDial() {
+		t.Fatal("tryDial() failed below the half-open limit")
+	}
+
+	if l.tryDial() {
+		t.Fatal("tryDial() exceeded the half-open limit")
+	}
+
+	// 建立完成的连接不再占用half-open名额
+	l.dialDone(true)
+
+	if !l.tryDial() {
+		t.Fatal("tryDial() failed after a dial completed")
+	}
+
+	l.dialDone(false)
+	l.dialDone(true)
+
+	// 2个连接, 还可以接受2个
+	if !l.tryAccept() || !l.tryAccept() {
+		t.Fatal("tryAccept() failed below the connection limit")
+	}
+
+	if l.tryAccept() || l.tryDial() {
+		t.Fatal("connection limit exceeded")
+	}
+
+	l.release()
+
+	if !l.tryDial() {
+		t.Error("tryDial() failed after a connection was released")
+	}
+}
+
+func TestReadyCandidates(t *testing.T) {
+	now := time.Now()
+
+	cands := []*candidate{
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.1"), Port: 1}, added: 0, tried: true, failures: 1},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.2"), Port: 1}, added: 1, tried: true},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.3"), Port: 1}, added: 2},
+		{peer: peers.Peer{IP: net.ParseIP("192.168.1.2"), Port: 1}, added: 3, tried: true, failures: 2},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.4"), Port: 1}, added: 4},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.5"), Port: 1}, added: 5, dialing: true},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.6"), Port: 1}, added: 6, connected: true},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.7"), Port: 1}, added: 7, next: now.Add(time.Minute)},
+		{peer: peers.Peer{IP: net.ParseIP("8.8.8.8"), Port: 1}, added: 8, failures: maxFailures},
+	}
+
+	torrent := &Torrent{candidates: make(map[string]*candidate)}
+
+	for _, cand := range cands {
+		torrent.candidates[cand.peer.String()] = cand
+	}
+
+	// 局域网peer, 没有连接过的peer, 失败次数少的peer, 先加入的peer
+	want := []string{"192.168.1.2", "8.8.8.3", "8.8.8.4", "8.8.8.2", "8.8.8.1"}
+
+	ready := torrent.readyCandidates(now)
+
+	var got []string
+
+	for _, cand := range ready {
+		got = append(got, cand.peer.IP.String())
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("readyCandidates() = %v, want %v", got, want)
+	}
+}
+
+// 在release之前不响应握手的peer, 之后立即关闭所有连接
+func silentListener(t *testing.T) (*net.TCPListener, func()) {
+	t.Helper()
+
+	// 监听所有地址, 127.0.0.x都会连接到这里
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+
+	released := false
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+
+			if released {
+				conn.Close()
+			} else {
+				conns = append(conns, conn)
+			}
+
+			mu.Unlock()
+		}
+	}()
+
+	release := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		released = true
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		conns = nil
+	}
+
+	t.Cleanup(func() {
+		ln.Close()
+		release()
+	})
+
+	return ln, release
+}
+
+// 连接数受限于MaxConns, 失败的peer等待后重新连接
+func TestConnectPeers(t *testing.T) {
+	ln, release := silentListener(t)
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	torrent := &Torrent{MaxConns: 2, conns: make(map[*client.Client]*peerConn)}
+
+	var ps []peers.Peer
+
+	for i := 1; i <= 5; i++ {
+		ps = append(ps, peers.Peer{IP: net.IPv4(127, 0, 0, byte(i)), Port: uint(port)})
+	}
+
+	torrent.addCandidates(ps)
+
+	now := time.Now()
+
+	// 第二轮时连接数已满
+	for round := 0; round < 2; round++ {
+		torrent.connectPeers(now)
+
+		torrent.mu.Lock()
+		dialing := torrent.dialing
+		torrent.mu.Unlock()
+
+		if dialing != 2 {
+			t.Fatalf("round %d: dialing %d peers, want 2", round, dialing)
+		}
+	}
+
+	release()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		torrent.mu.Lock()
+		dialing := torrent.dialing
+		torrent.mu.Unlock()
+
+		if dialing == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("handshakes did not fail")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	failed := 0
+
+	for _, cand := range torrent.candidates {
+		if !cand.tried {
+			continue
+		}
+
+		failed++
+
+		if cand.failures != 1 || cand.next.Before(now.Add(minRetryDelay)) {
+			t.Errorf("candidate %s: failures = %d, next in %v", cand.peer, cand.failures, cand.next.Sub(now))
+		}
+	}
+
+	if failed != 2 {
+		t.Errorf("%d candidates tried, want 2", failed)
+	}
+
+	// 失败的peer在等待时间内不再连接
+	if ready := torrent.readyCandidates(now.Add(time.Second)); len(ready) != 3 {
+		t.Errorf("%d candidates ready, want 3", len(ready))
+	}
+}
+
+// 同时接受的连接不会超过MaxConns
+func TestAddConnLimit(t *testing.T) {
+	torrent := &Torrent{
+		MaxConns:    2,
+		PieceHashes: make([][20]byte, 8),
+		conns:       make(map[*client.Client]*peerConn),
+		chokeWake:   make(chan struct{}, 1),
+		picker:      newTestPicker(8, 1),
+	}
+
+	var pcs []*peerConn
+
+	for i := 1; i <= 16; i++ {
+		pcs = append(pcs, testPeer(t, fmt.Sprintf("10.0.0.%d", i)))
+	}
+
+	var wg sync.WaitGroup
+
+	start := make(chan struct{})
+
+	for _, pc := range pcs {
+		wg.Add(1)
+
+		go func(c *client.Client) {
+			defer wg.Done()
+
+			<-start
+			torrent.AddConn(c)
+		}(pc.c)
+	}
+
+	close(start)
+	wg.Wait()
+
+	torrent.mu.Lock()
+	n := torrent.numConns()
+	torrent.mu.Unlock()
+
+	if n != 2 {
+		t.Errorf("%d connections accepted, want 2", n)
+	}
+}
@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"log"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/bitfield"
+)
+
+// 下载完成但是缺少跳过的piece, 即只上传的partial seed (BEP 21)
+func (t *Torrent) UploadOnly() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.finished {
+		return false
+	}
+
+	for i := range t.PieceHashes {
+		if !t.have.HasPiece(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 成为partial seed后重新发送扩展握手, 告知对端upload_only
+func (t *Torrent) broadcastExtHandshake() {
+	t.mu.Lock()
+
+	conns := make([]*client.Client, 0, len(t.conns))
+
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		c.SendExtHandshake()
+	}
+}
+
+// 对端是否拥有还需要下载的piece
+func (p *picker) interesting(bf bitfield.BitField) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	for idx := range p.pending {
+		if bf.HasPiece(idx) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 只对拥有需要的piece的peer感兴趣, 不向只上传的peer请求它没有的piece
+func (pc *peerConn) updateInterest() {
+	interested := pc.t.picker.interesting(pc.c.BitField)
+
+	if interested == pc.amInterested {
+		return
+	}
+
+	pc.amInterested = interested
+
+	if interested {
+		pc.c.SendInterested()
+	} else {
+		pc.c.SendNotInterested()
+	}
+}
+
+// 对端的bitfield或扩展握手变化后更新seed以及upload_only状态
+func (pc *peerConn) updatePeerState() {
+	seed := true
+
+	for i := range pc.t.PieceHashes {
+		if !pc.c.BitField.HasPiece(i) {
+			seed = false
+			break
+		}
+	}
+
+	uploadOnly := pc.c.UploadOnly()
+
+	pc.mu.Lock()
+	changed := uploadOnly && !pc.uploadOnly
+	pc.seed = seed
+	pc.uploadOnly = uploadOnly
+	pc.mu.Unlock()
+
+	if changed && !seed {
+		log.Printf("peer %s is a partial seed\n", pc.c.Peer())
+	}
+}
+
+// c对应的peer是否做种或只上传, 可以在任意goroutine中调用
+func (t *Torrent) PeerSeed(c *client.Client) bool {
+	t.mu.Lock()
+	pc := t.conns[c]
+	t.mu.Unlock()
+
+	if pc == nil {
+		return false
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.seed || pc.uploadOnly
+}
+
+// 对端是否只上传, 本地也不再下载时连接没有用处
+func (pc *peerConn) isUploadOnly() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.uploadOnly
+}
@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/message"
+	"github.com/jackpal/bencode-go"
+)
+
+// 跳过部分piece的下载完成后成为partial seed, 扩展握手中发送upload_only
+func TestPartialSeed(t *testing.T) {
+	data := []byte("piece 0 piece 1 ")
+	pieceLength := 8
+
+	torrent := &Torrent{
+		InfoHash:    [20]byte{1},
+		PieceHashes: [][20]byte{sha1.Sum(data[:pieceLength]), sha1.Sum(data[pieceLength:])},
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "partial",
+		Existing:    map[int][]byte{0: data[:pieceLength]},
+		Skip:        map[int]bool{1: true},
+		Seed:        true,
+		Registry:    client.NewRegistry(),
+	}
+
+	torrent.Registry.UploadOnly = torrent.UploadOnly
+
+	if torrent.UploadOnly() {
+		t.Fatal("UploadOnly() before the download finished")
+	}
+
+	buf, err := torrent.Download()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer torrent.Stop()
+
+	if !bytes.Equal(buf[:pieceLength], data[:pieceLength]) {
+		t.Errorf("piece 0 = %q, want %q", buf[:pieceLength], data[:pieceLength])
+	}
+
+	if !torrent.UploadOnly() {
+		t.Fatal("UploadOnly() = false after skipping piece 1")
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	got := make(chan *client.ExtHandshake, 1)
+
+	go func() {
+		defer close(got)
+
+		if _, err := handshake.ReadHandShake(remote); err != nil {
+			return
+		}
+
+		go remote.Write((&message.Message{ID: message.MsgHaveNone}).Serialize())
+
+		for {
+			msg, err := message.ReadMessage(remote)
+
+			if err != nil {
+				return
+			}
+
+			if msg == nil || msg.ID != message.MsgExtended {
+				continue
+			}
+
+			id, payload, err := message.ParseMsgExtended(msg)
+
+			if err != nil || id != 0 {
+				continue
+			}
+
+			hs := &client.ExtHandshake{}
+
+			if bencode.Unmarshal(bytes.NewReader(payload), hs) == nil {
+				got <- hs
+			}
+
+			io.Copy(io.Discard, remote)
+
+			return
+		}
+	}()
+
+	conn := &pipeConn{Conn: local, raddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}}
+
+	c, err := client.Accept(conn, handshake.New([20]byte{1}, [20]byte{2}), torrent.Config())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	select {
+	case hs := <-got:
+		if hs == nil || hs.UploadOnly != 1 {
+			t.Errorf("extended handshake = %+v, want upload_only", hs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no extended handshake")
+	}
+}
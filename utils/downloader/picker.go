@@ -0,0 +1,469 @@
+package downloader
+
+import (
+	"crypto/sha1"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"cpipi1024.com/turtleDownloader/utils/bitfield"
+)
+
+// 完成的piece少于该数量时随机选择, 尽快获得可以交换的piece
+const randomFirstPieces = 4
+
+// piece选择器
+//
+// 根据所有peer的bitfield和MsgHave统计每个piece的可用数, 优先下载最稀有的piece,
+// 可用数相同时随机选择. 请求以block为单位分配, 一个piece可以同时从多个peer下载,
+// peer断开后已经收到的block会保留, 缺少的block交给其他peer
+//
+// 所有剩余的block都已经请求后进入endgame, 空闲的peer重复请求其他peer正在下载的block
+type picker struct {
+	mu        sync.Mutex
+	avail     []int               // 每个piece被多少个peer拥有
+	pending   map[int]*pieceState // 还没有完成的piece
+	completed int
+	endgame   bool
+	closed    bool
+}
+
+// 正在下载的piece, 第一次分配block时创建缓冲区
+type pieceState struct {
+	pw       *pieceWork
+	buf      []byte
+	blocks   []blockState
+	received int // 已经收到的block数
+
+	suspects []blockRecord // 校验失败时每个block的来源, 用于找出提供错误数据的peer
+}
+
+type blockState struct {
+	received bool
+	owners   map[*peerConn]bool // 已经向这些peer请求了该block
+	from     string             // 提供数据的peer ip
+}
+
+// 校验失败的piece中的一个block
+type blockRecord struct {
+	index int // block在piece中的序号
+	from  string
+	hash  [20]byte
+}
+
+func newPicker(numPieces int) *picker {
+	return &picker{
+		avail:   make([]int, numPieces),
+		pending: make(map[int]*pieceState),
+	}
+}
+
+// 添加需要下载的piece
+func (p *picker) add(pw *pieceWork) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending[pw.index] = &pieceState{pw: pw}
+}
+
+// 新连接的peer, 统计它拥有的piece
+func (p *picker) addBitField(bf bitfield.BitField) {
+	p.updateBitField(bf, 1)
+}
+
+// 断开的peer, 去掉它拥有的piece
+func (p *picker) removeBitField(bf bitfield.BitField) {
+	p.updateBitField(bf, -1)
+}
+
+func (p *picker) updateBitField(bf bitfield.BitField, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.avail {
+		if bf.HasPiece(i) {
+			p.avail[i] += delta
+
+			if p.avail[i] < 0 {
+				p.avail[i] = 0
+			}
+		}
+	}
+}
+
+// peer通过MsgHave通知新的piece
+func (p *picker) addHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.avail) {
+		p.avail[index]++
+	}
+}
+
+func (ps *pieceState) start() {
+	if ps.buf != nil {
+		return
+	}
+
+	ps.buf = make([]byte, ps.pw.length)
+	ps.blocks = make([]blockState, (ps.pw.length+MaxBacklogSize-1)/MaxBacklogSize)
+}
+
+func (ps *pieceState) request(i int) request {
+	begin := i * MaxBacklogSize
+	length := MaxBacklogSize
+
+	if begin+length > ps.pw.length {
+		length = ps.pw.length - begin
+	}
+
+	return request{ps.pw.index, begin, length}
+}
+
+// 还没有请求过的block数
+func (ps *pieceState) unrequested() int {
+	if ps.buf == nil {
+		return (ps.pw.length + MaxBacklogSize - 1) / MaxBacklogSize
+	}
+
+	n := 0
+
+	for _, b := range ps.blocks {
+		if !b.received && len(b.owners) == 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// 将piece中的block分配给pc, endgame为true时包含其他peer已经请求的block
+func (ps *pieceState) take(pc *peerConn, n int, endgame bool) []request {
+	ps.start()
+
+	var rs []request
+
+	for i := range ps.blocks {
+		if len(rs) >= n {
+			break
+		}
+
+		b := &ps.blocks[i]
+
+		if b.received || b.owners[pc] || (!endgame && len(b.owners) > 0) {
+			continue
+		}
+
+		if b.owners == nil {
+			b.owners = make(map[*peerConn]bool)
+		}
+
+		b.owners[pc] = true
+		rs = append(rs, ps.request(i))
+	}
+
+	return rs
+}
+
+// 为pc分配最多n个block, allowed判断是否可以请求该piece
+//
+// 已经开始的piece之后优先选择对端建议的piece (suggested中越靠后越新),
+// 对端通常已经把这些piece读入了缓存. ok为false表示所有piece都已经完成
+func (p *picker) pick(pc *peerConn, bf bitfield.BitField, allowed func(int) bool, suggested []int, n int) (rs []request, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, false
+	}
+
+	usable := func(idx int) bool {
+		return bf.HasPiece(idx) && allowed(idx)
+	}
+
+	// 优先完成已经开始的piece
+	for _, ps := range p.started() {
+		if len(rs) >= n {
+			return rs, true
+		}
+
+		if usable(ps.pw.index) {
+			rs = append(rs, ps.take(pc, n-len(rs), false)...)
+		}
+	}
+
+	for i := len(suggested) - 1; i >= 0 && len(rs) < n; i-- {
+		ps, ok := p.pending[suggested[i]]
+
+		if ok && ps.buf == nil && usable(ps.pw.index) {
+			rs = append(rs, ps.take(pc, n-len(rs), false)...)
+		}
+	}
+
+	for len(rs) < n {
+		ps := p.next(usable)
+
+		if ps == nil {
+			break
+		}
+
+		rs = append(rs, ps.take(pc, n-len(rs), false)...)
+	}
+
+	if len(rs) == 0 && p.allRequested() {
+		rs = p.endgameBlocks(pc, usable, n)
+	}
+
+	return rs, true
+}
+
+// 已经开始下载的piece, 已经收到的block越多越靠前
+func (p *picker) started() []*pieceState {
+	var ps []*pieceState
+
+	for _, s := range p.pending {
+		if s.buf != nil {
+			ps = append(ps, s)
+		}
+	}
+
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].received != ps[j].received {
+			return ps[i].received > ps[j].received
+		}
+
+		return ps[i].pw.index < ps[j].pw.index
+	})
+
+	return ps
+}
+
+// 选择一个新的piece, 开始阶段随机选择, 之后选择最稀有的piece
+func (p *picker) next(usable func(int) bool) *pieceState {
+	var candidates []*pieceState
+
+	rarest := -1
+
+	for idx, ps := range p.pending {
+		if ps.buf != nil || !usable(idx) {
+			continue
+		}
+
+		if p.completed < randomFirstPieces {
+			candidates = append(candidates, ps)
+			continue
+		}
+
+		switch {
+		case rarest == -1 || p.avail[idx] < rarest:
+			rarest = p.avail[idx]
+			candidates = append(candidates[:0], ps)
+		case p.avail[idx] == rarest:
+			candidates = append(candidates, ps)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// 所有剩余的block是否都已经请求
+func (p *picker) allRequested() bool {
+	for _, ps := range p.pending {
+		if ps.unrequested() > 0 {
+			return false
+		}
+	}
+
+	return len(p.pending) > 0
+}
+
+// endgame中重复请求其他peer正在下载的block
+func (p *picker) endgameBlocks(pc *peerConn, usable func(int) bool, n int) []request {
+	var rs []request
+
+	for _, ps := range p.started() {
+		if len(rs) >= n {
+			break
+		}
+
+		if usable(ps.pw.index) {
+			rs = append(rs, ps.take(pc, n-len(rs), true)...)
+		}
+	}
+
+	if len(rs) > 0 && !p.endgame {
+		p.endgame = true
+		log.Printf("entering endgame with %d pieces left\n", len(p.pending))
+	}
+
+	return rs
+}
+
+// pc不再下载该block, 下载失败的block会重新交给其他peer
+func (p *picker) release(pc *peerConn, r request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if b := p.block(r); b != nil {
+		delete(b.owners, pc)
+	}
+}
+
+// pc断开时释放它请求的所有block, 已经收到的数据保留
+func (p *picker) releaseAll(pc *peerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ps := range p.pending {
+		for i := range ps.blocks {
+			delete(ps.blocks[i].owners, pc)
+		}
+	}
+}
+
+func (p *picker) block(r request) *blockState {
+	ps, ok := p.pending[r.index]
+
+	if !ok || ps.buf == nil || r.begin%MaxBacklogSize != 0 {
+		return nil
+	}
+
+	i := r.begin / MaxBacklogSize
+
+	if i >= len(ps.blocks) || ps.request(i) != r {
+		return nil
+	}
+
+	return &ps.blocks[i]
+}
+
+// 收到pc请求的block
+//
+// ok为false表示数据已经由其他peer提供; others为同样请求了该block的peer, 需要取消请求;
+// piece的所有block都收到后返回pw和完整的数据, 校验后调用done或reset
+func (p *picker) received(pc *peerConn, r request, data []byte) (pw *pieceWork, buf []byte, others []*peerConn, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b := p.block(r)
+
+	if b == nil || b.received {
+		return nil, nil, nil, false
+	}
+
+	for other := range b.owners {
+		if other != pc {
+			others = append(others, other)
+		}
+	}
+
+	b.received = true
+	b.owners = nil
+	b.from = pc.c.Peer().IP.String()
+
+	ps := p.pending[r.index]
+	copy(ps.buf[r.begin:], data)
+	ps.received++
+
+	if ps.received < len(ps.blocks) {
+		return nil, nil, others, true
+	}
+
+	return ps.pw, ps.buf, others, true
+}
+
+// piece校验完成
+func (p *picker) done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, index)
+	p.completed++
+}
+
+// piece校验失败, 记录每个block的来源和hash后丢弃数据重新下载
+//
+// 返回提供了数据的peer ip
+func (p *picker) failed(index int) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ps, ok := p.pending[index]
+
+	if !ok || ps.buf == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+
+	var sources []string
+
+	for i, b := range ps.blocks {
+		r := ps.request(i)
+
+		ps.suspects = append(ps.suspects, blockRecord{
+			index: i,
+			from:  b.from,
+			hash:  sha1.Sum(ps.buf[r.begin : r.begin+r.length]),
+		})
+
+		if !seen[b.from] {
+			seen[b.from] = true
+			sources = append(sources, b.from)
+		}
+	}
+
+	ps.buf = nil
+	ps.blocks = nil
+	ps.received = 0
+
+	return sources
+}
+
+// piece校验通过后, 找出之前提供了不同数据的peer
+func (p *picker) culprits(index int, buf []byte) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ps, ok := p.pending[index]
+
+	if !ok || len(ps.suspects) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+
+	var ips []string
+
+	for _, rec := range ps.suspects {
+		r := ps.request(rec.index)
+
+		if sha1.Sum(buf[r.begin:r.begin+r.length]) != rec.hash && !seen[rec.from] {
+			seen[rec.from] = true
+			ips = append(ips, rec.from)
+		}
+	}
+
+	return ips
+}
+
+func (p *picker) inEndgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.endgame
+}
+
+// 所有piece都已经完成, 等待中的worker随后退出
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+}
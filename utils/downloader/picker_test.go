@@ -0,0 +1,326 @@
+package downloader
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/bitfield"
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+// 远端地址为ip的net.Pipe
+type pipeConn struct {
+	net.Conn
+	raddr *net.TCPAddr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// 通过net.Pipe建立的client, 对端ip为ip
+func testPeer(t *testing.T, ip string) *peerConn {
+	t.Helper()
+
+	local, remote := net.Pipe()
+
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	// 对端读取握手后发送空的bitfield, 之后丢弃收到的消息
+	go func() {
+		buf := make([]byte, len(handshake.New([20]byte{}, [20]byte{}).Serialize()))
+
+		if _, err := io.ReadFull(remote, buf); err != nil {
+			return
+		}
+
+		remote.Write((&message.Message{ID: message.MsgBitfield, PayLoad: []byte{0}}).Serialize())
+
+		io.Copy(io.Discard, remote)
+	}()
+
+	conn := &pipeConn{Conn: local, raddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 6881}}
+
+	c, err := client.Accept(conn, &handshake.HandShake{Pstr: "BitTorrent protocol"}, &client.Config{NumPieces: 8})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &peerConn{c: c}
+}
+
+// 拥有给定piece的bitfield
+func have(numPieces int, pieces ...int) bitfield.BitField {
+	bf := make(bitfield.BitField, (numPieces+7)/8)
+
+	for _, i := range pieces {
+		bf.SetPiece(i)
+	}
+
+	return bf
+}
+
+func all(numPieces int) bitfield.BitField {
+	bf := have(numPieces)
+
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+
+	return bf
+}
+
+func allowAll(int) bool { return true }
+
+// 每个piece包含blocks个block
+func newTestPicker(numPieces, blocks int) *picker {
+	p := newPicker(numPieces)
+
+	for i := 0; i < numPieces; i++ {
+		p.add(&pieceWork{index: i, length: blocks * MaxBacklogSize})
+	}
+
+	return p
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	tests := []struct {
+		name      string
+		avail     []bitfield.BitField // 其他peer的bitfield
+		bf        bitfield.BitField   // 请求方拥有的piece
+		allowed   func(int) bool
+		suggested []int
+		want      int // 选择的piece, -1表示没有可以请求的piece
+	}{
+		{
+			name:  "rarest",
+			avail: []bitfield.BitField{all(4), have(4, 0, 2, 3), have(4, 0, 3)},
+			bf:    all(4),
+			want:  1,
+		},
+		{
+			name:  "rarest that the peer has",
+			avail: []bitfield.BitField{all(4), have(4, 0, 2, 3), have(4, 0, 3)},
+			bf:    have(4, 0, 2),
+			want:  2,
+		},
+		{
+			name:    "rarest that is allowed",
+			avail:   []bitfield.BitField{all(4), have(4, 0, 2, 3), have(4, 0, 3)},
+			bf:      all(4),
+			allowed: func(i int) bool { return i != 1 },
+			want:    2,
+		},
+		{
+			name:      "suggested before rarest",
+			avail:     []bitfield.BitField{all(4), have(4, 0, 2, 3)},
+			bf:        all(4),
+			suggested: []int{0, 3},
+			want:      3,
+		},
+		{
+			name:      "suggested piece the peer lacks",
+			avail:     []bitfield.BitField{all(4), have(4, 0, 2, 3)},
+			bf:        have(4, 1, 2),
+			suggested: []int{3},
+			want:      1,
+		},
+		{
+			name: "peer has nothing",
+			bf:   have(4),
+			want: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPicker(4, 1)
+
+			// 跳过开始阶段的随机选择
+			p.completed = randomFirstPieces
+
+			for _, bf := range tt.avail {
+				p.addBitField(bf)
+			}
+
+			if tt.allowed == nil {
+				tt.allowed = allowAll
+			}
+
+			rs, ok := p.pick(testPeer(t, "10.0.0.1"), tt.bf, tt.allowed, tt.suggested, 1)
+
+			if !ok {
+				t.Fatal("pick() reported all pieces complete")
+			}
+
+			got := -1
+
+			if len(rs) > 0 {
+				got = rs[0].index
+			}
+
+			if got != tt.want {
+				t.Errorf("picked piece %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// 开始阶段在对端拥有的piece中随机选择
+func TestPickRandomFirst(t *testing.T) {
+	seen := make(map[int]bool)
+
+	for i := 0; i < 200; i++ {
+		p := newTestPicker(8, 1)
+		p.addBitField(have(8, 0))
+
+		rs, _ := p.pick(testPeer(t, "10.0.0.1"), have(8, 0, 1, 2, 3), allowAll, nil, 1)
+
+		if len(rs) != 1 || rs[0].index > 3 {
+			t.Fatalf("pick() = %v, want one of pieces 0-3", rs)
+		}
+
+		seen[rs[0].index] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("random first picked only %v", seen)
+	}
+}
+
+func TestPickAfterClose(t *testing.T) {
+	p := newTestPicker(2, 1)
+	p.close()
+
+	if rs, ok := p.pick(testPeer(t, "10.0.0.1"), all(2), allowAll, nil, 4); ok || len(rs) > 0 {
+		t.Errorf("pick() after close = %v, %v", rs, ok)
+	}
+}
+
+func blockData(r request) []byte {
+	data := make([]byte, r.length)
+
+	for i := range data {
+		data[i] = byte(r.index + r.begin/MaxBacklogSize)
+	}
+
+	return data
+}
+
+// 多个peer下载同一个piece的不同block
+func TestPickBlocks(t *testing.T) {
+	p := newTestPicker(1, 4)
+	a := testPeer(t, "10.0.0.1")
+	b := testPeer(t, "10.0.0.2")
+
+	ra, _ := p.pick(a, all(1), allowAll, nil, 2)
+	rb, _ := p.pick(b, all(1), allowAll, nil, 4)
+
+	if len(ra) != 2 || ra[0].begin != 0 || ra[1].begin != MaxBacklogSize {
+		t.Fatalf("peer a got %v, want blocks 0 and 1", ra)
+	}
+
+	if len(rb) != 2 || rb[0].begin != 2*MaxBacklogSize || rb[1].begin != 3*MaxBacklogSize {
+		t.Fatalf("peer b got %v, want blocks 2 and 3", rb)
+	}
+
+	if p.inEndgame() {
+		t.Fatal("endgame started before a peer became idle")
+	}
+
+	var pw *pieceWork
+	var buf []byte
+
+	for i, r := range append(ra, rb...) {
+		pc := a
+
+		if i >= 2 {
+			pc = b
+		}
+
+		var ok bool
+
+		pw, buf, _, ok = p.received(pc, r, blockData(r))
+
+		if !ok {
+			t.Fatalf("received(%v) was rejected", r)
+		}
+
+		if (pw != nil) != (i == 3) {
+			t.Fatalf("piece completed after %d blocks", i+1)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if buf[i*MaxBacklogSize] != byte(i) {
+			t.Errorf("block %d is not in place", i)
+		}
+	}
+}
+
+// 断开的peer已经下载的block保留, 其余block交给其他peer
+func TestReleaseKeepsReceivedBlocks(t *testing.T) {
+	p := newTestPicker(1, 3)
+	a := testPeer(t, "10.0.0.1")
+	b := testPeer(t, "10.0.0.2")
+
+	ra, _ := p.pick(a, all(1), allowAll, nil, 3)
+
+	if _, _, _, ok := p.received(a, ra[0], blockData(ra[0])); !ok {
+		t.Fatal("first block was rejected")
+	}
+
+	p.releaseAll(a)
+
+	rb, _ := p.pick(b, all(1), allowAll, nil, 3)
+
+	if len(rb) != 2 || rb[0] != ra[1] || rb[1] != ra[2] {
+		t.Fatalf("peer b got %v, want %v", rb, ra[1:])
+	}
+
+	// 已经收到的block不再接受
+	if _, _, _, ok := p.received(b, ra[0], blockData(ra[0])); ok {
+		t.Error("duplicate block was accepted")
+	}
+}
+
+// 所有block都已经请求后, 空闲的peer重复请求其他peer的block
+func TestEndgame(t *testing.T) {
+	p := newTestPicker(1, 2)
+	a := testPeer(t, "10.0.0.1")
+	b := testPeer(t, "10.0.0.2")
+
+	ra, _ := p.pick(a, all(1), allowAll, nil, 2)
+	rb, _ := p.pick(b, all(1), allowAll, nil, 2)
+
+	if !p.inEndgame() {
+		t.Fatal("endgame did not start")
+	}
+
+	if len(rb) != 2 || rb[0] != ra[0] || rb[1] != ra[1] {
+		t.Fatalf("endgame requests = %v, want %v", rb, ra)
+	}
+
+	// 同一个peer不会重复请求同一个block
+	if again, _ := p.pick(b, all(1), allowAll, nil, 2); len(again) != 0 {
+		t.Fatalf("peer b requested %v twice", again)
+	}
+
+	// 先收到的数据被接受, 需要取消另一个peer的请求
+	_, _, others, ok := p.received(b, rb[0], blockData(rb[0]))
+
+	if !ok || len(others) != 1 || others[0] != a {
+		t.Fatalf("received() = %v, %v, want cancel for peer a", others, ok)
+	}
+
+	if _, _, _, ok := p.received(a, ra[0], blockData(ra[0])); ok {
+		t.Error("late duplicate block was accepted")
+	}
+}
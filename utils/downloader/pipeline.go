@@ -0,0 +1,235 @@
+package downloader
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	defaultPeerReqq = 250 // 对端没有在扩展握手中给出reqq时的队列上限, 与libtorrent的默认值相同
+	minQueueDepth   = 2
+
+	rateWindow = time.Second      // 统计下载速率的时间窗口
+	rttWindow  = 30 * time.Second // 最小RTT的统计周期
+)
+
+// 单个peer的请求流水线
+//
+// 根据下载速率和RTT计算带宽时延积, 队列中保持两倍带宽时延积的请求;
+// RTT取一段时间内的最小值, 避免对端排队的请求使队列越来越长
+type pipeline struct {
+	sent map[request]time.Time // 请求的发送时间
+
+	rate        float64 // 平滑后的下载速率, bytes/s
+	windowStart time.Time
+	windowBytes int
+
+	minRTT      time.Duration // 当前统计周期的最小RTT
+	rtt         time.Duration // 上一个统计周期的最小RTT
+	rttStart    time.Time
+	depth       int
+	initialized bool
+
+	lastData time.Time // 最近一次收到数据或开始等待数据的时间
+	snubbed  bool      // 对端没有阻塞我们, 但是长时间没有返回数据
+}
+
+func (p *pipeline) init(now time.Time) {
+	if p.initialized {
+		return
+	}
+
+	p.sent = make(map[request]time.Time)
+	p.windowStart = now
+	p.rttStart = now
+	p.depth = MaXBacklog
+	p.initialized = true
+}
+
+// 收到请求的block, 更新RTT和下载速率
+func (p *pipeline) sample(r request, now time.Time, reqq int) {
+	sent, ok := p.sent[r]
+
+	if ok {
+		delete(p.sent, r)
+
+		if d := now.Sub(sent); p.minRTT == 0 || d < p.minRTT {
+			p.minRTT = d
+		}
+	}
+
+	if now.Sub(p.rttStart) >= rttWindow && p.minRTT > 0 {
+		p.rtt = p.minRTT
+		p.minRTT = 0
+		p.rttStart = now
+	}
+
+	p.windowBytes += r.length
+
+	elapsed := now.Sub(p.windowStart)
+
+	if elapsed < rateWindow {
+		return
+	}
+
+	current := float64(p.windowBytes) / elapsed.Seconds()
+
+	if p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate = 0.7*p.rate + 0.3*current
+	}
+
+	p.windowBytes = 0
+	p.windowStart = now
+
+	p.resize(reqq)
+}
+
+// 当前使用的RTT估计
+func (p *pipeline) latency() time.Duration {
+	switch {
+	case p.rtt == 0:
+		return p.minRTT
+	case p.minRTT == 0 || p.rtt < p.minRTT:
+		return p.rtt
+	default:
+		return p.minRTT
+	}
+}
+
+func (p *pipeline) resize(reqq int) {
+	bdp := p.rate * p.latency().Seconds()
+
+	depth := int(2*bdp)/MaxBacklogSize + minQueueDepth
+
+	if depth > reqq {
+		depth = reqq
+	}
+
+	p.depth = depth
+}
+
+// 对端允许的未完成请求数
+func (pc *peerConn) reqq() int {
+	if ext := pc.c.PeerExtensions(); ext != nil && ext.Reqq > 0 {
+		return ext.Reqq
+	}
+
+	return defaultPeerReqq
+}
+
+// 当前允许的未完成请求数, snubbed的peer只保留一个请求用于探测
+func (pc *peerConn) queueDepth() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.pipe.init(time.Now())
+
+	if pc.pipe.snubbed {
+		return 1
+	}
+
+	return pc.pipe.depth
+}
+
+func (pc *peerConn) addRequest(r request) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	now := time.Now()
+
+	pc.pipe.init(now)
+	pc.pipe.sent[r] = now
+
+	pc.requests = append(pc.requests, r)
+}
+
+// 去掉取消或拒绝的请求, 没有对应的请求时返回false
+func (pc *peerConn) removeRequest(r request) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.pipe.sent, r)
+
+	return pc.dropRequest(r)
+}
+
+// 收到请求的block, 没有对应的请求时返回false
+func (pc *peerConn) completeRequest(r request) bool {
+	reqq := pc.reqq()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if !pc.dropRequest(r) {
+		return false
+	}
+
+	pc.pipe.init(time.Now())
+	pc.pipe.sample(r, time.Now(), reqq)
+
+	return true
+}
+
+// 调用时需要持有pc.mu
+func (pc *peerConn) dropRequest(r request) bool {
+	for i, q := range pc.requests {
+		if q == r {
+			pc.requests = append(pc.requests[:i], pc.requests[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// 开始等待数据
+func (pc *peerConn) touch() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.pipe.lastData = time.Now()
+}
+
+// 收到数据, snubbed的peer恢复正常
+func (pc *peerConn) gotData() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.pipe.lastData = time.Now()
+
+	if pc.pipe.snubbed {
+		pc.pipe.snubbed = false
+		log.Printf("peer %s is no longer snubbing us\n", pc.c.Peer())
+	}
+}
+
+// 超过d没有收到数据时标记为snubbed, 返回true表示刚刚被标记
+func (pc *peerConn) checkSnubbed(d time.Duration) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.pipe.snubbed || len(pc.requests) == 0 || time.Since(pc.pipe.lastData) <= d {
+		return false
+	}
+
+	pc.pipe.snubbed = true
+
+	return true
+}
+
+func (pc *peerConn) isSnubbed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.pipe.snubbed
+}
+
+// 有未完成的请求, 但是超过d没有收到数据
+func (pc *peerConn) stalled(d time.Duration) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return len(pc.requests) > 0 && time.Since(pc.pipe.lastData) > d
+}
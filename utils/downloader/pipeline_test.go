@@ -0,0 +1,148 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineResize(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64 // bytes/s
+		rtt  time.Duration
+		reqq int
+		want int
+	}{
+		{name: "no samples", reqq: defaultPeerReqq, want: minQueueDepth},
+		{name: "1MB/s", rate: 1 << 20, rtt: 100 * time.Millisecond, reqq: defaultPeerReqq, want: 14},
+		{name: "10MB/s", rate: 10 << 20, rtt: 100 * time.Millisecond, reqq: defaultPeerReqq, want: 130},
+		{name: "limited by reqq", rate: 10 << 20, rtt: 100 * time.Millisecond, reqq: 50, want: 50},
+		{name: "long rtt", rate: 1 << 20, rtt: time.Second, reqq: defaultPeerReqq, want: 130},
+	}
+
+	for _, tt := range tests {
+		p := pipeline{rate: tt.rate, rtt: tt.rtt}
+
+		p.resize(tt.reqq)
+
+		if p.depth != tt.want {
+			t.Errorf("%s: depth = %d, want %d", tt.name, p.depth, tt.want)
+		}
+	}
+}
+
+// 每interval收到一个block, rtt为请求到收到数据的时间
+func receiveBlocks(p *pipeline, now time.Time, n int, interval, rtt time.Duration) time.Time {
+	for i := 0; i < n; i++ {
+		now = now.Add(interval)
+
+		r := request{index: i, begin: 0, length: MaxBacklogSize}
+		p.sent[r] = now.Add(-rtt)
+
+		p.sample(r, now, defaultPeerReqq)
+	}
+
+	return now
+}
+
+// 队列深度随下载速率增长和减少
+func TestPipelineSample(t *testing.T) {
+	var p pipeline
+
+	now := time.Now()
+	p.init(now)
+
+	if p.depth != MaXBacklog {
+		t.Fatalf("initial depth = %d, want %d", p.depth, MaXBacklog)
+	}
+
+	// 1.6MB/s, rtt 50ms: 带宽时延积为5个block
+	now = receiveBlocks(&p, now, 100, 10*time.Millisecond, 50*time.Millisecond)
+
+	if want := 2*5 + minQueueDepth; p.depth != want {
+		t.Fatalf("depth = %d after the first window, want %d", p.depth, want)
+	}
+
+	fast := p.depth
+
+	// 速率下降到十分之一
+	receiveBlocks(&p, now, 50, 100*time.Millisecond, 50*time.Millisecond)
+
+	if p.depth >= fast || p.depth < minQueueDepth {
+		t.Errorf("depth = %d after slowing down, want between %d and %d", p.depth, minQueueDepth, fast)
+	}
+}
+
+// RTT取统计周期内的最小值, 排队造成的延迟不会让队列越来越长
+func TestPipelineMinRTT(t *testing.T) {
+	var p pipeline
+
+	now := time.Now()
+	p.init(now)
+
+	now = receiveBlocks(&p, now, 1, 10*time.Millisecond, 20*time.Millisecond)
+	receiveBlocks(&p, now, 99, 10*time.Millisecond, 200*time.Millisecond)
+
+	if got := p.latency(); got != 20*time.Millisecond {
+		t.Errorf("latency() = %v, want %v", got, 20*time.Millisecond)
+	}
+}
+
+// snubbed的peer只保留一个请求
+func TestQueueDepthSnubbed(t *testing.T) {
+	pc := testPeer(t, "10.0.0.1")
+
+	if got := pc.queueDepth(); got != MaXBacklog {
+		t.Errorf("queueDepth() = %d, want %d", got, MaXBacklog)
+	}
+
+	pc.pipe.snubbed = true
+
+	if got := pc.queueDepth(); got != 1 {
+		t.Errorf("queueDepth() of a snubbed peer = %d, want 1", got)
+	}
+}
+
+// 有未完成的请求但长时间没有收到数据时, 先标记为snubbed, 再断开连接
+func TestStalledRequests(t *testing.T) {
+	pc := testPeer(t, "10.0.0.1")
+
+	const snub = 50 * time.Millisecond
+
+	// 没有请求时不会超时
+	pc.touch()
+	time.Sleep(2 * snub)
+
+	if pc.checkSnubbed(snub) || pc.stalled(snub) {
+		t.Fatal("peer without requests timed out")
+	}
+
+	pc.addRequest(request{0, 0, MaxBacklogSize})
+	pc.touch()
+
+	if pc.checkSnubbed(snub) || pc.stalled(snub) {
+		t.Fatal("peer timed out right after a request")
+	}
+
+	time.Sleep(2 * snub)
+
+	if !pc.checkSnubbed(snub) || !pc.isSnubbed() {
+		t.Fatal("peer was not marked as snubbed")
+	}
+
+	// 只在刚刚标记时返回true
+	if pc.checkSnubbed(snub) {
+		t.Error("checkSnubbed() reported the same peer twice")
+	}
+
+	if !pc.stalled(snub) || pc.stalled(time.Minute) {
+		t.Errorf("stalled() = %v, %v, want true only for the short timeout", pc.stalled(snub), pc.stalled(time.Minute))
+	}
+
+	// 收到数据后恢复
+	pc.gotData()
+
+	if pc.isSnubbed() || pc.stalled(snub) {
+		t.Error("peer is still snubbed after sending data")
+	}
+}
@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const progressInterval = 30 * time.Second // 输出统计信息的周期
+
+// 下载的统计信息
+type Stats struct {
+	Pieces     int   // piece总数
+	Completed  int   // 已经完成的piece数
+	Peers      int   // 当前连接的peer数
+	Seeds      int   // 拥有所有piece的peer数, 缺少piece的partial seed不计入
+	Downloaded int64 // 从peers下载的字节数
+	Uploaded   int64 // 上传给peers的字节数
+	Wasted     int64 // 重复下载或校验失败而丢弃的字节数
+	Endgame    bool  // 是否已经进入endgame
+
+	Conns  []PeerStats // 每个连接的统计信息
+	Banned []Ban       // 本次运行中被封禁的peer
+}
+
+// 单个连接的统计信息
+type PeerStats struct {
+	Addr         string
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate float64       // 平滑后的下载速率, bytes/s
+	RTT          time.Duration // 估计的往返时间
+	QueueDepth   int           // 允许的未完成请求数
+	Outstanding  int           // 当前未完成的请求数
+	Snubbed      bool          // 对端没有阻塞我们, 但是长时间没有返回数据
+	Seed         bool          // 对端拥有所有piece
+	UploadOnly   bool          // 对端声明只上传, 没有所有piece时为partial seed
+}
+
+func (s PeerStats) String() string {
+	str := fmt.Sprintf("%s: downloaded %d bytes at %.0f B/s, uploaded %d bytes, rtt %v, queue %d/%d",
+		s.Addr, s.Downloaded, s.DownloadRate, s.Uploaded, s.RTT, s.Outstanding, s.QueueDepth)
+
+	if s.Snubbed {
+		str += ", snubbed"
+	}
+
+	switch {
+	case s.Seed:
+		str += ", seed"
+	case s.UploadOnly:
+		str += ", partial seed"
+	}
+
+	return str
+}
+
+func (s Stats) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d/%d pieces, %d peers (%d seeds), downloaded %d bytes, uploaded %d bytes, wasted %d bytes, endgame %v, banned %v",
+		s.Completed, s.Pieces, s.Peers, s.Seeds, s.Downloaded, s.Uploaded, s.Wasted, s.Endgame, s.Banned)
+
+	// 每个连接一行
+	for _, c := range s.Conns {
+		b.WriteString("\n  ")
+		b.WriteString(c.String())
+	}
+
+	return b.String()
+}
+
+// 定期输出统计信息, 包括每个连接的速率, RTT和请求队列, 直到下载结束或停止做种
+func (t *Torrent) logProgress() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		done := t.stopped || (t.finished && !t.Seed)
+		t.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		log.Printf("%s: %s\n", t.Name, t.Stats())
+	}
+}
+
+// 当前的统计信息
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+
+	s := Stats{
+		Pieces:     len(t.PieceHashes),
+		Peers:      len(t.conns),
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded,
+		Wasted:     t.wasted,
+	}
+
+	for i := range t.PieceHashes {
+		if t.have.HasPiece(i) {
+			s.Completed++
+		}
+	}
+
+	conns := make([]*peerConn, 0, len(t.conns))
+
+	for _, pc := range t.conns {
+		conns = append(conns, pc)
+	}
+
+	p := t.picker
+	t.mu.Unlock()
+
+	for _, pc := range conns {
+		ps := pc.stats()
+
+		if ps.Seed {
+			s.Seeds++
+		}
+
+		s.Conns = append(s.Conns, ps)
+	}
+
+	// 下载速率高的peer在前
+	sort.Slice(s.Conns, func(i, j int) bool {
+		return s.Conns[i].DownloadRate > s.Conns[j].DownloadRate
+	})
+
+	if p != nil {
+		s.Endgame = p.inEndgame()
+	}
+
+	s.Banned = Banned()
+
+	return s
+}
+
+func (t *Torrent) addDownloaded(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.downloaded += int64(n)
+}
+
+func (t *Torrent) addUploaded(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.uploaded += int64(n)
+}
+
+func (t *Torrent) addWasted(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.wasted += int64(n)
+}
+
+func (pc *peerConn) stats() PeerStats {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	depth := pc.pipe.depth
+
+	if !pc.pipe.initialized {
+		depth = MaXBacklog
+	}
+
+	return PeerStats{
+		Addr:         pc.c.Peer().String(),
+		Downloaded:   int64(pc.downloaded),
+		Uploaded:     int64(pc.uploaded),
+		DownloadRate: pc.pipe.rate,
+		RTT:          pc.pipe.latency(),
+		QueueDepth:   depth,
+		Outstanding:  len(pc.requests),
+		Snubbed:      pc.pipe.snubbed,
+		Seed:         pc.seed,
+		UploadOnly:   pc.uploadOnly,
+	}
+}
@@ -0,0 +1,221 @@
+package downloader
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+
+	"cpipi1024.com/turtleDownloader/utils/bitfield"
+)
+
+// super-seeding (BEP 16)
+//
+// 初始做种时假装没有任何piece, 每次只通过MsgHave向一个peer公开一个piece,
+// 看到该piece被其他peer下载之后才向它公开下一个, 减少重复上传同一个piece
+type superSeeder struct {
+	mu    sync.Mutex
+	peers map[*peerConn]*superPeer
+}
+
+type superPeer struct {
+	has      bitfield.BitField // 对端拥有的piece, 由各自的worker更新
+	revealed map[int]bool      // 已经公开的piece, 只接受这些piece的请求
+	current  int               // 正在等待扩散的piece, -1表示没有
+}
+
+func newSuperSeeder() *superSeeder {
+	return &superSeeder{peers: make(map[*peerConn]*superPeer)}
+}
+
+// 没有处于super-seeding时返回nil, 只有一开始就拥有所有piece时才会启用
+func (t *Torrent) superSeed() *superSeeder {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.super
+}
+
+// 握手时告知对端的bitfield, super-seeding时不公开任何piece
+func (t *Torrent) advertised() bitfield.BitField {
+	if t.superSeed() != nil {
+		return make(bitfield.BitField, (len(t.PieceHashes)+7)/8)
+	}
+
+	return t.BitField()
+}
+
+// 开始向pc做种, 公开第一个piece
+func (t *Torrent) superSeedStart(pc *peerConn) {
+	s := t.superSeed()
+
+	if s == nil {
+		return
+	}
+
+	has := make(bitfield.BitField, len(pc.c.BitField))
+	copy(has, pc.c.BitField)
+
+	s.mu.Lock()
+	s.peers[pc] = &superPeer{has: has, revealed: make(map[int]bool), current: -1}
+	s.mu.Unlock()
+
+	t.superSeedUpdate(s)
+}
+
+// pc断开, 等待它下载的piece交给其他peer
+func (t *Torrent) superSeedStop(pc *peerConn) {
+	s := t.superSeed()
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.peers, pc)
+	s.mu.Unlock()
+
+	t.superSeedUpdate(s)
+}
+
+// pc通过MsgHave通知新的piece
+//
+// 其他peer正在等待扩散的piece出现在pc上时, 向它们公开下一个piece
+func (t *Torrent) superSeedHave(pc *peerConn, index int) {
+	s := t.superSeed()
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+
+	sp, ok := s.peers[pc]
+
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+
+	sp.has.SetPiece(index)
+
+	for other, op := range s.peers {
+		if other != pc && op.current == index {
+			op.current = -1
+		}
+	}
+
+	s.mu.Unlock()
+
+	t.superSeedUpdate(s)
+}
+
+// pc是否可以请求该piece
+func (t *Torrent) superSeedAllowed(pc *peerConn, index int) bool {
+	s := t.superSeed()
+
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.peers[pc]
+
+	return ok && sp.revealed[index]
+}
+
+// 向没有等待扩散的piece的peer公开新的piece
+func (t *Torrent) superSeedUpdate(s *superSeeder) {
+	s.mu.Lock()
+
+	reveals := make(map[*peerConn]int)
+
+	for pc, sp := range s.peers {
+		// 已经下载了公开的piece, 但是没有其他peer可以扩散时不再等待
+		if sp.current >= 0 && sp.has.HasPiece(sp.current) && !s.lacking(pc, sp.current) {
+			sp.current = -1
+		}
+
+		if sp.current >= 0 {
+			continue
+		}
+
+		index := s.pick(t.picker, pc)
+
+		if index < 0 {
+			continue
+		}
+
+		sp.current = index
+		sp.revealed[index] = true
+		reveals[pc] = index
+	}
+
+	s.mu.Unlock()
+
+	for pc, index := range reveals {
+		log.Printf("super-seeding piece #%d to %s\n", index, pc.c.Peer())
+
+		pc.c.SendHave(index)
+	}
+}
+
+// 除了pc之外是否还有peer缺少该piece, 调用时需要持有锁
+func (s *superSeeder) lacking(pc *peerConn, index int) bool {
+	for other, op := range s.peers {
+		if other != pc && !op.has.HasPiece(index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 为pc选择下一个公开的piece, 调用时需要持有锁
+//
+// 优先选择没有公开给其他peer的piece, 其次选择拥有者最少的piece
+func (s *superSeeder) pick(p *picker, pc *peerConn) int {
+	sp := s.peers[pc]
+
+	waiting := make(map[int]bool)
+
+	for other, op := range s.peers {
+		if other != pc && op.current >= 0 {
+			waiting[op.current] = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := -1
+	bestWaiting := false
+	ties := 0
+
+	for i := range p.avail {
+		if sp.has.HasPiece(i) || sp.revealed[i] {
+			continue
+		}
+
+		better := best == -1 ||
+			(bestWaiting && !waiting[i]) ||
+			(bestWaiting == waiting[i] && p.avail[i] < p.avail[best])
+
+		switch {
+		case better:
+			best = i
+			bestWaiting = waiting[i]
+			ties = 1
+		case bestWaiting == waiting[i] && p.avail[i] == p.avail[best]:
+			// 相同条件的piece随机选择
+			ties++
+
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	return best
+}
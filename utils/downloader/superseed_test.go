@@ -0,0 +1,148 @@
+package downloader
+
+import (
+	"crypto/sha1"
+	"testing"
+
+	"cpipi1024.com/turtleDownloader/client"
+)
+
+// 处于super-seeding的torrent, avail为其他peer拥有每个piece的数量
+func newSuperTorrent(avail []int) *Torrent {
+	p := newPicker(len(avail))
+	copy(p.avail, avail)
+
+	return &Torrent{
+		PieceHashes: make([][20]byte, len(avail)),
+		conns:       make(map[*client.Client]*peerConn),
+		picker:      p,
+		super:       newSuperSeeder(),
+	}
+}
+
+func superPeerOf(torrent *Torrent, pc *peerConn) *superPeer {
+	torrent.super.mu.Lock()
+	defer torrent.super.mu.Unlock()
+
+	return torrent.super.peers[pc]
+}
+
+func TestSuperSeedPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		avail    []int
+		has      []int       // 对端已有的piece
+		revealed []int       // 已经公开给对端的piece
+		waiting  map[int]int // 其他peer正在等待扩散的piece
+		want     []int       // 可能选择的piece
+	}{
+		{name: "rarest", avail: []int{3, 1, 2, 1}, want: []int{1, 3}},
+		{name: "skip pieces the peer has", avail: []int{3, 1, 2, 1}, has: []int{1, 3}, want: []int{2}},
+		{name: "skip revealed pieces", avail: []int{0, 1, 2}, revealed: []int{0}, want: []int{1}},
+		{name: "avoid pieces revealed to others", avail: []int{0, 0, 5}, waiting: map[int]int{0: 1, 1: 1}, want: []int{2}},
+		{name: "nothing left", avail: []int{0, 0}, has: []int{0, 1}, want: []int{-1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent := newSuperTorrent(tt.avail)
+			s := torrent.super
+
+			pc := testPeer(t, "10.0.0.1")
+			sp := &superPeer{has: have(len(tt.avail), tt.has...), revealed: make(map[int]bool), current: -1}
+
+			for _, i := range tt.revealed {
+				sp.revealed[i] = true
+			}
+
+			s.peers[pc] = sp
+
+			for index := range tt.waiting {
+				other := testPeer(t, "10.0.1.1")
+				s.peers[other] = &superPeer{has: have(len(tt.avail)), revealed: map[int]bool{index: true}, current: index}
+			}
+
+			got := s.pick(torrent.picker, pc)
+
+			for _, w := range tt.want {
+				if got == w {
+					return
+				}
+			}
+
+			t.Errorf("pick() = %d, want one of %v", got, tt.want)
+		})
+	}
+}
+
+// 每个peer只能请求公开给它的piece, 公开的piece扩散到其他peer之后才公开下一个
+func TestSuperSeedUpdate(t *testing.T) {
+	torrent := newSuperTorrent([]int{0, 0, 0, 0})
+	a := testPeer(t, "10.0.0.1")
+	b := testPeer(t, "10.0.0.2")
+
+	torrent.superSeedStart(a)
+	torrent.superSeedStart(b)
+
+	pa := superPeerOf(torrent, a).current
+	pb := superPeerOf(torrent, b).current
+
+	if pa < 0 || pb < 0 || pa == pb {
+		t.Fatalf("revealed pieces %d and %d, want two different pieces", pa, pb)
+	}
+
+	if !torrent.superSeedAllowed(a, pa) || torrent.superSeedAllowed(a, pb) {
+		t.Errorf("peer a may request %d: %v, %d: %v", pa, torrent.superSeedAllowed(a, pa), pb, torrent.superSeedAllowed(a, pb))
+	}
+
+	// a下载完公开的piece, 还没有扩散到b之前不公开新的piece
+	torrent.superSeedHave(a, pa)
+
+	if got := superPeerOf(torrent, a).current; got != pa {
+		t.Fatalf("peer a got piece %d before piece %d spread", got, pa)
+	}
+
+	// b从a获得了该piece, 向a公开下一个
+	torrent.superSeedHave(b, pa)
+
+	next := superPeerOf(torrent, a).current
+
+	if next < 0 || next == pa || next == pb {
+		t.Fatalf("peer a got piece %d after piece %d spread, want a new piece", next, pa)
+	}
+
+	// b断开后不再接受它的请求
+	torrent.superSeedStop(b)
+
+	if torrent.superSeedAllowed(b, pb) {
+		t.Error("disconnected peer may still request pieces")
+	}
+}
+
+// 开始做种时已经决定super-seeding, 握手时不公开任何piece
+func TestSuperSeedBeforePeers(t *testing.T) {
+	data := []byte("0123456789abcdef")
+
+	torrent := &Torrent{
+		PieceHashes: [][20]byte{sha1.Sum(data[:8]), sha1.Sum(data[8:])},
+		PieceLength: 8,
+		Length:      len(data),
+		Existing:    map[int][]byte{0: data[:8], 1: data[8:]},
+		Seed:        true,
+		SuperSeed:   true,
+	}
+
+	if _, err := torrent.Download(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer torrent.Stop()
+
+	if torrent.superSeed() == nil {
+		t.Fatal("super-seeding is not enabled")
+	}
+
+	if bf := torrent.advertised(); bf.HasPiece(0) || bf.HasPiece(1) {
+		t.Errorf("advertised bitfield = %08b, want no pieces", bf)
+	}
+}
@@ -0,0 +1,362 @@
+package downloader
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/message"
+)
+
+const (
+	MaxPeerRequests  = 250        // 每个peer未处理请求的上限, 在扩展握手中作为reqq告知对端
+	maxRequestLength = 128 * 1024 // 单个请求的最大长度
+)
+
+type request struct {
+	index  int
+	begin  int
+	length int
+}
+
+// 单个连接的状态: 上传队列, 阻塞状态以及双向的传输量
+//
+// 消息由worker读取, 请求在独立的goroutine中发送, 阻塞状态由choker修改
+type peerConn struct {
+	t     *Torrent
+	c     *client.Client
+	since time.Time // 连接开始的时间
+
+	amInterested bool // 本地是否对对端感兴趣, 只由worker使用
+
+	mu         sync.Mutex
+	queue      []request
+	choking    bool // 本地是否阻塞对端
+	interested bool // 对端是否感兴趣
+	uploaded   int
+	downloaded int
+	requests   []request // 向对端发送但还没有收到的请求
+	pipe       pipeline
+	seed       bool // 对端拥有所有piece
+	uploadOnly bool // 对端在扩展握手中声明upload_only
+
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+func (t *Torrent) newPeerConn(c *client.Client) *peerConn {
+	pc := &peerConn{
+		t:       t,
+		c:       c,
+		since:   time.Now(),
+		choking: true,
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.conns[c] = pc
+	t.starting--
+	t.mu.Unlock()
+
+	go pc.run()
+
+	return pc
+}
+
+func (pc *peerConn) close() {
+	close(pc.closed)
+
+	pc.t.mu.Lock()
+	delete(pc.t.conns, pc.c)
+	pc.t.mu.Unlock()
+
+	pc.t.superSeedStop(pc)
+
+	pc.mu.Lock()
+	uploaded := pc.uploaded
+	pc.mu.Unlock()
+
+	if uploaded > 0 {
+		log.Printf("uploaded %d bytes to %s\n", uploaded, pc.c.Peer())
+	}
+}
+
+// 处理与上传有关的消息, 返回false表示不是上传消息
+func (pc *peerConn) handle(msg *message.Message) (bool, error) {
+	switch msg.ID {
+	case message.MsgInterested:
+		pc.setInterested(true)
+	case message.MsgNotInterested:
+		pc.setInterested(false)
+	case message.MsgRequest:
+		idx, begin, length, err := message.ParseMsgRequest(msg)
+		if err != nil {
+			return true, err
+		}
+		return true, pc.request(request{idx, begin, length})
+	case message.MsgCancel:
+		idx, begin, length, err := message.ParseMsgRequest(msg)
+		if err != nil {
+			return true, err
+		}
+		pc.cancel(request{idx, begin, length})
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (pc *peerConn) setInterested(interested bool) {
+	pc.mu.Lock()
+	changed := pc.interested != interested
+	pc.interested = interested
+	pc.mu.Unlock()
+
+	// 感兴趣的peer变化时尽快重新分配上传名额
+	if changed {
+		pc.t.rechoke()
+	}
+}
+
+// 校验请求并加入队列, 无法满足的请求会被拒绝
+func (pc *peerConn) request(r request) error {
+	// super-seeding时只接受已经公开的piece
+	if !pc.t.validRequest(r) || !pc.t.superSeedAllowed(pc, r.index) {
+		return pc.c.SendReject(r.index, r.begin, r.length)
+	}
+
+	pc.mu.Lock()
+
+	// 被阻塞时只能请求allowed fast集合中的piece
+	if (pc.choking && !pc.c.GrantedFast[r.index]) || len(pc.queue) >= MaxPeerRequests {
+		pc.mu.Unlock()
+		return pc.c.SendReject(r.index, r.begin, r.length)
+	}
+
+	pc.queue = append(pc.queue, r)
+	pc.mu.Unlock()
+
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// 对端取消尚未发送的请求
+func (pc *peerConn) cancel(r request) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for i, q := range pc.queue {
+		if q == r {
+			pc.queue = append(pc.queue[:i], pc.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (pc *peerConn) pop() (request, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if len(pc.queue) == 0 {
+		return request{}, false
+	}
+
+	r := pc.queue[0]
+	pc.queue = pc.queue[1:]
+
+	return r, true
+}
+
+// 阻塞对端, 未发送的请求作废
+//
+// 支持Fast Extension时需要明确拒绝, 否则对端会认为请求已经被丢弃
+func (pc *peerConn) choke() {
+	pc.mu.Lock()
+
+	if pc.choking {
+		pc.mu.Unlock()
+		return
+	}
+
+	pc.choking = true
+
+	var dropped []request
+
+	for _, r := range pc.queue {
+		if !pc.c.GrantedFast[r.index] {
+			dropped = append(dropped, r)
+		}
+	}
+
+	kept := pc.queue[:0]
+
+	for _, r := range pc.queue {
+		if pc.c.GrantedFast[r.index] {
+			kept = append(kept, r)
+		}
+	}
+
+	pc.queue = kept
+	pc.mu.Unlock()
+
+	pc.c.SendChoke()
+
+	for _, r := range dropped {
+		pc.c.SendReject(r.index, r.begin, r.length)
+	}
+}
+
+func (pc *peerConn) unchoke() {
+	pc.mu.Lock()
+
+	if !pc.choking {
+		pc.mu.Unlock()
+		return
+	}
+
+	pc.choking = false
+	pc.mu.Unlock()
+
+	pc.c.SendUnchoke()
+}
+
+func (pc *peerConn) outstanding() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return len(pc.requests)
+}
+
+// 其他peer已经提供了该block, 取消请求
+func (pc *peerConn) cancelRequest(r request) {
+	if pc.removeRequest(r) {
+		pc.c.SendCancel(r.index, r.begin, r.length)
+	}
+}
+
+// 取消所有未完成的请求, 还没有完成的block交给其他peer
+func (pc *peerConn) cancelRequests() {
+	pc.mu.Lock()
+	rs := pc.requests
+	pc.requests = nil
+	pc.pipe.sent = make(map[request]time.Time)
+	pc.mu.Unlock()
+
+	for _, r := range rs {
+		pc.c.SendCancel(r.index, r.begin, r.length)
+		pc.t.picker.release(pc, r)
+	}
+}
+
+// 对端丢弃了所有请求, 交给其他peer
+func (pc *peerConn) releaseRequests() {
+	pc.mu.Lock()
+	rs := pc.requests
+	pc.requests = nil
+	pc.pipe.sent = make(map[request]time.Time)
+	pc.mu.Unlock()
+
+	for _, r := range rs {
+		pc.t.picker.release(pc, r)
+	}
+}
+
+// 记录从对端下载的字节数
+func (pc *peerConn) addDownloaded(n int) {
+	pc.mu.Lock()
+	pc.downloaded += n
+	pc.mu.Unlock()
+
+	pc.t.addDownloaded(n)
+}
+
+// 按顺序发送队列中的block
+func (pc *peerConn) run() {
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-pc.wake:
+		}
+
+		for {
+			r, ok := pc.pop()
+
+			if !ok {
+				break
+			}
+
+			data := pc.t.readBlock(r)
+
+			if data == nil {
+				pc.c.SendReject(r.index, r.begin, r.length)
+				continue
+			}
+
+			if err := pc.c.SendPiece(r.index, r.begin, data); err != nil {
+				return
+			}
+
+			pc.mu.Lock()
+			pc.uploaded += len(data)
+			pc.mu.Unlock()
+
+			pc.t.addUploaded(len(data))
+		}
+	}
+}
+
+// 请求的范围是否在piece之内
+func (t *Torrent) validRequest(r request) bool {
+	if r.index < 0 || r.index >= len(t.PieceHashes) {
+		return false
+	}
+
+	if r.begin < 0 || r.length <= 0 || r.length > maxRequestLength {
+		return false
+	}
+
+	return r.begin+r.length <= t.calculatePieceSize(r.index)
+}
+
+// 读取已经校验通过的block, 没有该piece时返回nil
+func (t *Torrent) readBlock(r request) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.buf == nil || !t.have.HasPiece(r.index) {
+		return nil
+	}
+
+	begin, _ := t.calculateBoundsForPiece(r.index)
+	begin += r.begin
+
+	data := make([]byte, r.length)
+	copy(data, t.buf[begin:begin+r.length])
+
+	return data
+}
+
+// 向所有连接发送MsgHave
+func (t *Torrent) broadcastHave(index int) {
+	t.mu.Lock()
+
+	conns := make([]*client.Client, 0, len(t.conns))
+
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		c.SendHave(index)
+	}
+}
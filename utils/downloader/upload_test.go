@@ -0,0 +1,90 @@
+package downloader
+
+import "testing"
+
+// 每个piece为两个block, 最后一个piece只有一个block
+func newUploadTorrent() *Torrent {
+	return &Torrent{
+		PieceHashes: make([][20]byte, 3),
+		PieceLength: 2 * maxRequestLength,
+		Length:      5 * maxRequestLength,
+	}
+}
+
+func TestValidRequest(t *testing.T) {
+	torrent := newUploadTorrent()
+
+	tests := []struct {
+		name string
+		r    request
+		want bool
+	}{
+		{name: "first block", r: request{0, 0, maxRequestLength}, want: true},
+		{name: "end of piece", r: request{1, maxRequestLength, maxRequestLength}, want: true},
+		{name: "last piece", r: request{2, 0, maxRequestLength}, want: true},
+		{name: "small block", r: request{2, 100, 16}, want: true},
+		{name: "negative index", r: request{-1, 0, 16}},
+		{name: "index out of range", r: request{3, 0, 16}},
+		{name: "negative begin", r: request{0, -16, 16}},
+		{name: "zero length", r: request{0, 0, 0}},
+		{name: "too long", r: request{0, 0, maxRequestLength + 1}},
+		{name: "past piece end", r: request{0, maxRequestLength + 1, maxRequestLength}},
+		{name: "past last piece end", r: request{2, maxRequestLength, 16}},
+	}
+
+	for _, tt := range tests {
+		if got := torrent.validRequest(tt.r); got != tt.want {
+			t.Errorf("%s: validRequest(%v) = %v, want %v", tt.name, tt.r, got, tt.want)
+		}
+	}
+}
+
+func queued(pc *peerConn) int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return len(pc.queue)
+}
+
+// 未处理的请求不超过MaxPeerRequests, 无效的请求和阻塞时的请求不会进入队列
+func TestRequestQueue(t *testing.T) {
+	pc := testPeer(t, "10.0.0.1")
+	pc.t = newUploadTorrent()
+	pc.wake = make(chan struct{}, 1)
+	pc.choking = true
+
+	if err := pc.request(request{0, 0, 16}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := queued(pc); n != 0 {
+		t.Fatalf("%d requests queued while choking, want 0", n)
+	}
+
+	pc.choking = false
+
+	if err := pc.request(request{3, 0, 16}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := queued(pc); n != 0 {
+		t.Fatalf("%d invalid requests queued, want 0", n)
+	}
+
+	for i := 0; i < MaxPeerRequests+10; i++ {
+		if err := pc.request(request{0, i % 8 * 16, 16}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := queued(pc); n != MaxPeerRequests {
+		t.Fatalf("%d requests queued, want %d", n, MaxPeerRequests)
+	}
+
+	// 取消的请求让出队列位置
+	pc.cancel(request{0, 0, 16})
+
+	if n := queued(pc); n != MaxPeerRequests-1 {
+		t.Errorf("%d requests queued after cancel, want %d", n, MaxPeerRequests-1)
+	}
+}
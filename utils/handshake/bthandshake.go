@@ -5,19 +5,45 @@ import (
 	"io"
 )
 
+// reserved中扩展协议(BEP 10)的标志位: reserved[5] & 0x10
+// Fast Extension(BEP 6)的标志位: reserved[7] & 0x04
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+	fastByte      = 7
+	fastBit       = 0x04
+)
+
 // 握手报文
 type HandShake struct {
 	Pstr     string   // Bit Torrent Protocol
+	Reserved [8]byte  // 协议扩展标志位
 	InfoHash [20]byte // 验证hash
 	PeerId   [20]byte // 客户端随机生成
 }
 
+// 创建握手报文, 默认声明支持扩展协议以及Fast Extension
 func New(infohash, peerID [20]byte) *HandShake {
-	return &HandShake{
+	h := &HandShake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infohash,
 		PeerId:   peerID,
 	}
+
+	h.Reserved[extensionByte] |= extensionBit
+	h.Reserved[fastByte] |= fastBit
+
+	return h
+}
+
+// 是否支持Fast Extension
+func (h *HandShake) SupportsFast() bool {
+	return h.Reserved[fastByte]&fastBit != 0
+}
+
+// 是否支持扩展协议
+func (h *HandShake) SupportsExtensions() bool {
+	return h.Reserved[extensionByte]&extensionBit != 0
 }
 
 // 序列化
@@ -30,7 +56,7 @@ func (h *HandShake) Serialize() []byte {
 	cur := 1
 
 	cur += copy(buf[cur:], []byte(h.Pstr))
-	cur += copy(buf[cur:], make([]byte, 8))
+	cur += copy(buf[cur:], h.Reserved[:])
 	cur += copy(buf[cur:], h.InfoHash[:])
 	cur += copy(buf[cur:], h.PeerId[:])
 
@@ -65,14 +91,16 @@ func ReadHandShake(r io.Reader) (*HandShake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infohash, peerID [20]byte
 
-	// +8 忽略reserved信息
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infohash[:], handshakeBuf[pstrLen+8:pstrLen+8+20])
 	copy(peerID[:], handshakeBuf[pstrLen+20+8:])
 
 	h := HandShake{
 		Pstr:     string(handshakeBuf[0:pstrLen]),
+		Reserved: reserved,
 		InfoHash: infohash,
 		PeerId:   peerID,
 	}
@@ -0,0 +1,46 @@
+package handshake
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandShakeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		reserved       [8]byte
+		wantFast       bool
+		wantExtensions bool
+	}{
+		{name: "none"},
+		{name: "fast", reserved: [8]byte{7: 0x04}, wantFast: true},
+		{name: "extensions", reserved: [8]byte{5: 0x10}, wantExtensions: true},
+		{name: "both", reserved: [8]byte{5: 0x10, 7: 0x05}, wantFast: true, wantExtensions: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New([20]byte{1}, [20]byte{2})
+			h.Reserved = tt.reserved
+
+			got, err := ReadHandShake(bytes.NewReader(h.Serialize()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Reserved != tt.reserved || got.InfoHash != h.InfoHash || got.PeerId != h.PeerId {
+				t.Errorf("ReadHandShake() = %+v, want %+v", got, h)
+			}
+
+			if got.SupportsFast() != tt.wantFast || got.SupportsExtensions() != tt.wantExtensions {
+				t.Errorf("fast = %v, extensions = %v", got.SupportsFast(), got.SupportsExtensions())
+			}
+		})
+	}
+
+	// New默认声明支持两种扩展
+	if h := New([20]byte{}, [20]byte{}); !h.SupportsFast() || !h.SupportsExtensions() {
+		t.Error("New() does not advertise fast and extension protocol")
+	}
+}
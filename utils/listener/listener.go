@@ -0,0 +1,168 @@
+package listener
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/mse"
+)
+
+// 接受的连接完成握手后调用
+type PeerFunc func(c *client.Client)
+
+type torrent struct {
+	cfg    *client.Config
+	onPeer PeerFunc
+}
+
+// 监听对端发起的连接, 一个端口服务多个torrent
+//
+// 根据握手中的infohash找到对应的torrent
+type Listener struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	skeys    map[[20]byte][20]byte // HASH('req2', infohash) -> infohash, 用于加密连接
+
+	wg sync.WaitGroup
+}
+
+// 在addr上监听TCP连接, addr为 bind:port
+func New(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		ln:       ln,
+		torrents: make(map[[20]byte]*torrent),
+		skeys:    make(map[[20]byte][20]byte),
+	}
+
+	l.wg.Add(1)
+	go l.acceptLoop(ln)
+
+	return l, nil
+}
+
+// 监听的端口
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+
+	l.wg.Wait()
+
+	return err
+}
+
+// 接受cfg.InfoHash的连接, 握手完成后交给onPeer
+func (l *Listener) Add(cfg *client.Config, onPeer PeerFunc) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.torrents[cfg.InfoHash] = &torrent{cfg: cfg, onPeer: onPeer}
+	l.skeys[mse.SKeyHash(cfg.InfoHash)] = cfg.InfoHash
+}
+
+// 不再接受infohash的连接
+func (l *Listener) Remove(infohash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, infohash)
+	delete(l.skeys, mse.SKeyHash(infohash))
+}
+
+func (l *Listener) lookupSKey(req2 [20]byte) ([20]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ih, ok := l.skeys[req2]
+
+	return ih, ok
+}
+
+// 同时接受另一个监听器的连接, 如uTP socket
+//
+// ln由调用方关闭, 关闭之前Close不会返回
+func (l *Listener) Serve(ln net.Listener) {
+	l.wg.Add(1)
+	go l.acceptLoop(ln)
+}
+
+func (l *Listener) acceptLoop(ln net.Listener) {
+	defer l.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			return
+		}
+
+		go l.handle(conn)
+	}
+}
+
+// 读取对端握手, 交给对应的torrent
+func (l *Listener) handle(conn net.Conn) {
+	if d := client.Timeouts.Handshake; d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+
+	ec, err := mse.Accept(conn, client.Encryption, l.lookupSKey)
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	hs, err := handshake.ReadHandShake(ec)
+
+	if err != nil {
+		ec.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	l.mu.Lock()
+	t, ok := l.torrents[hs.InfoHash]
+	l.mu.Unlock()
+
+	if !ok {
+		ec.Close()
+		return
+	}
+
+	c, err := client.Accept(ec, hs, t.cfg)
+
+	if err != nil {
+		log.Printf("incoming connection from %s failed: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Printf("accepted connection from %s\n", c.Peer())
+
+	t.onPeer(c)
+}
+
+// 监听地址
+func Addr(bind string, port int) string {
+	return net.JoinHostPort(bind, strconv.Itoa(port))
+}
@@ -0,0 +1,123 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/message"
+	"cpipi1024.com/turtleDownloader/utils/mse"
+)
+
+// 作为对端连接l, 返回是否收到infohash的握手响应
+func connect(t *testing.T, l *Listener, infohash [20]byte, encrypt bool) bool {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", Addr("127.0.0.1", l.Port()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if encrypt {
+		ec, err := mse.Initiate(conn, infohash, mse.CryptoRC4, nil)
+
+		// 没有对应skey时监听方直接关闭连接
+		if err != nil {
+			return false
+		}
+
+		conn = ec
+	}
+
+	if _, err := conn.Write(handshake.New(infohash, [20]byte{2}).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, err := handshake.ReadHandShake(conn)
+
+	if err != nil {
+		return false
+	}
+
+	if hs.InfoHash != infohash {
+		t.Fatalf("handshake infohash = %x, want %x", hs.InfoHash, infohash)
+	}
+
+	go io.Copy(io.Discard, conn)
+
+	conn.Write((&message.Message{ID: message.MsgBitfield, PayLoad: []byte{0}}).Serialize())
+
+	return true
+}
+
+func TestRouting(t *testing.T) {
+	l, err := New(Addr("127.0.0.1", 0))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	infohashes := [][20]byte{{1}, {2}}
+	accepted := make([]chan *client.Client, len(infohashes))
+
+	for i, ih := range infohashes {
+		ch := make(chan *client.Client, 1)
+		accepted[i] = ch
+
+		l.Add(&client.Config{InfoHash: ih, NumPieces: 8}, func(c *client.Client) { ch <- c })
+	}
+
+	tests := []struct {
+		name     string
+		infohash [20]byte
+		encrypt  bool
+		want     int // 接受连接的torrent, -1表示拒绝
+	}{
+		{name: "plaintext first torrent", infohash: infohashes[0], want: 0},
+		{name: "plaintext second torrent", infohash: infohashes[1], want: 1},
+		{name: "encrypted second torrent", infohash: infohashes[1], encrypt: true, want: 1},
+		{name: "unknown infohash", infohash: [20]byte{3}, want: -1},
+		{name: "encrypted unknown infohash", infohash: [20]byte{3}, encrypt: true, want: -1},
+	}
+
+	for _, tt := range tests {
+		ok := connect(t, l, tt.infohash, tt.encrypt)
+
+		if ok != (tt.want >= 0) {
+			t.Errorf("%s: handshake completed = %v", tt.name, ok)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		select {
+		case c := <-accepted[tt.want]:
+			if c.Encrypted() != tt.encrypt {
+				t.Errorf("%s: encrypted = %v", tt.name, c.Encrypted())
+			}
+
+			c.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: connection was not passed to torrent %d", tt.name, tt.want)
+		}
+	}
+
+	// 移除之后不再接受该torrent的连接
+	l.Remove(infohashes[0])
+
+	if connect(t, l, infohashes[0], false) {
+		t.Error("handshake completed after the torrent was removed")
+	}
+}
@@ -0,0 +1,325 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+// BEP 14 组播地址
+const (
+	Addr4 = "239.192.152.143:6771"
+	Addr6 = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	announceInterval    = 5 * time.Minute // 定期announce的周期
+	minAnnounceInterval = time.Minute     // 同一个infohash两次announce的最小间隔
+
+	minReadDelay = 10 * time.Millisecond // 读取失败后的等待时间, 连续失败时翻倍
+	maxReadDelay = time.Second
+)
+
+// LSD 配置
+type Config struct {
+	Port      int            // 本地peer监听端口
+	Interface *net.Interface // 组播使用的网卡, 为nil时由系统选择
+	Groups    []string       // 组播地址, 为空时使用Addr4和Addr6
+}
+
+// 收到其他peer的announce后调用
+type PeerFunc func(p peers.Peer)
+
+type group struct {
+	addr *net.UDPAddr
+	recv *net.UDPConn // 加入组播组的接收连接
+	send *net.UDPConn // 发送连接, 默认开启组播回环以便本机测试
+}
+
+type torrentInfo struct {
+	onPeer PeerFunc
+	last   time.Time
+}
+
+// 本地服务发现(BEP 14)
+type LSD struct {
+	cfg    Config
+	cookie string
+	groups []*group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrentInfo
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// 加入组播组并开始监听其他peer的announce
+//
+// 至少有一个组播组可用时返回成功
+func New(cfg Config) (*LSD, error) {
+	if len(cfg.Groups) == 0 {
+		cfg.Groups = []string{Addr4, Addr6}
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	l := &LSD{
+		cfg:      cfg,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*torrentInfo),
+		closed:   make(chan struct{}),
+	}
+
+	var lastErr error
+
+	for _, g := range cfg.Groups {
+		grp, err := joinGroup(g, cfg.Interface)
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		l.groups = append(l.groups, grp)
+	}
+
+	if len(l.groups) == 0 {
+		return nil, fmt.Errorf("join lsd multicast groups failed: %v", lastErr)
+	}
+
+	for _, grp := range l.groups {
+		l.wg.Add(1)
+		go l.readLoop(grp)
+	}
+
+	l.wg.Add(1)
+	go l.announceLoop()
+
+	return l, nil
+}
+
+func joinGroup(addr string, ifi *net.Interface) (*group, error) {
+	gaddr, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	network := "udp4"
+
+	if gaddr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	recv, err := net.ListenMulticastUDP(network, ifi, gaddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	send, err := net.ListenUDP(network, nil)
+
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+
+	return &group{addr: gaddr, recv: recv, send: send}, nil
+}
+
+// 关闭所有组播连接
+func (l *LSD) Close() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+
+	close(l.closed)
+
+	for _, grp := range l.groups {
+		grp.recv.Close()
+		grp.send.Close()
+	}
+
+	l.wg.Wait()
+
+	return nil
+}
+
+// 开始在局域网中announce infohash, 发现的peer通过onPeer返回
+func (l *LSD) Announce(infohash [20]byte, onPeer PeerFunc) {
+	l.mu.Lock()
+	l.torrents[infohash] = &torrentInfo{onPeer: onPeer}
+	l.mu.Unlock()
+
+	l.announce()
+}
+
+// 停止announce infohash
+func (l *LSD) StopAnnounce(infohash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, infohash)
+}
+
+// 发送所有可以announce的infohash
+func (l *LSD) announce() {
+	l.mu.Lock()
+
+	hashes := make([][20]byte, 0, len(l.torrents))
+
+	for ih, info := range l.torrents {
+		if time.Since(info.last) >= minAnnounceInterval {
+			info.last = time.Now()
+			hashes = append(hashes, ih)
+		}
+	}
+
+	l.mu.Unlock()
+
+	if len(hashes) == 0 {
+		return
+	}
+
+	for _, grp := range l.groups {
+		_, err := grp.send.WriteToUDP(l.searchMessage(grp.addr, hashes), grp.addr)
+
+		if err != nil {
+			log.Println("lsd announce failed:", err)
+		}
+	}
+}
+
+// BT-SEARCH 报文
+func (l *LSD) searchMessage(addr *net.UDPAddr, hashes [][20]byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", addr.String())
+	fmt.Fprintf(&buf, "Port: %d\r\n", l.cfg.Port)
+
+	for _, ih := range hashes {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", ih)
+	}
+
+	fmt.Fprintf(&buf, "cookie: %s\r\n", l.cookie)
+	buf.WriteString("\r\n\r\n")
+
+	return buf.Bytes()
+}
+
+func (l *LSD) announceLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+		}
+
+		l.announce()
+	}
+}
+
+// 连续读取失败后的下一次等待时间
+func nextReadDelay(d time.Duration) time.Duration {
+	if d < minReadDelay {
+		return minReadDelay
+	}
+
+	if d *= 2; d > maxReadDelay {
+		d = maxReadDelay
+	}
+
+	return d
+}
+
+func (l *LSD) readLoop(grp *group) {
+	defer l.wg.Done()
+
+	buf := make([]byte, 1500)
+
+	var delay time.Duration
+
+	for {
+		n, from, err := grp.recv.ReadFromUDP(buf)
+
+		if err != nil {
+			// 连接只在Close时关闭, 其他错误可能持续出现, 等待后重试
+			delay = nextReadDelay(delay)
+
+			select {
+			case <-l.closed:
+				return
+			case <-time.After(delay):
+			}
+
+			continue
+		}
+
+		delay = 0
+
+		l.handleMessage(buf[:n], from)
+	}
+}
+
+// 解析其他peer的BT-SEARCH报文
+func (l *LSD) handleMessage(data []byte, from *net.UDPAddr) {
+	// 报文格式与http请求相同, 以两个CRLF结束
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+
+	// 忽略自己发送的报文
+	if req.Header.Get("cookie") == l.cookie {
+		return
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+
+	p := peers.Peer{IP: from.IP, Port: uint(port)}
+
+	for _, value := range req.Header.Values("Infohash") {
+		raw, err := hex.DecodeString(strings.TrimSpace(value))
+
+		if err != nil || len(raw) != 20 {
+			continue
+		}
+
+		var ih [20]byte
+		copy(ih[:], raw)
+
+		l.mu.Lock()
+		info, ok := l.torrents[ih]
+		l.mu.Unlock()
+
+		if ok && info.onPeer != nil {
+			info.onPeer(p)
+		}
+	}
+}
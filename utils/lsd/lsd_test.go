@@ -0,0 +1,164 @@
+package lsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+func newTestLSD(cookie string, port int) *LSD {
+	return &LSD{
+		cfg:      Config{Port: port},
+		cookie:   cookie,
+		torrents: make(map[[20]byte]*torrentInfo),
+		closed:   make(chan struct{}),
+	}
+}
+
+// searchMessage生成的报文由handleMessage解析
+func TestSearchMessageRoundTrip(t *testing.T) {
+	group, err := net.ResolveUDPAddr("udp", Addr4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 40000}
+	ih1 := [20]byte{1}
+	ih2 := [20]byte{2}
+	other := [20]byte{3}
+
+	tests := []struct {
+		name   string
+		cookie string // 发送方的cookie
+		port   int
+		hashes [][20]byte
+		want   [][20]byte // 接收方收到的infohash
+	}{
+		{name: "single infohash", cookie: "a", port: 6881, hashes: [][20]byte{ih1}, want: [][20]byte{ih1}},
+		{name: "multiple infohashes", cookie: "a", port: 6881, hashes: [][20]byte{ih1, ih2}, want: [][20]byte{ih1, ih2}},
+		{name: "unknown infohash", cookie: "a", port: 6881, hashes: [][20]byte{other}},
+		{name: "own message", cookie: "self", port: 6881, hashes: [][20]byte{ih1}},
+		{name: "invalid port", cookie: "a", port: 0, hashes: [][20]byte{ih1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := newTestLSD(tt.cookie, tt.port)
+			receiver := newTestLSD("self", 6881)
+
+			var got [][20]byte
+
+			for _, ih := range [][20]byte{ih1, ih2} {
+				ih := ih
+
+				receiver.torrents[ih] = &torrentInfo{onPeer: func(p peers.Peer) {
+					if !p.IP.Equal(from.IP) || p.Port != uint(tt.port) {
+						t.Errorf("peer = %s, want %s:%d", p, from.IP, tt.port)
+					}
+
+					got = append(got, ih)
+				}}
+			}
+
+			receiver.handleMessage(sender.searchMessage(group, tt.hashes), from)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d infohashes, want %d", len(got), len(tt.want))
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("infohash %d = %x, want %x", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMalformedMessage(t *testing.T) {
+	tests := []string{
+		"",
+		"GET / HTTP/1.1\r\nHost: x\r\nPort: 6881\r\nInfohash: 0100000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nPort: abc\r\nInfohash: 0100000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nPort: 6881\r\nInfohash: 01\r\n\r\n",
+	}
+
+	for _, msg := range tests {
+		l := newTestLSD("self", 6881)
+
+		l.torrents[[20]byte{1}] = &torrentInfo{onPeer: func(p peers.Peer) {
+			t.Errorf("peer %s found in %q", p, msg)
+		}}
+
+		l.handleMessage([]byte(msg), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	}
+}
+
+// 本机的两个LSD通过组播回环发现对方
+func TestLoopbackMulticast(t *testing.T) {
+	ifi := multicastInterface()
+
+	// 避免与本机运行的客户端冲突
+	groups := []string{strings.Replace(Addr4, "6771", "16771", 1)}
+
+	a, err := New(Config{Port: 1111, Interface: ifi, Groups: groups})
+
+	if err != nil {
+		t.Skip("multicast is not available:", err)
+	}
+
+	defer a.Close()
+
+	b, err := New(Config{Port: 2222, Interface: ifi, Groups: groups})
+
+	if err != nil {
+		t.Skip("multicast is not available:", err)
+	}
+
+	defer b.Close()
+
+	ih := [20]byte{0xaa}
+	found := make(chan peers.Peer, 1)
+
+	a.Announce(ih, func(p peers.Peer) {
+		select {
+		case found <- p:
+		default:
+		}
+	})
+
+	// b的announce被a收到
+	b.Announce(ih, func(peers.Peer) {})
+
+	select {
+	case p := <-found:
+		if p.Port != 2222 {
+			t.Errorf("peer port = %d, want 2222", p.Port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce received over loopback multicast")
+	}
+}
+
+// 支持组播的回环网卡, 没有时由系统选择网卡, 发送的报文同样会回环到本机
+func multicastInterface() *net.Interface {
+	ifaces, err := net.Interfaces()
+
+	if err != nil {
+		return nil
+	}
+
+	for i := range ifaces {
+		f := ifaces[i].Flags
+
+		if f&net.FlagLoopback != 0 && f&net.FlagUp != 0 && f&net.FlagMulticast != 0 {
+			return &ifaces[i]
+		}
+	}
+
+	return nil
+}
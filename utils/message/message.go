@@ -19,6 +19,14 @@ const (
 	MsgRequest       messageID = 6 //type id = 6 request msg payload的数据是index, begin, length 分别代表文件分片的索引，对应piece内的字节索引, 请求的长度
 	MsgPiece         messageID = 7 //type id = 7 piece msg payload的数据是index, begin, piece 前两个的意义与request msg相同， piece则是对端peer请求的文件片段
 	MsgCancel        messageID = 8 //type id = 8 cancel msg payload数据是index, begin, length 意义与request msg 相反 用于取消对应文件片段的下载
+
+	MsgSuggest     messageID = 13 //type id = 13 Fast Extension 建议对端下载的piece payload为index
+	MsgHaveAll     messageID = 14 //type id = 14 Fast Extension 代替bitfield 表示拥有全部piece
+	MsgHaveNone    messageID = 15 //type id = 15 Fast Extension 代替bitfield 表示没有任何piece
+	MsgReject      messageID = 16 //type id = 16 Fast Extension 拒绝request payload与request msg相同
+	MsgAllowedFast messageID = 17 //type id = 17 Fast Extension 允许对端在被阻塞时请求的piece payload为index
+
+	MsgExtended messageID = 20 //type id = 20 扩展协议(BEP 10) payload第一个字节为扩展消息id, 其余为扩展消息内容
 )
 
 // 实际传输的数据
@@ -64,6 +72,17 @@ func FormatRequest(begin, idx, length int) *Message {
 	}
 }
 
+// 创建 MsgPiece
+func FormatPiece(idx, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+
+	binary.BigEndian.PutUint32(payload[0:4], uint32(idx))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+
+	return &Message{ID: MsgPiece, PayLoad: payload}
+}
+
 // 创建 MsgHave
 func FromHava(idx int) *Message {
 	payload := make([]byte, 4)
@@ -73,6 +92,89 @@ func FromHava(idx int) *Message {
 	return &Message{ID: MsgHave, PayLoad: payload}
 }
 
+// 创建 MsgReject
+func FormatReject(idx, begin, length int) *Message {
+	m := FormatRequest(begin, idx, length)
+	m.ID = MsgReject
+
+	return m
+}
+
+// 创建 MsgCancel
+func FormatCancel(idx, begin, length int) *Message {
+	m := FormatRequest(begin, idx, length)
+	m.ID = MsgCancel
+
+	return m
+}
+
+// 创建只包含piece index的msg, 如 MsgSuggest, MsgAllowedFast
+func FormatIndex(id messageID, idx int) *Message {
+	payload := make([]byte, 4)
+
+	binary.BigEndian.PutUint32(payload, uint32(idx))
+
+	return &Message{ID: id, PayLoad: payload}
+}
+
+// parse 对等peer发送的MsgRequest, MsgCancel或MsgReject
+//
+// 返回index, begin, length
+func ParseMsgRequest(msg *Message) (int, int, int, error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel && msg.ID != MsgReject {
+		err := fmt.Errorf("expect Request, Cancel or Reject Msg but got:%d", msg.ID)
+		return 0, 0, 0, err
+	}
+
+	if len(msg.PayLoad) != 12 {
+		err := fmt.Errorf("expected payload length is 12 but got:%d", len(msg.PayLoad))
+		return 0, 0, 0, err
+	}
+
+	idx := int(binary.BigEndian.Uint32(msg.PayLoad[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.PayLoad[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.PayLoad[8:12]))
+
+	return idx, begin, length, nil
+}
+
+// parse 只包含piece index的msg, 如 MsgSuggest, MsgAllowedFast
+func ParseMsgIndex(msg *Message) (int, error) {
+	if len(msg.PayLoad) != 4 {
+		err := fmt.Errorf("expected payload length is 4 but got:%d", len(msg.PayLoad))
+		return 0, err
+	}
+
+	return int(binary.BigEndian.Uint32(msg.PayLoad)), nil
+}
+
+// 创建 MsgExtended
+func FormatExtended(extID byte, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+
+	buf[0] = extID
+	copy(buf[1:], payload)
+
+	return &Message{ID: MsgExtended, PayLoad: buf}
+}
+
+// parse 对等peer发送的MsgExtended
+//
+// 返回扩展消息id以及扩展消息内容
+func ParseMsgExtended(msg *Message) (byte, []byte, error) {
+	if msg.ID != MsgExtended {
+		err := fmt.Errorf("expect MsgExtended, ID:%d but got:%d", MsgExtended, msg.ID)
+		return 0, nil, err
+	}
+
+	if len(msg.PayLoad) < 1 {
+		err := fmt.Errorf("extended msg payload is empty")
+		return 0, nil, err
+	}
+
+	return msg.PayLoad[0], msg.PayLoad[1:], nil
+}
+
 // parse 对等peer发送的Msgpiece
 //
 // 返回data长度
@@ -104,7 +206,7 @@ func ParseMsgPiece(idx int, buf []byte, msg *Message) (int, error) {
 
 	data := msg.PayLoad[8:]
 
-	if begin+len(data) >= len(buf) {
+	if begin+len(data) > len(buf) {
 		err := fmt.Errorf("data is too long for buf, datasize:%d, bufsize:%d, beiginoffset:%d", len(data), len(buf), begin)
 		return 0, err
 	}
@@ -114,6 +216,24 @@ func ParseMsgPiece(idx int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// 返回MsgPiece的piece index和begin offset, 不复制数据
+func ParseMsgPieceHeader(msg *Message) (int, int, error) {
+	if msg.ID != MsgPiece {
+		err := fmt.Errorf("expect Piece Msg, ID:%d but got:%d", MsgPiece, msg.ID)
+		return 0, 0, err
+	}
+
+	if len(msg.PayLoad) < 8 {
+		err := fmt.Errorf("msg payload is to short, length:%d", len(msg.PayLoad))
+		return 0, 0, err
+	}
+
+	idx := int(binary.BigEndian.Uint32(msg.PayLoad[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.PayLoad[4:8]))
+
+	return idx, begin, nil
+}
+
 // parse 对等peer发送的MsgHave
 func ParseMsgHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -155,6 +275,18 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
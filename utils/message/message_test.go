@@ -0,0 +1,72 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 序列化后再读取得到相同的消息
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []*Message{
+		{ID: MsgChoke},
+		{ID: MsgHaveAll},
+		{ID: MsgHaveNone},
+		FromHava(7),
+		FormatIndex(MsgSuggest, 42),
+		FormatIndex(MsgAllowedFast, 1313),
+		FormatRequest(16384, 3, 16384),
+		FormatReject(3, 16384, 16384),
+		FormatCancel(3, 0, 100),
+		FormatPiece(1, 0, []byte("data")),
+		FormatExtended(2, []byte("d1:ai1ee")),
+	}
+
+	for _, msg := range tests {
+		t.Run(msg.String(), func(t *testing.T) {
+			got, err := ReadMessage(bytes.NewReader(msg.Serialize()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.ID != msg.ID || !bytes.Equal(got.PayLoad, msg.PayLoad) {
+				t.Errorf("ReadMessage() = %s %x, want %s %x", got, got.PayLoad, msg, msg.PayLoad)
+			}
+		})
+	}
+}
+
+func TestParseFastMessages(t *testing.T) {
+	idx, begin, length, err := ParseMsgRequest(FormatReject(5, 32768, 1000))
+
+	if err != nil || idx != 5 || begin != 32768 || length != 1000 {
+		t.Errorf("ParseMsgRequest(reject) = %d, %d, %d, %v", idx, begin, length, err)
+	}
+
+	tests := []struct {
+		msg     *Message
+		want    int
+		wantErr bool
+	}{
+		{msg: FormatIndex(MsgSuggest, 9), want: 9},
+		{msg: FormatIndex(MsgAllowedFast, 1<<20), want: 1 << 20},
+		{msg: &Message{ID: MsgAllowedFast, PayLoad: []byte{1, 2}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMsgIndex(tt.msg)
+
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseMsgIndex(%s) = %d, %v, want %d", tt.msg, got, err, tt.want)
+		}
+	}
+}
+
+// keep-alive为长度为0的消息
+func TestReadKeepAlive(t *testing.T) {
+	msg, err := ReadMessage(bytes.NewReader([]byte{0, 0, 0, 0}))
+
+	if err != nil || msg != nil {
+		t.Errorf("ReadMessage(keep-alive) = %v, %v, want nil, nil", msg, err)
+	}
+}
@@ -0,0 +1,325 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	Name = "ut_metadata" // 扩展名称
+
+	pieceSize       = 16 * 1024 // metadata按16KiB分片传输
+	maxMetadataSize = 8 * 1024 * 1024
+
+	// ut_metadata msg_type
+	msgTypeRequest = 0
+	msgTypeData    = 1
+	msgTypeReject  = 2
+)
+
+// ut_metadata消息头
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func encodeMsg(m metadataMsg, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, m)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf.Write(data)
+
+	return buf.Bytes(), nil
+}
+
+// ut_metadata扩展(BEP 9)
+//
+// info不为nil时响应peer的metadata请求, 否则从peer获取metadata
+type Extension struct {
+	infohash [20]byte
+
+	mu       sync.Mutex
+	info     []byte
+	fetching map[*client.Client]*fetchState
+	done     chan []byte
+}
+
+// 单个连接的获取进度
+type fetchState struct {
+	buf      []byte
+	have     []bool // 已经收到的分片, 重复的分片不会重复计数
+	received int    // 已经收到的分片数
+}
+
+func NewExtension(infohash [20]byte, info []byte) *Extension {
+	return &Extension{
+		infohash: infohash,
+		info:     info,
+		fetching: make(map[*client.Client]*fetchState),
+		done:     make(chan []byte, 1),
+	}
+}
+
+func (e *Extension) Name() string {
+	return Name
+}
+
+// 完整校验通过的info字典, 尚未获取时为nil
+func (e *Extension) Info() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.info
+}
+
+// 获取完成后返回info字典
+func (e *Extension) Done() <-chan []byte {
+	return e.done
+}
+
+// 收到扩展握手后请求metadata的所有分片
+func (e *Extension) OnHandshake(c *client.Client, hs *client.ExtHandshake) error {
+	e.mu.Lock()
+
+	if e.info != nil {
+		e.mu.Unlock()
+		return nil
+	}
+
+	if hs.MetadataSize <= 0 || hs.MetadataSize > maxMetadataSize {
+		e.mu.Unlock()
+		return fmt.Errorf("invalid metadata size:%d", hs.MetadataSize)
+	}
+
+	pieces := (hs.MetadataSize + pieceSize - 1) / pieceSize
+
+	e.fetching[c] = &fetchState{buf: make([]byte, hs.MetadataSize), have: make([]bool, pieces)}
+	e.mu.Unlock()
+
+	for i := 0; i < pieces; i++ {
+		payload, err := encodeMsg(metadataMsg{MsgType: msgTypeRequest, Piece: i}, nil)
+
+		if err != nil {
+			return err
+		}
+
+		err = c.SendExtended(Name, payload)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Extension) OnMessage(c *client.Client, payload []byte) error {
+	header, err := bencode.Decode(bytes.NewReader(payload))
+
+	if err != nil {
+		return err
+	}
+
+	dict, ok := header.(map[string]interface{})
+
+	if !ok {
+		return fmt.Errorf("malformed ut_metadata message")
+	}
+
+	msgType, _ := dict["msg_type"].(int64)
+	piece, _ := dict["piece"].(int64)
+
+	switch msgType {
+	case msgTypeRequest:
+		return e.serve(c, int(piece))
+	case msgTypeReject:
+		return fmt.Errorf("peer rejected metadata piece %d", piece)
+	case msgTypeData:
+	default:
+		return nil
+	}
+
+	// 字典之后的剩余字节为分片数据
+	// Decode会预读, 通过重新编码字典得到其长度
+	var buf bytes.Buffer
+
+	err = bencode.Marshal(&buf, dict)
+
+	if err != nil || buf.Len() > len(payload) {
+		return fmt.Errorf("malformed ut_metadata message")
+	}
+
+	return e.receive(c, int(piece), payload[buf.Len():])
+}
+
+// 响应peer的metadata请求, 没有metadata时拒绝
+func (e *Extension) serve(c *client.Client, piece int) error {
+	info := e.Info()
+
+	begin := piece * pieceSize
+
+	if info == nil || piece < 0 || begin >= len(info) {
+		payload, err := encodeMsg(metadataMsg{MsgType: msgTypeReject, Piece: piece}, nil)
+
+		if err != nil {
+			return err
+		}
+
+		return c.SendExtended(Name, payload)
+	}
+
+	end := begin + pieceSize
+
+	if end > len(info) {
+		end = len(info)
+	}
+
+	payload, err := encodeMsg(metadataMsg{MsgType: msgTypeData, Piece: piece, TotalSize: len(info)}, info[begin:end])
+
+	if err != nil {
+		return err
+	}
+
+	return c.SendExtended(Name, payload)
+}
+
+// 保存收到的分片, 全部收到后校验infohash
+func (e *Extension) receive(c *client.Client, piece int, data []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.fetching[c]
+
+	if !ok || e.info != nil {
+		return nil
+	}
+
+	if piece < 0 || piece >= len(state.have) {
+		err := fmt.Errorf("metadata piece %d out of range", piece)
+		return err
+	}
+
+	// 除最后一个分片外每个分片都是16KiB
+	begin := piece * pieceSize
+	end := begin + pieceSize
+
+	if end > len(state.buf) {
+		end = len(state.buf)
+	}
+
+	if len(data) != end-begin {
+		err := fmt.Errorf("metadata piece %d has %d bytes, want %d", piece, len(data), end-begin)
+		return err
+	}
+
+	if state.have[piece] {
+		return nil
+	}
+
+	copy(state.buf[begin:], data)
+	state.have[piece] = true
+	state.received++
+
+	if state.received < len(state.have) {
+		return nil
+	}
+
+	delete(e.fetching, c)
+
+	hash := sha1.Sum(state.buf)
+
+	if !bytes.Equal(hash[:], e.infohash[:]) {
+		return fmt.Errorf("metadata from %s failed integrity check", c.Peer())
+	}
+
+	e.info = state.buf
+	e.done <- state.buf
+
+	return nil
+}
+
+// 通过ut_metadata从peer获取infohash对应的info字典
+func Fetch(peer peers.Peer, infohash, peerID [20]byte) ([]byte, error) {
+	ext := NewExtension(infohash, nil)
+
+	registry := client.NewRegistry()
+	registry.Register(ext)
+
+	c, err := client.NewClient(peer, &client.Config{PeerID: peerID, InfoHash: infohash, Registry: registry})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close()
+
+	c.Conn.SetDeadline(time.Now().Add(60 * time.Second))
+
+	for {
+		select {
+		case info := <-ext.Done():
+			return info, nil
+		default:
+		}
+
+		if c.PeerExtensions() != nil && !c.SupportsExtension(Name) {
+			return nil, fmt.Errorf("peer %s does not support ut_metadata", peer)
+		}
+
+		_, err := c.Read()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// 并发尝试多个peers, 返回第一个成功获取的info字典
+func FetchFromPeers(ps []peers.Peer, infohash, peerID [20]byte) ([]byte, error) {
+	type result struct {
+		info []byte
+		err  error
+	}
+
+	results := make(chan result, len(ps))
+
+	// 最多同时连接的peer数
+	sem := make(chan struct{}, 8)
+
+	for _, p := range ps {
+		go func(p peers.Peer) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			info, err := Fetch(p, infohash, peerID)
+			results <- result{info, err}
+		}(p)
+	}
+
+	var lastErr error = fmt.Errorf("no peers to fetch metadata %x", infohash)
+
+	for range ps {
+		res := <-results
+
+		if res.err == nil {
+			return res.info, nil
+		}
+
+		lastErr = res.err
+	}
+
+	return nil, lastErr
+}
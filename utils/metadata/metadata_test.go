@@ -0,0 +1,118 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"cpipi1024.com/turtleDownloader/client"
+)
+
+// 通过OnMessage按顺序交给扩展的分片
+func TestReceivePieces(t *testing.T) {
+	info := bytes.Repeat([]byte("0123456789"), (2*pieceSize+100)/10)
+	infohash := sha1.Sum(info)
+
+	piece := func(i int) []byte {
+		end := (i + 1) * pieceSize
+
+		if end > len(info) {
+			end = len(info)
+		}
+
+		return info[i*pieceSize : end]
+	}
+
+	type msg struct {
+		piece int
+		data  []byte
+	}
+
+	tests := []struct {
+		name     string
+		infohash [20]byte
+		msgs     []msg
+		wantErr  bool
+		wantDone bool
+	}{
+		{
+			name:     "all pieces",
+			infohash: infohash,
+			msgs:     []msg{{0, piece(0)}, {1, piece(1)}, {2, piece(2)}},
+			wantDone: true,
+		},
+		{
+			name:     "out of order",
+			infohash: infohash,
+			msgs:     []msg{{2, piece(2)}, {0, piece(0)}, {1, piece(1)}},
+			wantDone: true,
+		},
+		{
+			// 重复的分片累计的字节数达到总长度, 但是仍然缺少分片
+			name:     "duplicate pieces",
+			infohash: infohash,
+			msgs:     []msg{{0, piece(0)}, {0, piece(0)}, {1, piece(1)}},
+		},
+		{
+			name:     "short piece",
+			infohash: infohash,
+			msgs:     []msg{{0, piece(0)[:100]}},
+			wantErr:  true,
+		},
+		{
+			name:     "piece out of range",
+			infohash: infohash,
+			msgs:     []msg{{3, piece(2)}},
+			wantErr:  true,
+		},
+		{
+			name:     "wrong infohash",
+			infohash: sha1.Sum([]byte("other")),
+			msgs:     []msg{{0, piece(0)}, {1, piece(1)}, {2, piece(2)}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewExtension(tt.infohash, nil)
+			c := &client.Client{}
+
+			pieces := (len(info) + pieceSize - 1) / pieceSize
+			e.fetching[c] = &fetchState{buf: make([]byte, len(info)), have: make([]bool, pieces)}
+
+			var err error
+
+			for _, m := range tt.msgs {
+				payload, encErr := encodeMsg(metadataMsg{MsgType: msgTypeData, Piece: m.piece, TotalSize: len(info)}, m.data)
+
+				if encErr != nil {
+					t.Fatal(encErr)
+				}
+
+				if err = e.OnMessage(c, payload); err != nil {
+					break
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OnMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			select {
+			case got := <-e.Done():
+				if !tt.wantDone {
+					t.Fatal("metadata completed early")
+				}
+
+				if !bytes.Equal(got, info) {
+					t.Error("metadata does not match")
+				}
+			default:
+				if tt.wantDone {
+					t.Fatal("metadata did not complete")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,519 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// 加密策略
+type Policy int
+
+const (
+	Disabled  Policy = iota // 只使用明文连接
+	Preferred               // 优先使用加密, 对端不支持时回退到明文
+	Required                // 只接受RC4加密的连接
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	default:
+		return fmt.Sprintf("policy#%d", int(p))
+	}
+}
+
+// 解析策略名称
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "disabled":
+		return Disabled, nil
+	case "preferred":
+		return Preferred, nil
+	case "required":
+		return Required, nil
+	}
+
+	return Disabled, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// crypto_provide / crypto_select 中的加密方式
+const (
+	CryptoPlaintext uint32 = 0x01 // 只加密握手, 之后使用明文
+	CryptoRC4       uint32 = 0x02 // 整个连接使用RC4加密
+)
+
+const (
+	keyLen    = 96  // DH公钥长度
+	maxPadLen = 512 // PadA, PadB, PadC, PadD的最大长度
+)
+
+var (
+	// 768位素数P, 生成元G为2
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	vc = make([]byte, 8) // verification constant
+
+	btProtocol = append([]byte{19}, "BitTorrent protocol"...)
+
+	ErrPlaintext = errors.New("mse: plaintext connection refused by encryption policy")
+)
+
+// 加密方式对应的crypto_provide, 加密被禁用时返回0
+func (p Policy) Provide() uint32 {
+	switch p {
+	case Preferred:
+		return CryptoRC4 | CryptoPlaintext
+	case Required:
+		return CryptoRC4
+	}
+
+	return 0
+}
+
+// 从对端提供的加密方式中选择一个, 没有可以接受的方式时返回0
+func (p Policy) Select(provide uint32) uint32 {
+	if provide&CryptoRC4 != 0 {
+		return CryptoRC4
+	}
+
+	if p == Preferred && provide&CryptoPlaintext != 0 {
+		return CryptoPlaintext
+	}
+
+	return 0
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	return h.Sum(nil)
+}
+
+// 接收方通过该值查找对应的infohash: HASH('req2', SKEY)
+func SKeyHash(skey [20]byte) [20]byte {
+	var res [20]byte
+
+	copy(res[:], hash([]byte("req2"), skey[:]))
+
+	return res
+}
+
+// DH密钥对
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+
+	_, err := rand.Read(buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	x := new(big.Int).SetBytes(buf)
+	y := new(big.Int).Exp(generator, x, prime)
+
+	return &keyPair{private: x, public: pad(y.Bytes())}, nil
+}
+
+// 计算共享密钥S
+func (k *keyPair) secret(remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+
+	return pad(new(big.Int).Exp(y, k.private, prime).Bytes())
+}
+
+// 大端补齐到96字节
+func pad(b []byte) []byte {
+	res := make([]byte, keyLen)
+
+	copy(res[keyLen-len(b):], b)
+
+	return res
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+
+	_, err := rand.Read(n[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLen+1))
+
+	_, err = rand.Read(p)
+
+	return p, err
+}
+
+// 创建RC4, 丢弃前1024字节的密钥流
+func newCipher(name string, s []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey[:]))
+
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+// 在r中查找pattern, 最多跳过maxSkip字节
+func syncOn(r io.Reader, pattern []byte, maxSkip int) error {
+	buf := make([]byte, 0, maxSkip+len(pattern))
+	b := make([]byte, 1)
+
+	for len(buf) < maxSkip+len(pattern) {
+		_, err := io.ReadFull(r, b)
+
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, b[0])
+
+		if bytes.HasSuffix(buf, pattern) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("mse: could not find sync pattern")
+}
+
+// 握手后的连接, 选择RC4时读写都经过加密
+type Conn struct {
+	net.Conn
+
+	prefix []byte // 握手中收到的初始数据(IA), 先于连接数据返回
+
+	dec *rc4.Cipher
+
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(p)
+
+	if c.dec != nil && n > 0 {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+
+	// 加密和写入必须按相同顺序进行
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+
+	return c.Conn.Write(buf)
+}
+
+// 连接是否使用RC4加密
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+// 作为发起方进行加密握手
+//
+// skey为torrent的infohash, ia为随握手一起加密发送的初始数据, 可以为空
+func Initiate(conn net.Conn, skey [20]byte, provide uint32, ia []byte) (*Conn, error) {
+	keys, err := newKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPad()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Ya, PadA
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padA...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Yb, PadB
+	yb := make([]byte, keyLen)
+
+	_, err = io.ReadFull(conn, yb)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := keys.secret(yb)
+
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	var buf bytes.Buffer
+
+	buf.Write(hash([]byte("req1"), s))
+
+	req2 := SKeyHash(skey)
+	req3 := hash([]byte("req3"), s)
+
+	for i := range req2 {
+		buf.WriteByte(req2[i] ^ req3[i])
+	}
+
+	// PadC为空
+	plain := make([]byte, 16+len(ia))
+	copy(plain, vc)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	binary.BigEndian.PutUint16(plain[14:16], uint16(len(ia)))
+	copy(plain[16:], ia)
+
+	enc.XORKeyStream(plain, plain)
+	buf.Write(plain)
+
+	_, err = conn.Write(buf.Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// PadB长度未知, 通过加密后的VC同步
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+
+	err = syncOn(conn, encVC, maxPadLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, dec: dec, enc: enc}
+
+	head := make([]byte, 6)
+
+	_, err = io.ReadFull(c, head)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected := binary.BigEndian.Uint32(head[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(head[4:]))
+
+	if len(padD) > maxPadLen {
+		return nil, fmt.Errorf("mse: padD too long: %d", len(padD))
+	}
+
+	_, err = io.ReadFull(c, padD)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == CryptoRC4 && provide&CryptoRC4 != 0:
+	case selected == CryptoPlaintext && provide&CryptoPlaintext != 0:
+		c.enc, c.dec = nil, nil
+	default:
+		return nil, fmt.Errorf("mse: peer selected unsupported crypto method %d", selected)
+	}
+
+	return c, nil
+}
+
+// 作为接收方处理连接, 根据第一段数据判断对端是否使用加密
+//
+// lookup根据HASH('req2', SKEY)查找本地的infohash
+func Accept(conn net.Conn, policy Policy, lookup func(req2 [20]byte) ([20]byte, bool)) (*Conn, error) {
+	first := make([]byte, len(btProtocol))
+
+	_, err := io.ReadFull(conn, first)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 明文握手
+	if bytes.Equal(first, btProtocol) {
+		if policy == Required {
+			return nil, ErrPlaintext
+		}
+
+		return &Conn{Conn: conn, prefix: first}, nil
+	}
+
+	if policy == Disabled {
+		return nil, fmt.Errorf("mse: encrypted connection refused by encryption policy")
+	}
+
+	// 1 A->B: Ya, PadA
+	ya := make([]byte, keyLen)
+	copy(ya, first)
+
+	_, err = io.ReadFull(conn, ya[len(first):])
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := newKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	padB, err := randomPad()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Yb, PadB
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padB...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := keys.secret(ya)
+
+	// 3 A->B: 通过HASH('req1', S)跳过PadA
+	err = syncOn(conn, hash([]byte("req1"), s), maxPadLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var req2 [20]byte
+
+	_, err = io.ReadFull(conn, req2[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	req3 := hash([]byte("req3"), s)
+
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	skey, ok := lookup(req2)
+
+	if !ok {
+		return nil, fmt.Errorf("mse: unknown torrent")
+	}
+
+	c := &Conn{
+		Conn: conn,
+		dec:  newCipher("keyA", s, skey),
+		enc:  newCipher("keyB", s, skey),
+	}
+
+	head := make([]byte, 14)
+
+	_, err = io.ReadFull(c, head)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(head[:8], vc) {
+		return nil, fmt.Errorf("mse: invalid verification constant")
+	}
+
+	provide := binary.BigEndian.Uint32(head[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(head[12:14]))
+
+	if len(padC) > maxPadLen {
+		return nil, fmt.Errorf("mse: padC too long: %d", len(padC))
+	}
+
+	_, err = io.ReadFull(c, padC)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var iaLen [2]byte
+
+	_, err = io.ReadFull(c, iaLen[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen[:]))
+
+	_, err = io.ReadFull(c, ia)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected := policy.Select(provide)
+
+	if selected == 0 {
+		return nil, fmt.Errorf("mse: no acceptable crypto method in %d", provide)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// PadD为空
+	resp := make([]byte, 14)
+	copy(resp, vc)
+	binary.BigEndian.PutUint32(resp[8:12], selected)
+
+	_, err = c.Write(resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == CryptoPlaintext {
+		c.enc, c.dec = nil, nil
+	}
+
+	c.prefix = ia
+
+	return c, nil
+}
@@ -0,0 +1,213 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 带发送缓冲的连接
+//
+// 握手双方都会在对端读取PadA/PadB之前继续写入, 依赖TCP的发送缓冲;
+// net.Pipe没有缓冲, 因此写入交给单独的goroutine
+type bufferedConn struct {
+	net.Conn
+	out chan []byte
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	c := &bufferedConn{Conn: conn, out: make(chan []byte, 64)}
+
+	go func() {
+		for b := range c.out {
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	c.out <- append([]byte{}, p...)
+
+	return len(p), nil
+}
+
+func bufferedPipe(t *testing.T) (*bufferedConn, *bufferedConn) {
+	a, b := net.Pipe()
+
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return newBufferedConn(a), newBufferedConn(b)
+}
+
+func TestHandshake(t *testing.T) {
+	skey := [20]byte{0xaa}
+	ia := append(append([]byte{}, btProtocol...), "initial payload"...)
+
+	tests := []struct {
+		name          string
+		provide       uint32
+		policy        Policy
+		skey          [20]byte // 发起方使用的infohash
+		wantErr       bool
+		wantEncrypted bool
+	}{
+		{name: "preferred both", provide: Preferred.Provide(), policy: Preferred, skey: skey, wantEncrypted: true},
+		{name: "required both", provide: Required.Provide(), policy: Required, skey: skey, wantEncrypted: true},
+		{name: "rc4 to preferred", provide: CryptoRC4, policy: Preferred, skey: skey, wantEncrypted: true},
+		{name: "plaintext to preferred", provide: CryptoPlaintext, policy: Preferred, skey: skey},
+		{name: "plaintext to required", provide: CryptoPlaintext, policy: Required, skey: skey, wantErr: true},
+		{name: "encrypted to disabled", provide: Preferred.Provide(), policy: Disabled, skey: skey, wantErr: true},
+		{name: "unknown torrent", provide: Preferred.Provide(), policy: Preferred, skey: [20]byte{0xbb}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := bufferedPipe(t)
+
+			type result struct {
+				conn *Conn
+				err  error
+			}
+
+			accepted := make(chan result, 1)
+
+			go func() {
+				c, err := Accept(b, tt.policy, func(req2 [20]byte) ([20]byte, bool) {
+					return skey, req2 == SKeyHash(skey)
+				})
+
+				// 失败时关闭连接, 使发起方返回
+				if err != nil {
+					b.Conn.Close()
+				}
+
+				accepted <- result{c, err}
+			}()
+
+			ca, errA := Initiate(a, tt.skey, tt.provide, ia)
+			r := <-accepted
+
+			if tt.wantErr {
+				if errA == nil && r.err == nil {
+					t.Fatal("handshake succeeded, want error")
+				}
+
+				return
+			}
+
+			if errA != nil || r.err != nil {
+				t.Fatalf("Initiate() = %v, Accept() = %v", errA, r.err)
+			}
+
+			cb := r.conn
+
+			if ca.Encrypted() != tt.wantEncrypted || cb.Encrypted() != tt.wantEncrypted {
+				t.Fatalf("encrypted = %v/%v, want %v", ca.Encrypted(), cb.Encrypted(), tt.wantEncrypted)
+			}
+
+			// 接收方先读到IA
+			got := make([]byte, len(ia))
+
+			if _, err := io.ReadFull(cb, got); err != nil || !bytes.Equal(got, ia) {
+				t.Fatalf("initial payload = %q, %v, want %q", got, err, ia)
+			}
+
+			// 握手后双向传输
+			for _, dir := range []struct {
+				w, r *Conn
+				msg  string
+			}{{ca, cb, "from initiator"}, {cb, ca, "from receiver"}} {
+				if _, err := dir.w.Write([]byte(dir.msg)); err != nil {
+					t.Fatal(err)
+				}
+
+				buf := make([]byte, len(dir.msg))
+
+				if _, err := io.ReadFull(dir.r, buf); err != nil || string(buf) != dir.msg {
+					t.Fatalf("read %q, %v, want %q", buf, err, dir.msg)
+				}
+			}
+		})
+	}
+}
+
+// 未加密的BitTorrent握手
+func TestAcceptPlaintext(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		wantErr bool
+	}{
+		{Disabled, false},
+		{Preferred, false},
+		{Required, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			a, b := bufferedPipe(t)
+
+			hs := append(append([]byte{}, btProtocol...), "rest of handshake"...)
+			a.Write(hs)
+
+			c, err := Accept(b, tt.policy, func([20]byte) ([20]byte, bool) { return [20]byte{}, false })
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Accept() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			// 已经读取的协议头通过Read返回
+			got := make([]byte, len(hs))
+
+			if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, hs) {
+				t.Errorf("read %q, %v, want %q", got, err, hs)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		provide uint32
+		want    uint32
+	}{
+		{Preferred, CryptoRC4 | CryptoPlaintext, CryptoRC4},
+		{Preferred, CryptoPlaintext, CryptoPlaintext},
+		{Required, CryptoRC4 | CryptoPlaintext, CryptoRC4},
+		{Required, CryptoPlaintext, 0},
+		{Preferred, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.Select(tt.provide); got != tt.want {
+			t.Errorf("%s.Select(%d) = %d, want %d", tt.policy, tt.provide, got, tt.want)
+		}
+	}
+
+	for _, p := range []Policy{Disabled, Preferred, Required} {
+		if got, err := ParsePolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParsePolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+
+	if _, err := ParsePolicy("rc4"); err == nil {
+		t.Error("ParsePolicy accepted an unknown policy")
+	}
+}
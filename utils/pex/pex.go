@@ -0,0 +1,418 @@
+package pex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	Name = "ut_pex" // 扩展名称
+
+	Interval = time.Minute // 向每个peer发送pex消息的周期
+
+	minRecvInterval = 45 * time.Second // 短于该间隔收到的pex消息会被忽略
+	maxAddedPerMsg  = 50               // 每条消息最多发送/接受的新增peer数
+	maxDroppedPeers = 50
+)
+
+// added.f 中每个peer的标志位
+const (
+	FlagEncryption = 0x01 // 偏好加密连接
+	FlagSeed       = 0x02 // 做种或只上传
+	FlagUTP        = 0x04 // 支持uTP
+	FlagHolepunch  = 0x08 // 支持ut_holepunch
+	FlagReachable  = 0x10 // 主动连接成功, 即该peer可以被连接
+)
+
+const holepunchName = "ut_holepunch"
+
+// pex消息
+type pexMsg struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// 每个连接的pex状态
+type peerState struct {
+	sent     map[string]sentPeer // 已经告知该peer的连接
+	lastRecv time.Time
+}
+
+// 已经告知的连接以及当时的标志位, 标志位变化后重新告知
+type sentPeer struct {
+	peer  peers.Peer
+	flags byte
+}
+
+// ut_pex扩展(BEP 11)
+//
+// 主动连接的peer使用连接地址; 对端发起的连接使用扩展握手中的监听端口, 没有时不告知其他peer
+type Extension struct {
+	// 对端是否做种或只上传, 可以在任意goroutine中调用, 为nil时只根据扩展握手中的upload_only判断
+	Seed func(c *client.Client) bool
+
+	mu        sync.Mutex
+	connected map[string]connectedPeer
+	keys      map[*client.Client]string // 每个连接在connected中的key
+	states    map[*client.Client]*peerState
+	onPeers   func([]peers.Peer)
+}
+
+type connectedPeer struct {
+	peer peers.Peer
+	c    *client.Client
+}
+
+// onPeers用于接收其他peer告知的新peer
+func NewExtension(onPeers func([]peers.Peer)) *Extension {
+	return &Extension{
+		connected: make(map[string]connectedPeer),
+		keys:      make(map[*client.Client]string),
+		states:    make(map[*client.Client]*peerState),
+		onPeers:   onPeers,
+	}
+}
+
+func (e *Extension) Name() string {
+	return Name
+}
+
+// 连接当前的标志位, 对端可能之后成为seed或者声明upload_only, 每次发送时重新计算
+func (e *Extension) peerFlags(c *client.Client) byte {
+	var flags byte
+
+	hs := c.PeerExtensions()
+
+	if c.Encrypted() {
+		flags |= FlagEncryption
+	}
+
+	if (hs != nil && hs.UploadOnly == 1) || (e.Seed != nil && e.Seed(c)) {
+		flags |= FlagSeed
+	}
+
+	if c.OverUTP() {
+		flags |= FlagUTP
+	}
+
+	if hs != nil && hs.M[holepunchName] > 0 {
+		flags |= FlagHolepunch
+	}
+
+	// 只有主动连接成功才能确认对端可以被连接
+	if !c.Incoming {
+		flags |= FlagReachable
+	}
+
+	return flags
+}
+
+// 对端可以被连接的地址, 对端发起的连接只能使用扩展握手中的监听端口
+func listenAddr(c *client.Client, hs *client.ExtHandshake) (peers.Peer, bool) {
+	if !c.Incoming {
+		return c.Peer(), true
+	}
+
+	if hs == nil || hs.P <= 0 || hs.P > 65535 {
+		return peers.Peer{}, false
+	}
+
+	return peers.Peer{IP: c.Peer().IP, Port: uint(hs.P)}, true
+}
+
+// 记录或更新连接的地址, 调用时需要持有锁
+func (e *Extension) track(c *client.Client, hs *client.ExtHandshake) {
+	p, ok := listenAddr(c, hs)
+
+	if !ok {
+		return
+	}
+
+	key := p.String()
+
+	if old := e.keys[c]; old != "" && old != key {
+		delete(e.connected, old)
+	}
+
+	e.keys[c] = key
+	e.connected[key] = connectedPeer{peer: p, c: c}
+}
+
+// 记录已建立的连接, 扩展握手可能在连接建立之前已经收到
+func (e *Extension) OnConnect(c *client.Client) {
+	hs := c.PeerExtensions()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.keys[c] = ""
+
+	if c.SupportsExtension(Name) {
+		e.states[c] = &peerState{sent: make(map[string]sentPeer)}
+	}
+
+	e.track(c, hs)
+}
+
+func (e *Extension) OnClose(c *client.Client) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if key, ok := e.keys[c]; ok {
+		delete(e.connected, key)
+	}
+
+	delete(e.keys, c)
+	delete(e.states, c)
+}
+
+// 对端的扩展握手, 可能带有新的监听端口或upload_only
+func (e *Extension) OnHandshake(c *client.Client, hs *client.ExtHandshake) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// 连接建立之前收到的扩展握手由OnConnect处理
+	if _, ok := e.keys[c]; !ok {
+		return nil
+	}
+
+	if _, ok := e.states[c]; !ok {
+		e.states[c] = &peerState{sent: make(map[string]sentPeer)}
+	}
+
+	e.track(c, hs)
+
+	return nil
+}
+
+func (e *Extension) OnMessage(c *client.Client, payload []byte) error {
+	e.mu.Lock()
+
+	state, ok := e.states[c]
+
+	// 限制每个peer发送pex消息的频率
+	if !ok || time.Since(state.lastRecv) < minRecvInterval {
+		e.mu.Unlock()
+		return nil
+	}
+
+	state.lastRecv = time.Now()
+	e.mu.Unlock()
+
+	msg := pexMsg{}
+
+	err := bencode.Unmarshal(bytes.NewReader(payload), &msg)
+
+	if err != nil {
+		return err
+	}
+
+	added := append(decodePeers(msg.Added, 6), decodePeers(msg.Added6, 18)...)
+
+	valid := make([]peers.Peer, 0, len(added))
+
+	for _, p := range added {
+		if len(valid) >= maxAddedPerMsg {
+			break
+		}
+
+		if sanePeer(p, c) {
+			valid = append(valid, p)
+		}
+	}
+
+	if len(valid) > 0 && e.onPeers != nil {
+		e.onPeers(valid)
+	}
+
+	return nil
+}
+
+// 过滤明显无效的peer
+func sanePeer(p peers.Peer, from *client.Client) bool {
+	if p.Port == 0 || p.IP.IsUnspecified() || p.IP.IsMulticast() || p.IP.Equal(net.IPv4bcast) {
+		return false
+	}
+
+	// 只有来自本机的peer才可以告知本机地址
+	if p.IP.IsLoopback() && !from.Peer().IP.IsLoopback() {
+		return false
+	}
+
+	// 忽略本地连接地址
+	if local, ok := from.Conn.LocalAddr().(*net.TCPAddr); ok {
+		if local.IP.Equal(p.IP) && local.Port == int(p.Port) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// 解析compact格式的peer列表, size为6(ipv4)或18(ipv6)
+func decodePeers(s string, size int) []peers.Peer {
+	res := make([]peers.Peer, 0, len(s)/size)
+
+	for i := 0; i+size <= len(s); i += size {
+		ip := make(net.IP, size-2)
+		copy(ip, s[i:i+size-2])
+
+		port := binary.BigEndian.Uint16([]byte(s[i+size-2 : i+size]))
+
+		res = append(res, peers.Peer{IP: ip, Port: uint(port)})
+	}
+
+	return res
+}
+
+func encodePeer(p peers.Peer) (string, bool) {
+	ip := p.IP.To4()
+	v6 := false
+
+	if ip == nil {
+		ip = p.IP.To16()
+		v6 = true
+	}
+
+	buf := make([]byte, len(ip)+2)
+
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], uint16(p.Port))
+
+	return string(buf), v6
+}
+
+// 生成发送给c的消息, 包含上次发送之后新增, 标志位变化以及断开的连接
+//
+// flags为每个连接当前的标志位, 调用时需要持有锁
+func (e *Extension) diff(c *client.Client, state *peerState, flags map[*client.Client]byte) *pexMsg {
+	msg := &pexMsg{}
+
+	self := e.keys[c]
+	count := 0
+
+	for key, cp := range e.connected {
+		// 计算标志位之后才建立的连接下次再告知
+		f, known := flags[cp.c]
+
+		if sent, ok := state.sent[key]; (ok && sent.flags == f) || key == self || !known {
+			continue
+		}
+
+		if count >= maxAddedPerMsg {
+			break
+		}
+
+		count++
+		state.sent[key] = sentPeer{peer: cp.peer, flags: f}
+
+		addr, v6 := encodePeer(cp.peer)
+
+		if v6 {
+			msg.Added6 += addr
+			msg.Added6F += string([]byte{f})
+		} else {
+			msg.Added += addr
+			msg.AddedF += string([]byte{f})
+		}
+	}
+
+	count = 0
+
+	for key, sent := range state.sent {
+		if _, ok := e.connected[key]; ok {
+			continue
+		}
+
+		if count >= maxDroppedPeers {
+			break
+		}
+
+		count++
+		delete(state.sent, key)
+
+		addr, v6 := encodePeer(sent.peer)
+
+		if v6 {
+			msg.Dropped6 += addr
+		} else {
+			msg.Dropped += addr
+		}
+	}
+
+	if *msg == (pexMsg{}) {
+		return nil
+	}
+
+	return msg
+}
+
+// 定期向所有支持ut_pex的peer发送pex消息, 直到stop关闭
+func (e *Extension) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		msgs := e.messages()
+
+		for c, msg := range msgs {
+			var buf bytes.Buffer
+
+			if err := bencode.Marshal(&buf, *msg); err != nil {
+				continue
+			}
+
+			c.SendExtended(Name, buf.Bytes())
+		}
+	}
+}
+
+// 生成发送给每个peer的消息
+func (e *Extension) messages() map[*client.Client]*pexMsg {
+	e.mu.Lock()
+
+	conns := make([]*client.Client, 0, len(e.connected))
+
+	for _, cp := range e.connected {
+		conns = append(conns, cp.c)
+	}
+
+	e.mu.Unlock()
+
+	// Seed可能需要其他锁, 在持有锁之前计算
+	flags := make(map[*client.Client]byte, len(conns))
+
+	for _, c := range conns {
+		flags[c] = e.peerFlags(c)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	msgs := make(map[*client.Client]*pexMsg, len(e.states))
+
+	for c, state := range e.states {
+		if msg := e.diff(c, state, flags); msg != nil {
+			msgs[c] = msg
+		}
+	}
+
+	return msgs
+}
@@ -0,0 +1,192 @@
+package pex
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/handshake"
+	"cpipi1024.com/turtleDownloader/utils/message"
+	"cpipi1024.com/turtleDownloader/utils/peers"
+)
+
+// 远端地址为ip的net.Pipe
+type pipeConn struct {
+	net.Conn
+	raddr *net.TCPAddr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// 对端发起的支持ut_pex的连接, 扩展握手中的监听端口为port
+func testClient(t *testing.T, e *Extension, ip string, port int) *client.Client {
+	t.Helper()
+
+	local, remote := net.Pipe()
+
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	go func() {
+		if _, err := handshake.ReadHandShake(remote); err != nil {
+			return
+		}
+
+		// 本地同时发送bitfield和扩展握手
+		go io.Copy(io.Discard, remote)
+
+		hs := fmt.Sprintf("d1:md6:ut_pexi1ee1:pi%dee", port)
+
+		remote.Write(message.FormatExtended(0, []byte(hs)).Serialize())
+		remote.Write((&message.Message{ID: message.MsgHaveNone}).Serialize())
+	}()
+
+	registry := client.NewRegistry()
+	registry.Register(e)
+
+	conn := &pipeConn{Conn: local, raddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}}
+	cfg := &client.Config{NumPieces: 8, Registry: registry}
+
+	c, err := client.Accept(conn, handshake.New([20]byte{}, [20]byte{1}), cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// 消息中新增的peer及其标志位, 以及断开的peer
+func decodeMsg(msg *pexMsg) (added map[string]byte, dropped []string) {
+	added = make(map[string]byte)
+
+	if msg == nil {
+		return added, nil
+	}
+
+	for i, p := range decodePeers(msg.Added, 6) {
+		added[p.String()] = msg.AddedF[i]
+	}
+
+	for _, p := range decodePeers(msg.Dropped, 6) {
+		dropped = append(dropped, p.String())
+	}
+
+	sort.Strings(dropped)
+
+	return added, dropped
+}
+
+func TestDiff(t *testing.T) {
+	e := NewExtension(nil)
+
+	var mu sync.Mutex
+	seeds := make(map[*client.Client]bool)
+
+	e.Seed = func(c *client.Client) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return seeds[c]
+	}
+
+	a := testClient(t, e, "10.0.0.1", 6881)
+	b := testClient(t, e, "10.0.0.2", 6882)
+	c := testClient(t, e, "10.0.0.3", 6883)
+
+	steps := []struct {
+		name        string
+		change      func()
+		wantAdded   map[string]byte
+		wantDropped []string
+	}{
+		{
+			name:      "initial",
+			wantAdded: map[string]byte{"10.0.0.2:6882": 0, "10.0.0.3:6883": 0},
+		},
+		{
+			name: "nothing changed",
+		},
+		{
+			name: "peer became a seed",
+			change: func() {
+				mu.Lock()
+				seeds[b] = true
+				mu.Unlock()
+			},
+			wantAdded: map[string]byte{"10.0.0.2:6882": FlagSeed},
+		},
+		{
+			name: "peer became upload only",
+			change: func() {
+				if err := c.Handle(message.FormatExtended(0, []byte("d11:upload_onlyi1ee"))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantAdded: map[string]byte{"10.0.0.3:6883": FlagSeed},
+		},
+		{
+			name:        "peer disconnected",
+			change:      func() { b.Close() },
+			wantDropped: []string{"10.0.0.2:6882"},
+		},
+	}
+
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+
+		added, dropped := decodeMsg(e.messages()[a])
+
+		if step.wantAdded == nil {
+			step.wantAdded = map[string]byte{}
+		}
+
+		if fmt.Sprint(added) != fmt.Sprint(step.wantAdded) {
+			t.Errorf("%s: added = %v, want %v", step.name, added, step.wantAdded)
+		}
+
+		if fmt.Sprint(dropped) != fmt.Sprint(step.wantDropped) {
+			t.Errorf("%s: dropped = %v, want %v", step.name, dropped, step.wantDropped)
+		}
+	}
+}
+
+func TestSanePeer(t *testing.T) {
+	e := NewExtension(nil)
+	remote := testClient(t, e, "10.0.0.1", 6881)
+	local := testClient(t, e, "127.0.0.1", 6881)
+
+	tests := []struct {
+		name string
+		from *client.Client
+		peer peers.Peer
+		want bool
+	}{
+		{name: "valid", from: remote, peer: peers.Peer{IP: net.ParseIP("8.8.8.8"), Port: 6881}, want: true},
+		{name: "ipv6", from: remote, peer: peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, want: true},
+		{name: "port 0", from: remote, peer: peers.Peer{IP: net.ParseIP("8.8.8.8")}},
+		{name: "unspecified", from: remote, peer: peers.Peer{IP: net.IPv4zero, Port: 6881}},
+		{name: "multicast", from: remote, peer: peers.Peer{IP: net.ParseIP("239.192.152.143"), Port: 6881}},
+		{name: "broadcast", from: remote, peer: peers.Peer{IP: net.IPv4bcast, Port: 6881}},
+		{name: "loopback from remote peer", from: remote, peer: peers.Peer{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+		{name: "loopback from local peer", from: local, peer: peers.Peer{IP: net.ParseIP("127.0.0.1"), Port: 6882}, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := sanePeer(tt.peer, tt.from); got != tt.want {
+			t.Errorf("%s: sanePeer(%s) = %v, want %v", tt.name, tt.peer, got, tt.want)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 
 	"github.com/jackpal/bencode-go"
 )
@@ -17,23 +19,17 @@ type bencodeInfo struct {
 	Name        string `bencode:"name"`         // 资源名称
 }
 
-// 生成info_hash
-func (bi *bencodeInfo) hash() ([20]byte, error) {
-	//todo: 根据meta info 生成 infohash
-
+// bencode编码的info字典
+func (bi *bencodeInfo) encode() ([]byte, error) {
 	var buf bytes.Buffer
 
 	err := bencode.Marshal(&buf, *bi)
 
 	if err != nil {
-		return [20]byte{}, err
+		return nil, err
 	}
 
-	// 根据info信息生成sha1校验值
-	infoHash := sha1.Sum(buf.Bytes())
-
-	return infoHash, nil
-
+	return buf.Bytes(), nil
 }
 
 // 生成pieceHashes
@@ -72,12 +68,15 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 
 	announce := bto.Announce
 
-	infohash, err := bto.Info.hash()
+	info, err := bto.Info.encode()
 
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
+	// 根据info信息生成sha1校验值
+	infohash := sha1.Sum(info)
+
 	pieceHashes, err := bto.Info.splitePieces()
 
 	if err != nil {
@@ -91,16 +90,56 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 		PieceLength: bto.Info.PieceLength,
 		Length:      bto.Info.Length,
 		Name:        bto.Info.Name,
+		Info:        info,
 	}
 
 	return tf, nil
 }
 
+// 根据info字典生成torrentFile对象, 用于没有.torrent文件的情况(如通过ut_metadata获取)
+func FromInfo(info []byte) (TorrentFile, error) {
+	bi := bencodeInfo{}
+
+	err := bencode.Unmarshal(bytes.NewReader(info), &bi)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	pieceHashes, err := bi.splitePieces()
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	tf := TorrentFile{
+		InfoHash:    sha1.Sum(info),
+		PieceHashes: pieceHashes,
+		PieceLength: bi.PieceLength,
+		Length:      bi.Length,
+		Name:        bi.Name,
+		Info:        info,
+	}
+
+	return tf, nil
+}
+
+// 将info字典保存为.torrent文件
+func WriteTorrent(path string, info []byte) error {
+	var buf bytes.Buffer
+
+	buf.WriteString("d4:info")
+	buf.Write(info)
+	buf.WriteString("e")
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
 // 读取.torrent种子文件,生成torrentFile对象
 func Open(path string) (TorrentFile, error) {
 	//todo: 读取.torrent 文件生成torrentFile文件
 
-	r, err := os.OpenFile(path, os.O_RDONLY, 0777)
+	data, err := os.ReadFile(path)
 
 	if err != nil {
 		return TorrentFile{}, err
@@ -108,11 +147,59 @@ func Open(path string) (TorrentFile, error) {
 
 	bto := bencodeTorrent{}
 
-	err = bencode.Unmarshal(r, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	tf, err := bto.toTorrentFile()
 
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	return bto.toTorrentFile()
+	tf.Nodes = parseNodes(data)
+
+	return tf, nil
+}
+
+// 解析.torrent文件中的nodes字段
+//
+// nodes是由[host, port]组成的列表, 无法直接Unmarshal到结构体中
+func parseNodes(data []byte) []string {
+	v, err := bencode.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil
+	}
+
+	dict, ok := v.(map[string]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	list, _ := dict["nodes"].([]interface{})
+
+	nodes := make([]string, 0, len(list))
+
+	for _, item := range list {
+		pair, ok := item.([]interface{})
+
+		if !ok || len(pair) != 2 {
+			continue
+		}
+
+		host, ok := pair[0].(string)
+		port, ok2 := pair[1].(int64)
+
+		if !ok || !ok2 {
+			continue
+		}
+
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+
+	return nodes
 }
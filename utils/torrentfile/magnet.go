@@ -0,0 +1,100 @@
+package torrentfile
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cpipi1024.com/turtleDownloader/utils/dht"
+)
+
+// BEP 9 magnet链接: magnet:?xt=urn:btih:<infohash>&tr=<tracker>
+type MagnetLink struct {
+	InfoHash [20]byte
+	Name     string   // dn参数, 只用于显示
+	Trackers []string // tr参数
+}
+
+// 是否为BEP 46可变torrent的链接, 需要通过FollowMutable下载
+func IsMutableMagnet(link string) bool {
+	u, err := url.Parse(link)
+
+	if err != nil || u.Scheme != "magnet" {
+		return false
+	}
+
+	return strings.HasPrefix(u.Query().Get("xs"), "urn:btpk:")
+}
+
+// 解析magnet链接, infohash可以是40位hex或32位base32
+func ParseMagnet(link string) (*MagnetLink, error) {
+	u, err := url.Parse(link)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %s", link)
+	}
+
+	params := u.Query()
+
+	var ih string
+
+	for _, xt := range params["xt"] {
+		if strings.HasPrefix(xt, "urn:btih:") {
+			ih = strings.TrimPrefix(xt, "urn:btih:")
+			break
+		}
+	}
+
+	if ih == "" {
+		return nil, fmt.Errorf("magnet link has no urn:btih: %s", link)
+	}
+
+	var hash []byte
+
+	switch len(ih) {
+	case 40:
+		hash, err = hex.DecodeString(ih)
+	case 32:
+		hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(ih))
+	default:
+		err = fmt.Errorf("invalid infohash length:%d", len(ih))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ml := &MagnetLink{
+		Name:     params.Get("dn"),
+		Trackers: params["tr"],
+	}
+
+	copy(ml.InfoHash[:], hash)
+
+	return ml, nil
+}
+
+// 通过DHT获取torrent信息, 链接中的第一个tracker用于之后的下载
+func (ml *MagnetLink) Fetch(node *dht.DHT) (TorrentFile, error) {
+	if node == nil {
+		return TorrentFile{}, fmt.Errorf("magnet link requires dht")
+	}
+
+	tf, err := FetchTorrent(ml.InfoHash, node)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	if len(ml.Trackers) > 0 {
+		tf.Announce = ml.Trackers[0]
+	}
+
+	return tf, nil
+}
@@ -0,0 +1,70 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const ih = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+	tests := []struct {
+		link     string
+		want     string
+		trackers []string
+		wantErr  bool
+	}{
+		{link: "magnet:?xt=urn:btih:" + ih + "&dn=test", want: ih},
+		{link: "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK", want: ih},
+		{link: "magnet:?xt=urn:btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek", want: ih},
+		{
+			link:     "magnet:?xt=urn:btih:" + ih + "&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Fother.example%3A80",
+			want:     ih,
+			trackers: []string{"http://tracker.example/announce", "udp://other.example:80"},
+		},
+		{link: "magnet:?xt=urn:sha1:" + ih, wantErr: true},
+		{link: "magnet:?xt=urn:btih:c12f", wantErr: true},
+		{link: "magnet:?xt=urn:btih:" + ih[:39] + "z", wantErr: true},
+		{link: "http://example.com/?xt=urn:btih:" + ih, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ml, err := ParseMagnet(tt.link)
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMagnet(%q) error = %v, wantErr %v", tt.link, err, tt.wantErr)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if got := hex.EncodeToString(ml.InfoHash[:]); got != tt.want {
+			t.Errorf("ParseMagnet(%q) infohash = %s, want %s", tt.link, got, tt.want)
+		}
+
+		if !reflect.DeepEqual(ml.Trackers, tt.trackers) {
+			t.Errorf("ParseMagnet(%q) trackers = %v, want %v", tt.link, ml.Trackers, tt.trackers)
+		}
+	}
+}
+
+// 只有urn:btpk链接作为可变torrent跟随
+func TestIsMutableMagnet(t *testing.T) {
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{"magnet:?xs=urn:btpk:8543d3e6115f0f98c944077a4493dcd543e49c739fd998550a1f614ab36ed63e&s=6e", true},
+		{"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", false},
+		{"test.torrent", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsMutableMagnet(tt.link); got != tt.want {
+			t.Errorf("IsMutableMagnet(%q) = %v, want %v", tt.link, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cpipi1024.com/turtleDownloader/utils/dht"
+	"cpipi1024.com/turtleDownloader/utils/metadata"
+)
+
+// BEP 46 可变torrent链接: magnet:?xs=urn:btpk:<公钥hex>&s=<salt hex>
+type MutableLink struct {
+	PublicKey [32]byte
+	Salt      []byte
+}
+
+// 解析可变torrent的magnet链接
+func ParseMutableMagnet(link string) (*MutableLink, error) {
+	u, err := url.Parse(link)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %s", link)
+	}
+
+	params := u.Query()
+
+	xs := params.Get("xs")
+
+	if !strings.HasPrefix(xs, "urn:btpk:") {
+		return nil, fmt.Errorf("magnet link has no urn:btpk: %s", link)
+	}
+
+	key, err := hex.DecodeString(strings.TrimPrefix(xs, "urn:btpk:"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid public key length:%d", len(key))
+	}
+
+	ml := &MutableLink{}
+	copy(ml.PublicKey[:], key)
+
+	if s := params.Get("s"); s != "" {
+		ml.Salt, err = hex.DecodeString(s)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ml, nil
+}
+
+// 通过DHT查找可变数据, 返回当前指向的infohash以及seq
+func (ml *MutableLink) Resolve(node *dht.DHT) ([20]byte, int64, error) {
+	var infohash [20]byte
+
+	item, err := node.GetMutable(ml.PublicKey, ml.Salt)
+
+	if err != nil {
+		return infohash, 0, err
+	}
+
+	v, ok := item.V.(map[string]interface{})
+
+	if !ok {
+		return infohash, 0, fmt.Errorf("mutable torrent item is not a dict")
+	}
+
+	ih, _ := v["ih"].(string)
+
+	if len(ih) != 20 {
+		return infohash, 0, fmt.Errorf("mutable torrent item has invalid ih")
+	}
+
+	copy(infohash[:], ih)
+
+	return infohash, item.Seq, nil
+}
+
+// 通过DHT查找peers并使用ut_metadata获取torrent信息
+func FetchTorrent(infohash [20]byte, node *dht.DHT) (TorrentFile, error) {
+	var peerId [20]byte
+
+	_, err := rand.Read(peerId[:])
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	ps, err := node.GetPeers(infohash)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	info, err := metadata.FetchFromPeers(ps, infohash, peerId)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	return FromInfo(info)
+}
+
+// 持续跟随可变torrent, 指向的infohash更新后下载新版本到path
+//
+// 新版本中与旧版本相同的piece直接从旧文件中复用
+func FollowMutable(ml *MutableLink, path string, opts Options, interval time.Duration) error {
+	node := opts.DHT
+
+	if node == nil {
+		return fmt.Errorf("mutable torrent requires dht")
+	}
+
+	var current *TorrentFile
+	var seq int64
+
+	for {
+		infohash, newSeq, err := ml.Resolve(node)
+
+		if err != nil {
+			log.Println("resolve mutable torrent failed:", err)
+		} else if current == nil || (newSeq > seq && infohash != current.InfoHash) {
+			log.Printf("mutable torrent points to %x seq:%d\n", infohash, newSeq)
+
+			tf, err := followUpdate(infohash, path, opts, current)
+
+			if err != nil {
+				log.Println("download mutable torrent failed:", err)
+			} else {
+				current = tf
+				seq = newSeq
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// 下载可变torrent的新版本
+func followUpdate(infohash [20]byte, path string, opts Options, prev *TorrentFile) (*TorrentFile, error) {
+	tf, err := FetchTorrent(infohash, opts.DHT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tf.download(path, opts, tf.reusePieces(prev, path))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tf, nil
+}
+
+// 从path中的旧版本文件找出与当前版本hash相同的piece
+func (t *TorrentFile) reusePieces(prev *TorrentFile, path string) map[int][]byte {
+	if prev == nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil
+	}
+
+	prevPieces := make(map[[20]byte]int, len(prev.PieceHashes))
+
+	for i, hash := range prev.PieceHashes {
+		prevPieces[hash] = i
+	}
+
+	reuse := make(map[int][]byte)
+
+	for i, hash := range t.PieceHashes {
+		j, ok := prevPieces[hash]
+
+		if !ok {
+			continue
+		}
+
+		begin := j * prev.PieceLength
+		end := begin + prev.PieceLength
+
+		if end > prev.Length {
+			end = prev.Length
+		}
+
+		if end <= len(data) {
+			reuse[i] = data[begin:end]
+		}
+	}
+
+	return reuse
+}
@@ -0,0 +1,94 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 每pieceLength字节一个piece的torrent
+func testTorrent(data string, pieceLength int) *TorrentFile {
+	tf := &TorrentFile{PieceLength: pieceLength, Length: len(data)}
+
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+
+		if end > len(data) {
+			end = len(data)
+		}
+
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum([]byte(data[begin:end])))
+	}
+
+	return tf
+}
+
+func TestReusePieces(t *testing.T) {
+	const prevData = "aaaabbbbcccc12"
+
+	tests := []struct {
+		name string
+		file string // path中的文件内容, 为空时不创建
+		next string
+		want map[int]string
+	}{
+		{
+			name: "moved and unchanged pieces",
+			file: prevData,
+			next: "bbbbxxxxaaaa12",
+			want: map[int]string{0: "bbbb", 2: "aaaa", 3: "12"},
+		},
+		{
+			name: "nothing in common",
+			file: prevData,
+			next: "xxxxyyyy",
+			want: map[int]string{},
+		},
+		{
+			name: "truncated file",
+			file: prevData[:6],
+			next: "aaaabbbb",
+			want: map[int]string{0: "aaaa"},
+		},
+		{
+			name: "missing file",
+			next: prevData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data")
+
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			prev := testTorrent(prevData, 4)
+			next := testTorrent(tt.next, 4)
+
+			var got map[int]string
+
+			if reuse := next.reusePieces(prev, path); reuse != nil {
+				got = make(map[int]string)
+
+				for i, data := range reuse {
+					got[i] = string(data)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reusePieces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 没有旧版本时不复用
+	if reuse := testTorrent(prevData, 4).reusePieces(nil, "unused"); reuse != nil {
+		t.Errorf("reusePieces(nil) = %v, want nil", reuse)
+	}
+}
@@ -2,19 +2,28 @@ package torrentfile
 
 import (
 	"crypto/rand"
+	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"cpipi1024.com/turtleDownloader/client"
+	"cpipi1024.com/turtleDownloader/utils/dht"
 	"cpipi1024.com/turtleDownloader/utils/downloader"
+	"cpipi1024.com/turtleDownloader/utils/listener"
+	"cpipi1024.com/turtleDownloader/utils/lsd"
+	"cpipi1024.com/turtleDownloader/utils/metadata"
 	"cpipi1024.com/turtleDownloader/utils/peers"
+	"cpipi1024.com/turtleDownloader/utils/pex"
 	"github.com/jackpal/bencode-go"
 )
 
 const (
-	Port = 6881
+	Port = 6881 // 没有监听时向tracker和DHT报告的默认端口
 )
 
 // BT tracker响应对象
@@ -30,36 +39,192 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Nodes       []string // .torrent文件中的DHT节点 host:port
+	Info        []byte   // bencode编码的info字典, 通过ut_metadata提供给其他peer
 }
 
-func (t *TorrentFile) DownLoad(path string) error {
-	var peerId [20]byte
+// 下载时使用的本地服务, 均可以为nil
+type Options struct {
+	DHT      *dht.DHT           // 通过DHT查找peers, 并在下载期间announce本地端口
+	LSD      *lsd.LSD           // 通过局域网组播发现peers
+	Listener *listener.Listener // 接受对端发起的连接
+	Seed     bool               // 下载完成后继续做种, 直到Stop关闭
+	Stop     <-chan struct{}    // 为nil时一直做种
 
-	_, err := rand.Read(peerId[:])
+	UploadSlots int // 同时上传的peer数, 为0时使用默认值
+	MaxConns    int // 每个torrent的连接数, 为0时使用默认值
 
-	if err != nil {
-		return err
+	SuperSeed bool         // 已有完整数据时使用super-seeding做初始做种
+	Skip      map[int]bool // 不需要下载的piece, 由SkipPieces生成, 下载完成后作为partial seed只上传已有的piece
+	Saved     func()       // 文件写入path之后调用, 可以为nil
+}
+
+// 向tracker和DHT报告的端口
+func (o Options) port() int {
+	if o.Listener != nil {
+		return o.Listener.Port()
 	}
 
-	peers, err := t.requestPeers(peerId, Port)
+	return Port
+}
+
+// 根据需要下载的piece列表生成Skip, 列表形如"0-99,150,200-", 为空时下载所有piece
+func (t *TorrentFile) SkipPieces(list string) (map[int]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	n := len(t.PieceHashes)
+	wanted := make(map[int]bool)
+
+	for _, part := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+
+		first, err := strconv.Atoi(from)
+
+		if err != nil || first < 0 || first >= n {
+			err := fmt.Errorf("invalid piece %q in %q, torrent has %d pieces", from, list, n)
+			return nil, err
+		}
+
+		last := first
+
+		switch {
+		case isRange && to == "":
+			last = n - 1
+		case isRange:
+			last, err = strconv.Atoi(to)
+
+			if err != nil || last < first || last >= n {
+				err := fmt.Errorf("invalid piece range %q in %q, torrent has %d pieces", part, list, n)
+				return nil, err
+			}
+		}
+
+		for i := first; i <= last; i++ {
+			wanted[i] = true
+		}
+	}
+
+	skip := make(map[int]bool)
+
+	for i := 0; i < n; i++ {
+		if !wanted[i] {
+			skip[i] = true
+		}
+	}
+
+	return skip, nil
+}
+
+// 下载文件到path
+func (t *TorrentFile) DownLoad(path string, opts Options) error {
+	return t.download(path, opts, nil)
+}
+
+// 复用path中已有的数据, 下载缺少的piece后继续做种
+func (t *TorrentFile) Seed(path string, opts Options) error {
+	opts.Seed = true
+
+	return t.download(path, opts, t.reusePieces(t, path))
+}
+
+// reuse为已有的piece数据, 校验通过的piece不会再从peers下载
+func (t *TorrentFile) download(path string, opts Options, reuse map[int][]byte) error {
+	var peerId [20]byte
+
+	_, err := rand.Read(peerId[:])
+
 	if err != nil {
 		return err
 	}
 
 	torrent := &downloader.Torrent{
-		Peers:       peers,
 		PeerID:      peerId,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Existing:    reuse,
+		Skip:        opts.Skip,
+		Seed:        opts.Seed,
+		UploadSlots: opts.UploadSlots,
+		MaxConns:    opts.MaxConns,
+		SuperSeed:   opts.SuperSeed,
+	}
+
+	left := t.Length
+
+	for _, data := range reuse {
+		left -= len(data)
+	}
+
+	// 局域网peer最先加入, 开始下载时优先连接
+	if opts.LSD != nil {
+		opts.LSD.Announce(t.InfoHash, func(p peers.Peer) {
+			log.Printf("found lan peer %s\n", p)
+			torrent.AddPeers([]peers.Peer{p})
+		})
+
+		defer opts.LSD.StopAnnounce(t.InfoHash)
+	}
+
+	// 没有tracker的torrent只能通过DHT或LSD查找peers
+	if t.Announce != "" {
+		var trackerPeers []peers.Peer
+
+		trackerPeers, err = t.requestPeers(peerId, uint(opts.port()), left, "")
+		torrent.AddPeers(trackerPeers)
+	} else {
+		err = fmt.Errorf("torrent %s has no tracker", t.Name)
+	}
+
+	if err != nil {
+		if opts.DHT == nil && opts.LSD == nil {
+			return err
+		}
+
+		log.Println("request tracker failed:", err)
+	}
+
+	if opts.DHT != nil {
+		torrent.AddPeers(t.dhtPeers(opts.DHT))
+
+		opts.DHT.Announce(t.InfoHash, opts.port())
+		defer opts.DHT.StopAnnounce(t.InfoHash)
+	}
+
+	// 通过ut_pex获取的peers加入到下载中
+	pexExt := pex.NewExtension(torrent.AddPeers)
+	pexExt.Seed = torrent.PeerSeed
+
+	torrent.Registry = client.NewRegistry()
+	torrent.Registry.Port = opts.port()
+	torrent.Registry.Reqq = downloader.MaxPeerRequests
+	torrent.Registry.UploadOnly = torrent.UploadOnly
+	torrent.Registry.Register(pexExt)
+
+	// 向通过magnet链接下载的peer提供metadata
+	if len(t.Info) > 0 {
+		torrent.Registry.MetadataSize = len(t.Info)
+		torrent.Registry.Register(metadata.NewExtension(t.InfoHash, t.Info))
+	}
+
+	if opts.Listener != nil {
+		opts.Listener.Add(torrent.Config(), torrent.AddConn)
+		defer opts.Listener.Remove(t.InfoHash)
 	}
 
+	stopPex := make(chan struct{})
+	defer close(stopPex)
+
+	go pexExt.Run(stopPex)
+
 	buf, err := torrent.Download()
 
 	if err != nil {
-		return nil
+		return err
 	}
 
 	outfile, err := os.Create(path)
@@ -74,11 +239,62 @@ func (t *TorrentFile) DownLoad(path string) error {
 		return err
 	}
 
+	if opts.Saved != nil {
+		opts.Saved()
+	}
+
+	if opts.Seed {
+		log.Printf("seeding %s\n", t.Name)
+
+		if len(opts.Skip) > 0 && torrent.UploadOnly() {
+			t.announcePaused(torrent, peerId, opts.port())
+		}
+
+		defer torrent.Stop()
+
+		<-opts.Stop
+	}
+
 	return nil
 }
 
+// 只下载了部分piece的partial seed通知tracker不再下载 (BEP 21)
+//
+// 不支持的tracker会按普通announce处理
+func (t *TorrentFile) announcePaused(torrent *downloader.Torrent, peerID [20]byte, port int) {
+	if t.Announce == "" {
+		return
+	}
+
+	left := 0
+	have := torrent.BitField()
+
+	for i := range t.PieceHashes {
+		if have.HasPiece(i) {
+			continue
+		}
+
+		if size := t.Length - i*t.PieceLength; size < t.PieceLength {
+			left += size
+		} else {
+			left += t.PieceLength
+		}
+	}
+
+	_, err := t.requestPeers(peerID, uint(port), left, "paused")
+
+	if err != nil {
+		log.Println("announce paused failed:", err)
+		return
+	}
+
+	log.Printf("announced %s as a partial seed\n", t.Name)
+}
+
 // 构建tracker地址
-func (t *TorrentFile) builTrackerURL(peerID [20]byte, port uint) (string, error) {
+//
+// event为空时不发送event参数
+func (t *TorrentFile) builTrackerURL(peerID [20]byte, port uint, left int, event string) (string, error) {
 	//todo: 根据 announce生成bt trakcer请求
 
 	// announce "http:xxxbttracker.com:port/source"
@@ -95,7 +311,11 @@ func (t *TorrentFile) builTrackerURL(peerID [20]byte, port uint) (string, error)
 		"uploaded":   []string{"0"},
 		"downloaded": []string{"0"},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.Itoa(left)},
+	}
+
+	if event != "" {
+		params.Set("event", event)
 	}
 
 	base.RawQuery = params.Encode()
@@ -105,8 +325,8 @@ func (t *TorrentFile) builTrackerURL(peerID [20]byte, port uint) (string, error)
 }
 
 // 向tracker请求peers
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint) ([]peers.Peer, error) {
-	url, err := t.builTrackerURL(peerID, port)
+func (t *TorrentFile) requestPeers(peerID [20]byte, port uint, left int, event string) ([]peers.Peer, error) {
+	url, err := t.builTrackerURL(peerID, port, left, event)
 
 	if err != nil {
 		return nil, err
@@ -136,3 +356,21 @@ func (t *TorrentFile) requestPeers(peerID [20]byte, port uint) ([]peers.Peer, er
 
 	return peers.Unmarshal(peersBytes)
 }
+
+// 通过DHT查找peers
+func (t *TorrentFile) dhtPeers(node *dht.DHT) []peers.Peer {
+	if len(t.Nodes) > 0 {
+		node.Bootstrap(t.Nodes)
+	}
+
+	res, err := node.GetPeers(t.InfoHash)
+
+	if err != nil {
+		log.Println("dht get peers failed:", err)
+		return nil
+	}
+
+	log.Printf("found %d peers from dht\n", len(res))
+
+	return res
+}
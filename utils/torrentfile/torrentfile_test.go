@@ -0,0 +1,100 @@
+package torrentfile
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSkipPieces(t *testing.T) {
+	tf := &TorrentFile{PieceHashes: make([][20]byte, 10)}
+
+	tests := []struct {
+		list    string
+		want    []int // 跳过的piece
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "0-9", want: []int{}},
+		{list: "0-4", want: []int{5, 6, 7, 8, 9}},
+		{list: "3", want: []int{0, 1, 2, 4, 5, 6, 7, 8, 9}},
+		{list: "0-2, 5, 8-", want: []int{3, 4, 6, 7}},
+		{list: "7-", want: []int{0, 1, 2, 3, 4, 5, 6}},
+		{list: "10", wantErr: true},
+		{list: "5-3", wantErr: true},
+		{list: "0-10", wantErr: true},
+		{list: "-3", wantErr: true},
+		{list: "a", wantErr: true},
+		{list: "1,,2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			skip, err := tf.SkipPieces(tt.list)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SkipPieces(%q) error = %v, wantErr %v", tt.list, err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if tt.want == nil {
+				if skip != nil {
+					t.Errorf("SkipPieces(%q) = %v, want nil", tt.list, skip)
+				}
+
+				return
+			}
+
+			got := []int{}
+
+			for i := range tf.PieceHashes {
+				if skip[i] {
+					got = append(got, i)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SkipPieces(%q) skips %v, want %v", tt.list, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerURLEvent(t *testing.T) {
+	tf := &TorrentFile{Announce: "http://tracker.example/announce"}
+
+	tests := []struct {
+		event string
+		want  []string
+	}{
+		{event: "", want: nil},
+		{event: "paused", want: []string{"paused"}},
+	}
+
+	for _, tt := range tests {
+		raw, err := tf.builTrackerURL([20]byte{1}, 6881, 100, tt.event)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, err := url.Parse(raw)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := u.Query()
+
+		if got := q["event"]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("event = %v, want %v", got, tt.want)
+		}
+
+		if q.Get("left") != "100" || q.Get("port") != "6881" {
+			t.Errorf("query = %v", q)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	recvBufferSize = 1024 * 1024 // 接收缓冲区大小, 作为通告窗口
+	maxOutstanding = 1024        // 最多未确认的报文数
+	maxRetransmits = 8           // 超过重传次数后断开连接
+	synRetransmits = 3
+	dupAckThresh   = 3 // 收到3个重复ack或sack跳过3个报文时认为丢包
+	finLinger      = 10 * time.Second
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+// 连接状态
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+// 已发送但未确认的报文
+type outPacket struct {
+	typ           int
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	acked         bool // 通过selective ack确认
+}
+
+// uTP连接, 实现net.Conn
+type Conn struct {
+	s      *Socket
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	mu      sync.Mutex
+	wmu     sync.Mutex    // 保证一次Write的数据连续发送
+	changed chan struct{} // 状态变化时关闭并替换, 唤醒等待的读写
+	state   int
+	err     error
+
+	// 发送
+	seqNr    uint16 // 下一个报文的序号
+	outbuf   []*outPacket
+	inFlight int
+	peerWnd  int
+	lastAck  uint16
+	dupAcks  int
+	cc       *ledbat
+	finSent  bool
+	closedAt time.Time
+
+	// 接收
+	initSeq    uint16 // 回复SYN时使用的序号, 重复的SYN需要相同的回复
+	initAck    uint16 // SYN的序号
+	ackNr      uint16 // 最后一个按序收到的报文
+	inbuf      []byte
+	ooo        map[uint16]*inPacket
+	replyMicro uint32 // 回复给对端的单向延迟
+	finRecv    bool
+	finSeq     uint16
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type inPacket struct {
+	typ     int
+	payload []byte
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:       s,
+		raddr:   raddr,
+		recvID:  recvID,
+		sendID:  sendID,
+		changed: make(chan struct{}),
+		peerWnd: recvBufferSize,
+		cc:      newLedbat(),
+		ooo:     make(map[uint16]*inPacket),
+	}
+}
+
+// 唤醒所有等待中的读写, 调用时需要持有锁
+func (c *Conn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// 等待状态变化或deadline, 调用时需要持有锁, 返回时仍持有锁
+func (c *Conn) wait(deadline time.Time) error {
+	ch := c.changed
+
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// 发送SYN
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateSynSent
+	c.seqNr = 1
+
+	c.queue(stSyn, nil)
+}
+
+func (c *Conn) waitConnected(deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.state == stateSynSent {
+		if err := c.wait(deadline); err != nil {
+			return err
+		}
+	}
+
+	return c.err
+}
+
+// 处理对端的SYN
+func (c *Conn) accepted(h *header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b [2]byte
+	rand.Read(b[:])
+
+	c.state = stateConnected
+	c.seqNr = binary.BigEndian.Uint16(b[:])
+	c.initSeq = c.seqNr
+	c.initAck = h.seqNr
+	c.ackNr = h.seqNr
+	c.lastAck = c.seqNr - 1
+	c.peerWnd = int(h.wndSize)
+	c.replyMicro = nowMicro() - h.timestamp
+
+	c.sendState()
+}
+
+// 本地接收窗口剩余字节数
+func (c *Conn) recvWindow() uint32 {
+	used := len(c.inbuf)
+
+	for _, p := range c.ooo {
+		used += len(p.payload)
+	}
+
+	if used >= recvBufferSize {
+		return 0
+	}
+
+	return uint32(recvBufferSize - used)
+}
+
+func (c *Conn) header(typ int, seqNr uint16) *header {
+	h := &header{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: nowMicro(),
+		tsDiff:    c.replyMicro,
+		wndSize:   c.recvWindow(),
+		seqNr:     seqNr,
+		ackNr:     c.ackNr,
+	}
+
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+
+	return h
+}
+
+// 根据乱序缓存生成selective ack
+func (c *Conn) selectiveAck() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+
+	mask := make([]byte, 4)
+
+	for i := 0; i < 32; i++ {
+		if _, ok := c.ooo[c.ackNr+2+uint16(i)]; ok {
+			mask[i/8] |= 1 << uint(i%8)
+		}
+	}
+
+	return mask
+}
+
+// 发送只包含ack的STATE报文, 不占用序号
+func (c *Conn) sendState() {
+	h := c.header(stState, c.seqNr)
+	h.sack = c.selectiveAck()
+
+	c.s.send(h.encode(nil), c.raddr)
+}
+
+// 重新回复SYN, 对端根据其中的序号确定我们的第一个报文
+func (c *Conn) resendSynAck() {
+	h := c.header(stState, c.initSeq)
+	h.ackNr = c.initAck
+
+	c.s.send(h.encode(nil), c.raddr)
+}
+
+// 发送占用序号的报文并加入重传队列
+func (c *Conn) queue(typ int, payload []byte) {
+	p := &outPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+
+	c.seqNr++
+	c.outbuf = append(c.outbuf, p)
+	c.inFlight += len(payload)
+
+	c.transmit(p, time.Now())
+}
+
+func (c *Conn) transmit(p *outPacket, now time.Time) {
+	p.sentAt = now
+	p.transmissions++
+
+	c.s.send(c.header(p.typ, p.seqNr).encode(p.payload), c.raddr)
+}
+
+// 处理收到的报文
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	now := time.Now()
+
+	if h.typ == stReset {
+		c.failLocked(ErrReset)
+		return
+	}
+
+	if h.typ == stSyn {
+		// 对端没有收到STATE
+		if h.seqNr == c.initAck {
+			c.resendSynAck()
+		}
+
+		return
+	}
+
+	c.replyMicro = nowMicro() - h.timestamp
+	c.peerWnd = int(h.wndSize)
+	c.cc.addDelay(h.tsDiff, now)
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+
+		// 对端的STATE携带其下一个报文的序号
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+
+	c.processAck(h, now)
+
+	switch h.typ {
+	case stData, stFin:
+		c.receive(h, payload)
+		c.sendState()
+	}
+
+	c.broadcast()
+}
+
+// 处理ack_nr和selective ack
+func (c *Conn) processAck(h *header, now time.Time) {
+	acked := 0
+
+	for len(c.outbuf) > 0 && !seqLess(h.ackNr, c.outbuf[0].seqNr) {
+		p := c.outbuf[0]
+		c.outbuf = c.outbuf[1:]
+
+		if !p.acked {
+			acked += len(p.payload)
+			c.inFlight -= len(p.payload)
+
+			c.sampleRTT(p, now)
+		}
+	}
+
+	// selective ack
+	sacked := 0
+
+	for i := 0; i < len(h.sack)*8; i++ {
+		if h.sack[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+
+		seq := h.ackNr + 2 + uint16(i)
+
+		for _, p := range c.outbuf {
+			if p.seqNr == seq && !p.acked {
+				p.acked = true
+				acked += len(p.payload)
+				c.inFlight -= len(p.payload)
+
+				c.sampleRTT(p, now)
+			}
+		}
+
+		sacked++
+	}
+
+	// 重复ack
+	if h.typ == stState && h.ackNr == c.lastAck && len(c.outbuf) > 0 {
+		c.dupAcks++
+	} else {
+		c.dupAcks = 0
+	}
+
+	c.lastAck = h.ackNr
+
+	c.cc.onAck(acked)
+
+	// 快速重传第一个未确认的报文
+	if len(c.outbuf) > 0 && (c.dupAcks >= dupAckThresh || sacked >= dupAckThresh) {
+		p := c.outbuf[0]
+
+		if !p.acked && now.Sub(p.sentAt) > c.cc.rtt {
+			c.cc.onLoss(now)
+			c.transmit(p, now)
+		}
+
+		c.dupAcks = 0
+	}
+}
+
+// 只用没有重传过的报文计算RTT, 每个报文只在第一次被确认时采样
+func (c *Conn) sampleRTT(p *outPacket, now time.Time) {
+	if p.transmissions == 1 {
+		c.cc.addRTT(now.Sub(p.sentAt))
+	}
+}
+
+// 按序交付数据
+func (c *Conn) receive(h *header, payload []byte) {
+	if h.typ == stFin {
+		c.finRecv = true
+		c.finSeq = h.seqNr
+	}
+
+	if !seqLess(c.ackNr, h.seqNr) {
+		// 重复的报文
+		return
+	}
+
+	if h.seqNr != c.ackNr+1 {
+		if len(c.ooo) < maxOutstanding && int(c.recvWindow()) >= len(payload) {
+			c.ooo[h.seqNr] = &inPacket{typ: h.typ, payload: payload}
+		}
+
+		return
+	}
+
+	c.deliver(h.typ, payload)
+
+	for {
+		p, ok := c.ooo[c.ackNr+1]
+
+		if !ok {
+			break
+		}
+
+		delete(c.ooo, c.ackNr+1)
+		c.deliver(p.typ, p.payload)
+	}
+}
+
+func (c *Conn) deliver(typ int, payload []byte) {
+	c.ackNr++
+	c.inbuf = append(c.inbuf, payload...)
+
+	if typ == stFin || (c.finRecv && c.ackNr == c.finSeq) {
+		c.eof = true
+	}
+}
+
+// 重传超时的报文, 返回true表示连接可以从socket中移除
+func (c *Conn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return true
+	}
+
+	// 本地关闭后等待FIN被确认
+	if c.finSent && (len(c.outbuf) == 0 || now.Sub(c.closedAt) > finLinger) {
+		c.failLocked(net.ErrClosed)
+		return true
+	}
+
+	for _, p := range c.outbuf {
+		if p.acked {
+			continue
+		}
+
+		if now.Sub(p.sentAt) < c.cc.timeout {
+			break
+		}
+
+		limit := maxRetransmits
+
+		if p.typ == stSyn {
+			limit = synRetransmits
+		}
+
+		if p.transmissions >= limit {
+			c.failLocked(ErrTimeout)
+			return true
+		}
+
+		c.cc.onTimeout()
+		c.transmit(p, now)
+
+		break
+	}
+
+	return false
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	c.broadcast()
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if len(c.inbuf) > 0 {
+			n := copy(b, c.inbuf)
+			c.inbuf = c.inbuf[n:]
+
+			return n, nil
+		}
+
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if c.state == stateClosed || c.finSent {
+			if c.err != nil && c.err != net.ErrClosed {
+				return 0, c.err
+			}
+
+			return 0, net.ErrClosed
+		}
+
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	// 等待窗口时会释放mu, 需要另一把锁防止并发的Write交错
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+
+	for written < len(b) {
+		if c.state == stateClosed || c.finSent {
+			if c.err != nil && c.err != net.ErrClosed {
+				return written, c.err
+			}
+
+			return written, net.ErrClosed
+		}
+
+		size := len(b) - written
+
+		if size > mss {
+			size = mss
+		}
+
+		// 拥塞窗口和对端接收窗口都允许时才发送
+		window := int(c.cc.window)
+
+		if c.peerWnd < window {
+			window = c.peerWnd
+		}
+
+		if c.inFlight > 0 && (c.inFlight+size > window || len(c.outbuf) >= maxOutstanding) {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return written, err
+			}
+
+			continue
+		}
+
+		payload := make([]byte, size)
+		copy(payload, b[written:])
+
+		c.queue(stData, payload)
+
+		written += size
+	}
+
+	return written, nil
+}
+
+// 发送FIN, 之后的读写都会返回错误
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != stateConnected || c.finSent {
+		c.failLocked(net.ErrClosed)
+		return nil
+	}
+
+	c.finSent = true
+	c.closedAt = time.Now()
+
+	c.queue(stFin, nil)
+	c.broadcast()
+
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.broadcast()
+
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.broadcast()
+
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.broadcast()
+
+	return nil
+}
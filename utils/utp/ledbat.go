@@ -0,0 +1,164 @@
+package utp
+
+import (
+	"time"
+)
+
+const (
+	mss = 1200 // 每个报文最多携带的数据, 避免IP分片
+
+	targetDelay      = 100 * time.Millisecond // LEDBAT目标排队延迟
+	maxCwndIncrease  = 3000                   // 每个RTT窗口最多增加的字节数
+	minWindow        = 2 * mss
+	maxWindow        = 1024 * 1024
+	baseDelayHistory = time.Minute // 每分钟记录一次最小延迟, 保留两分钟
+
+	minTimeout = 500 * time.Millisecond
+	maxTimeout = 30 * time.Second
+)
+
+// LEDBAT拥塞控制
+//
+// 根据对端测得的单向延迟与历史最小延迟之差调整窗口, 排队延迟超过目标值时缩小窗口,
+// 让uTP在链路繁忙时主动让出带宽
+type ledbat struct {
+	window float64 // 允许在途的字节数
+
+	// 最近两分钟的最小延迟
+	curMin, prevMin uint32
+	curStart        time.Time
+
+	lastDelay uint32 // 最近一次的延迟采样
+	lastLoss  time.Time
+
+	rtt, rttVar time.Duration
+	timeout     time.Duration
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{
+		window:  minWindow,
+		timeout: time.Second,
+	}
+}
+
+// 记录单向延迟采样, 由于双方时钟不同步只有差值有意义
+func (l *ledbat) addDelay(sample uint32, now time.Time) {
+	if sample == 0 {
+		return
+	}
+
+	l.lastDelay = sample
+
+	if l.curStart.IsZero() || now.Sub(l.curStart) > baseDelayHistory {
+		l.prevMin = l.curMin
+		l.curMin = sample
+		l.curStart = now
+
+		return
+	}
+
+	// 时钟回绕时差值为负, 此时直接使用新的采样
+	if int32(sample-l.curMin) < 0 {
+		l.curMin = sample
+	}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	if l.prevMin != 0 && int32(l.prevMin-l.curMin) < 0 {
+		return l.prevMin
+	}
+
+	return l.curMin
+}
+
+// 排队延迟, 即当前延迟减去基础延迟
+func (l *ledbat) queuingDelay() time.Duration {
+	if l.lastDelay == 0 {
+		return 0
+	}
+
+	d := int32(l.lastDelay - l.baseDelay())
+
+	if d < 0 {
+		d = 0
+	}
+
+	return time.Duration(d) * time.Microsecond
+}
+
+// 收到确认后根据排队延迟调整窗口
+func (l *ledbat) onAck(acked int) {
+	if acked <= 0 {
+		return
+	}
+
+	offTarget := float64(targetDelay - l.queuingDelay())
+	delayFactor := offTarget / float64(targetDelay)
+
+	windowFactor := float64(acked) / l.window
+
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+
+	l.window += maxCwndIncrease * delayFactor * windowFactor
+
+	l.clamp()
+}
+
+// 检测到丢包时窗口减半, 每个RTT最多一次
+func (l *ledbat) onLoss(now time.Time) {
+	if now.Sub(l.lastLoss) < l.rtt {
+		return
+	}
+
+	l.lastLoss = now
+	l.window /= 2
+
+	l.clamp()
+}
+
+// 超时后窗口重置为最小值, 超时时间加倍
+func (l *ledbat) onTimeout() {
+	l.window = minWindow
+
+	l.timeout *= 2
+
+	if l.timeout > maxTimeout {
+		l.timeout = maxTimeout
+	}
+}
+
+// 根据RTT采样更新超时时间, 与TCP相同
+func (l *ledbat) addRTT(sample time.Duration) {
+	if l.rtt == 0 {
+		l.rtt = sample
+		l.rttVar = sample / 2
+	} else {
+		delta := l.rtt - sample
+
+		if delta < 0 {
+			delta = -delta
+		}
+
+		l.rttVar += (delta - l.rttVar) / 4
+		l.rtt += (sample - l.rtt) / 8
+	}
+
+	l.timeout = l.rtt + 4*l.rttVar
+
+	if l.timeout < minTimeout {
+		l.timeout = minTimeout
+	}
+}
+
+func (l *ledbat) clamp() {
+	if l.window < minWindow {
+		l.window = minWindow
+	}
+
+	if l.window > maxWindow {
+		l.window = maxWindow
+	}
+}
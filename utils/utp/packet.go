@@ -0,0 +1,129 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// 报文类型
+const (
+	stData  = 0 // 数据
+	stFin   = 1 // 关闭连接, seq_nr为最后一个报文
+	stState = 2 // 只包含ack
+	stReset = 3 // 强制关闭连接
+	stSyn   = 4 // 建立连接
+)
+
+const (
+	version   = 1
+	headerLen = 20
+
+	extSelectiveAck = 1
+)
+
+// uTP报文头
+type header struct {
+	typ       int
+	ext       int // 第一个扩展的类型, 0表示没有扩展
+	connID    uint16
+	timestamp uint32 // 发送时间, 微秒
+	tsDiff    uint32 // 对端最近一个报文的单向延迟, 微秒
+	wndSize   uint32 // 接收窗口剩余字节数
+	seqNr     uint16
+	ackNr     uint16
+
+	sack []byte // selective ack bitmask, 第i位表示ack_nr+2+i已经收到
+}
+
+func (h *header) encode(payload []byte) []byte {
+	size := headerLen + len(payload)
+
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+
+	buf := make([]byte, size)
+
+	buf[0] = byte(h.typ<<4 | version)
+
+	if h.sack != nil {
+		buf[1] = extSelectiveAck
+	}
+
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], h.ackNr)
+
+	cur := headerLen
+
+	if h.sack != nil {
+		buf[cur] = 0
+		buf[cur+1] = byte(len(h.sack))
+		cur += 2 + copy(buf[cur+2:], h.sack)
+	}
+
+	copy(buf[cur:], payload)
+
+	return buf
+}
+
+// 解析报文, 返回报文头和数据
+func decodePacket(buf []byte) (*header, []byte, error) {
+	if len(buf) < headerLen {
+		return nil, nil, fmt.Errorf("utp packet too short: %d", len(buf))
+	}
+
+	if buf[0]&0x0f != version {
+		return nil, nil, fmt.Errorf("unsupported utp version: %d", buf[0]&0x0f)
+	}
+
+	h := &header{
+		typ:       int(buf[0] >> 4),
+		ext:       int(buf[1]),
+		connID:    binary.BigEndian.Uint16(buf[2:4]),
+		timestamp: binary.BigEndian.Uint32(buf[4:8]),
+		tsDiff:    binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:   binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:     binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:     binary.BigEndian.Uint16(buf[18:20]),
+	}
+
+	if h.typ > stSyn {
+		return nil, nil, fmt.Errorf("unknown utp packet type: %d", h.typ)
+	}
+
+	// 扩展链表: next_extension, len, data
+	cur := headerLen
+	ext := h.ext
+
+	for ext != 0 {
+		if cur+2 > len(buf) || cur+2+int(buf[cur+1]) > len(buf) {
+			return nil, nil, fmt.Errorf("malformed utp extension")
+		}
+
+		next, size := int(buf[cur]), int(buf[cur+1])
+
+		if ext == extSelectiveAck {
+			h.sack = buf[cur+2 : cur+2+size]
+		}
+
+		ext = next
+		cur += 2 + size
+	}
+
+	return h, buf[cur:], nil
+}
+
+// 当前时间的微秒数, 只使用低32位
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+// 考虑回绕的序号比较: a < b
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,193 @@
+package utp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       header
+		payload []byte
+	}{
+		{name: "syn", h: header{typ: stSyn, connID: 0x1234, timestamp: 1, wndSize: 1 << 20, seqNr: 1}},
+		{name: "data", h: header{typ: stData, connID: 7, timestamp: 0xffffffff, tsDiff: 500, seqNr: 0xffff, ackNr: 3}, payload: []byte("payload")},
+		{name: "state with sack", h: header{typ: stState, connID: 7, seqNr: 9, ackNr: 10, sack: []byte{0x03, 0x01, 0x00, 0x80}}},
+		{name: "data with sack", h: header{typ: stData, seqNr: 2, ackNr: 65535, sack: []byte{0xff, 0, 0, 0, 0, 0, 0, 1}}, payload: []byte{1, 2, 3}},
+		{name: "fin", h: header{typ: stFin, seqNr: 100, ackNr: 50}},
+		{name: "reset", h: header{typ: stReset, connID: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, payload, err := decodePacket(tt.h.encode(tt.payload))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.h
+
+			if want.sack != nil {
+				want.ext = extSelectiveAck
+			}
+
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("decodePacket() = %+v, want %+v", *got, want)
+			}
+
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("payload = %x, want %x", payload, tt.payload)
+			}
+		})
+	}
+}
+
+// BEP 29 的报文布局
+func TestHeaderLayout(t *testing.T) {
+	h := header{
+		typ:       stState,
+		connID:    0x0102,
+		timestamp: 0x03040506,
+		tsDiff:    0x0708090a,
+		wndSize:   0x0b0c0d0e,
+		seqNr:     0x0f10,
+		ackNr:     0x1112,
+		sack:      []byte{0xaa, 0xbb, 0xcc, 0xdd},
+	}
+
+	want := "21010102030405060708090a0b0c0d0e0f101112" + "0004aabbccdd" + "ff"
+
+	if got := hex.EncodeToString(h.encode([]byte{0xff})); got != want {
+		t.Errorf("encode() = %s, want %s", got, want)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	valid := (&header{typ: stData}).encode(nil)
+
+	withExt := func(ext byte, data ...byte) []byte {
+		buf := append([]byte{}, valid...)
+		buf[1] = ext
+
+		return append(buf, data...)
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{name: "short", buf: valid[:headerLen-1]},
+		{name: "version", buf: append([]byte{stData<<4 | 2}, valid[1:]...)},
+		{name: "type", buf: append([]byte{5<<4 | version}, valid[1:]...)},
+		{name: "truncated extension header", buf: withExt(extSelectiveAck, 0)},
+		{name: "truncated extension data", buf: withExt(extSelectiveAck, 0, 4, 0xff)},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := decodePacket(tt.buf); err == nil {
+			t.Errorf("%s: decodePacket() succeeded, want error", tt.name)
+		}
+	}
+
+	// 未知扩展被跳过, 之后的selective ack仍然被解析
+	h, payload, err := decodePacket(withExt(9, extSelectiveAck, 1, 0xee, 0, 4, 1, 2, 3, 4, 'x'))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(h.sack, []byte{1, 2, 3, 4}) || string(payload) != "x" {
+		t.Errorf("sack = %x, payload = %q", h.sack, payload)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xffff, 0, true},
+		{0, 0xffff, false},
+		{0xfff0, 0x0010, true},
+	}
+
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// 第i位表示ack_nr+2+i已经收到, 每个字节从低位开始
+func TestSelectiveAck(t *testing.T) {
+	tests := []struct {
+		name  string
+		ackNr uint16
+		ooo   []uint16
+		want  []byte
+	}{
+		{name: "empty", ackNr: 10},
+		{name: "bits", ackNr: 10, ooo: []uint16{12, 13, 20, 43}, want: []byte{0x03, 0x01, 0x00, 0x80}},
+		{name: "wraparound", ackNr: 0xfffe, ooo: []uint16{0, 1}, want: []byte{0x03, 0, 0, 0}},
+		{name: "out of range", ackNr: 10, ooo: []uint16{44}, want: []byte{0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn(nil, nil, 1, 2)
+			c.ackNr = tt.ackNr
+
+			for _, seq := range tt.ooo {
+				c.ooo[seq] = &inPacket{}
+			}
+
+			if got := c.selectiveAck(); !bytes.Equal(got, tt.want) {
+				t.Errorf("selectiveAck() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessSelectiveAck(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	now := time.Now()
+
+	for seq := uint16(1); seq <= 6; seq++ {
+		c.outbuf = append(c.outbuf, &outPacket{seqNr: seq, payload: make([]byte, 100), sentAt: now, transmissions: 1})
+		c.inFlight += 100
+	}
+
+	// 确认1, 并通过selective ack确认3和5
+	c.processAck(&header{typ: stState, ackNr: 1, sack: []byte{0x05, 0, 0, 0}}, now)
+
+	var seqs []uint16
+	var acked []uint16
+
+	for _, p := range c.outbuf {
+		seqs = append(seqs, p.seqNr)
+
+		if p.acked {
+			acked = append(acked, p.seqNr)
+		}
+	}
+
+	if !reflect.DeepEqual(seqs, []uint16{2, 3, 4, 5, 6}) {
+		t.Errorf("outbuf = %v, want [2 3 4 5 6]", seqs)
+	}
+
+	if !reflect.DeepEqual(acked, []uint16{3, 5}) {
+		t.Errorf("selectively acked = %v, want [3 5]", acked)
+	}
+
+	if c.inFlight != 300 {
+		t.Errorf("inFlight = %d, want 300", c.inFlight)
+	}
+}
@@ -0,0 +1,400 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tickInterval = 50 * time.Millisecond
+
+	minReadDelay = 10 * time.Millisecond // 读取失败后的等待时间, 连续失败时翻倍
+	maxReadDelay = time.Second
+)
+
+type connKey struct {
+	addr string
+	id   uint16 // 本地的接收连接id
+}
+
+// uTP socket, 一个UDP端口上复用多个连接
+//
+// 实现net.Listener, 对端发起的连接通过Accept返回;
+// bencode编码的数据报(如DHT消息)交给PacketConn, 使uTP与DHT可以共用一个端口
+type Socket struct {
+	pc *net.UDPConn
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	accept chan *Conn
+	shared *PacketConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 在addr上监听UDP
+func Listen(addr string) (*Socket, error) {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenUDP("udp", uaddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, 32),
+		closed: make(chan struct{}),
+	}
+
+	go s.readLoop()
+	go s.tickLoop()
+
+	return s, nil
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// 等待对端发起的连接
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// 关闭socket以及所有连接
+func (s *Socket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.pc.Close()
+
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+
+	return nil
+}
+
+// 与addr建立uTP连接
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+
+	var id uint16
+
+	// 选择一个未使用的连接id
+	for {
+		var b [2]byte
+		rand.Read(b[:])
+
+		id = binary.BigEndian.Uint16(b[:])
+
+		_, used := s.conns[connKey{raddr.String(), id}]
+		_, usedSend := s.conns[connKey{raddr.String(), id + 1}]
+
+		if !used && !usedSend {
+			break
+		}
+	}
+
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+
+	s.mu.Unlock()
+
+	c.connect()
+
+	// timeout为0时一直等待, 直到SYN重传超时
+	var deadline time.Time
+
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err = c.waitConnected(deadline)
+
+	if err != nil {
+		s.remove(c)
+		return nil, fmt.Errorf("utp dial %s: %w", addr, err)
+	}
+
+	return c, nil
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.raddr.String(), c.recvID}
+
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(buf []byte, addr *net.UDPAddr) error {
+	_, err := s.pc.WriteToUDP(buf, addr)
+
+	return err
+}
+
+// 对未知连接回复RESET
+func (s *Socket) reset(h *header, addr *net.UDPAddr) {
+	r := &header{
+		typ:       stReset,
+		connID:    h.connID,
+		timestamp: nowMicro(),
+		seqNr:     0,
+		ackNr:     h.seqNr,
+	}
+
+	s.send(r.encode(nil), addr)
+}
+
+// 连续读取失败后的下一次等待时间
+func nextReadDelay(d time.Duration) time.Duration {
+	if d < minReadDelay {
+		return minReadDelay
+	}
+
+	if d *= 2; d > maxReadDelay {
+		d = maxReadDelay
+	}
+
+	return d
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+
+	var delay time.Duration
+
+	for {
+		n, addr, err := s.pc.ReadFromUDP(buf)
+
+		if err != nil {
+			// 连接只在Close时关闭, 其他错误(如ICMP不可达)可能持续出现, 等待后重试
+			delay = nextReadDelay(delay)
+
+			select {
+			case <-s.closed:
+				return
+			case <-time.After(delay):
+			}
+
+			continue
+		}
+
+		delay = 0
+
+		if isBencoded(buf[:n]) {
+			s.deliver(buf[:n], addr)
+			continue
+		}
+
+		h, payload, err := decodePacket(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		// payload指向复用的缓冲区, 需要复制
+		data := make([]byte, len(payload))
+		copy(data, payload)
+
+		if h.sack != nil {
+			h.sack = append([]byte{}, h.sack...)
+		}
+
+		s.dispatch(h, data, addr)
+	}
+}
+
+// 是否为bencode字典, uTP包的第一个字节是type和version, 不会是'd'
+func isBencoded(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == 'd'
+}
+
+// 交给共用socket的其他协议, 没有PacketConn或者队列已满时丢弃
+func (s *Socket) deliver(buf []byte, addr *net.UDPAddr) {
+	s.mu.Lock()
+	p := s.shared
+	s.mu.Unlock()
+
+	if p == nil {
+		return
+	}
+
+	data := make([]byte, len(buf))
+	copy(data, buf)
+
+	select {
+	case p.in <- datagram{data, addr}:
+	default:
+	}
+}
+
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// 与uTP共用socket的UDP连接, 用于DHT
+//
+// 关闭PacketConn不会关闭socket
+type PacketConn struct {
+	s *Socket
+
+	in        chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 共用socket的UDP连接, 多次调用返回同一个连接
+func (s *Socket) PacketConn() *PacketConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shared == nil {
+		s.shared = &PacketConn{
+			s:      s,
+			in:     make(chan datagram, 256),
+			closed: make(chan struct{}),
+		}
+	}
+
+	return s.shared
+}
+
+func (p *PacketConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case d := <-p.in:
+		return copy(b, d.data), d.addr, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-p.s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (p *PacketConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return p.s.pc.WriteToUDP(b, addr)
+}
+
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.s.pc.LocalAddr()
+}
+
+func (p *PacketConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+
+	return nil
+}
+
+func (s *Socket) dispatch(h *header, payload []byte, addr *net.UDPAddr) {
+	s.mu.Lock()
+
+	if h.typ == stSyn {
+		key := connKey{addr.String(), h.connID + 1}
+		c, ok := s.conns[key]
+
+		if !ok {
+			c = newConn(s, addr, h.connID+1, h.connID)
+			s.conns[key] = c
+			s.mu.Unlock()
+
+			c.accepted(h)
+
+			select {
+			case s.accept <- c:
+			default:
+				// accept队列已满
+				s.remove(c)
+				s.reset(h, addr)
+			}
+
+			return
+		}
+
+		s.mu.Unlock()
+
+		// 重复的SYN, 重新回复STATE
+		c.handle(h, payload)
+
+		return
+	}
+
+	c, ok := s.conns[connKey{addr.String(), h.connID}]
+	s.mu.Unlock()
+
+	if !ok {
+		if h.typ != stReset {
+			s.reset(h, addr)
+		}
+
+		return
+	}
+
+	c.handle(h, payload)
+}
+
+// 定期检查重传和超时
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+
+		conns := make([]*Conn, 0, len(s.conns))
+
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+
+		s.mu.Unlock()
+
+		now := time.Now()
+
+		for _, c := range conns {
+			if c.tick(now) {
+				s.remove(c)
+			}
+		}
+	}
+}
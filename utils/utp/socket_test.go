@@ -0,0 +1,131 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) *Socket {
+	t.Helper()
+
+	s, err := Listen("127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestTransfer(t *testing.T) {
+	server := listen(t)
+	client := listen(t)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		conn, err := server.Accept()
+
+		if err != nil {
+			received <- nil
+			return
+		}
+
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		buf, _ := io.ReadAll(conn)
+		received <- buf
+	}()
+
+	conn, err := client.DialTimeout(server.Addr().String(), 5*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Fatalf("received %d bytes, want %d bytes", len(got), len(data))
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("transfer timed out")
+	}
+}
+
+// bencode字典交给PacketConn, 与uTP连接共用端口
+func TestSharedPacketConn(t *testing.T) {
+	s := listen(t)
+	pc := s.PacketConn()
+
+	if s.PacketConn() != pc {
+		t.Fatal("PacketConn() returned a different conn")
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer udp.Close()
+
+	msg := []byte("d1:y1:qe")
+	raddr := s.Addr().(*net.UDPAddr)
+
+	if _, err := udp.WriteToUDP(msg, raddr); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFromUDP(buf)
+
+	if err != nil || !bytes.Equal(buf[:n], msg) || from.Port != udp.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("ReadFromUDP() = %q from %v, %v", buf[:n], from, err)
+	}
+
+	// 通过共用的socket回复
+	if _, err := pc.WriteToUDP([]byte("d1:y1:re"), from); err != nil {
+		t.Fatal(err)
+	}
+
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, _, err = udp.ReadFromUDP(buf)
+
+	if err != nil || string(buf[:n]) != "d1:y1:re" {
+		t.Fatalf("reply = %q, %v", buf[:n], err)
+	}
+
+	// 关闭PacketConn不影响socket
+	pc.Close()
+
+	if _, _, err := pc.ReadFromUDP(buf); err != net.ErrClosed {
+		t.Errorf("ReadFromUDP() after Close = %v, want net.ErrClosed", err)
+	}
+
+	other := listen(t)
+
+	if conn, err := other.DialTimeout(raddr.String(), 5*time.Second); err != nil {
+		t.Errorf("dial after closing PacketConn: %v", err)
+	} else {
+		conn.Close()
+	}
+}